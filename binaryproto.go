@@ -0,0 +1,81 @@
+package dmrgo
+
+// Protocol for values in a binary encoding, such as MessagePack
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"encoding/base64"
+	"reflect"
+)
+
+// BinaryCodec encodes values in a binary format.  Wrap your library's
+// encoder to use it with BinaryProtocol; dmrgo doesn't depend on one.  The
+// msgpack subpackage has a BinaryCodec for MessagePack.
+type BinaryCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// BinaryProtocol encodes values with a BinaryCodec, which can be smaller and
+// faster to decode than JSON for struct-heavy jobs.  The binary encoding is
+// base64 encoded so values stay on a single line.  Keys are primitives,
+// written as by TSVProtocol, so they sort as text.
+type BinaryProtocol struct {
+	Codec BinaryCodec
+}
+
+var _ StreamProtocol = (*BinaryProtocol)(nil)
+var _ ValueUnmarshaler = (*BinaryProtocol)(nil)
+
+// Marshal implements the StreamProtocol interface.  A nil sortKey is written as no sort key.
+func (p *BinaryProtocol) Marshal(reduceKey interface{}, sortKey interface{}, value interface{}) *KeyValue {
+	b, _ := p.Codec.Marshal(value)
+	r, s := marshalKeys(reduceKey, sortKey)
+	return &KeyValue{r, s, base64.StdEncoding.EncodeToString(b)}
+}
+
+// UnmarshalKVs implements the StreamProtocol interface
+func (p *BinaryProtocol) UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) error {
+
+	var errs RecordErrors
+
+	if err := scanField(key, reflect.ValueOf(k).Elem()); err != nil {
+		errs.add(-1, err)
+	}
+
+	vsPtrValue := reflect.ValueOf(vs)
+	vsType := reflect.TypeOf(vs).Elem()
+
+	v := reflect.MakeSlice(vsType, len(values), len(values))
+
+	for i, s := range values {
+		p.unmarshalValue(s, v.Index(i), i, &errs)
+	}
+
+	vsPtrValue.Elem().Set(v)
+
+	return errs.err()
+}
+
+// UnmarshalValue implements the ValueUnmarshaler interface
+func (p *BinaryProtocol) UnmarshalValue(value string, v interface{}) error {
+	var errs RecordErrors
+	p.unmarshalValue(value, reflect.ValueOf(v).Elem(), 0, &errs)
+	return errs.err()
+}
+
+// unmarshalValue decodes the vi'th value into e, recording any errors in errs
+func (p *BinaryProtocol) unmarshalValue(s string, e reflect.Value, vi int, errs *RecordErrors) {
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		errs.add(vi, err)
+		return // skip
+	}
+
+	if err := p.Codec.Unmarshal(b, e.Addr().Interface()); err != nil {
+		// skip, unless we're being strict
+		errs.add(vi, err)
+	}
+}
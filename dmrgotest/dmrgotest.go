@@ -0,0 +1,76 @@
+// Package dmrgotest provides helpers for testing dmrgo jobs
+package dmrgotest
+
+// Test helpers for map reduce jobs
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dgryski/dmrgo"
+)
+
+// AssertDeterministic runs job over input twice in memory, with
+// dmrgo.RunLocal, and fails the test unless both runs produce byte-identical
+// output.  This catches jobs whose output depends on map iteration order,
+// the clock or an unseeded random number generator.  It doesn't catch
+// dependence on scheduling: RunLocal maps and reduces on a single goroutine,
+// in input order, so the values for a key arrive in the same order both
+// times.  The same job is run both times, so it must not carry state from one
+// run to the next.
+func AssertDeterministic(t testing.TB, job dmrgo.MapReduceJob, input string) {
+
+	t.Helper()
+
+	first, err := run(job, input)
+	if err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+
+	second, err := run(job, input)
+	if err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+
+	if bytes.Equal(first, second) {
+		return
+	}
+
+	a := strings.Split(string(first), "\n")
+	b := strings.Split(string(second), "\n")
+
+	line := 0
+	for line < len(a) && line < len(b) && a[line] == b[line] {
+		line++
+	}
+
+	t.Errorf("job output differs between runs at line %d:\nfirst:  %q\nsecond: %q", line+1, lineOf(a, line), lineOf(b, line))
+}
+
+// run runs the job and returns its output as "reduceKey\tsortKey\tvalue" lines
+func run(job dmrgo.MapReduceJob, input string) ([]byte, error) {
+
+	kvs, err := dmrgo.RunLocal(job, strings.NewReader(input))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, kv := range kvs {
+		fmt.Fprintf(&buf, "%s\t%s\t%s\n", kv.ReduceKey, kv.SortKey, kv.Value)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// lineOf returns the n'th line, or a marker if the output has ended
+func lineOf(lines []string, n int) string {
+	if n < len(lines) {
+		return lines[n]
+	}
+	return "(end of output)"
+}
@@ -0,0 +1,98 @@
+package dmrgotest
+
+// Tests for the test helpers
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dgryski/dmrgo"
+)
+
+// recorder is a testing.TB which records failures instead of failing the test
+type recorder struct {
+	testing.TB
+	failed bool
+	msg    string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.failed = true
+	r.msg = fmt.Sprintf(format, args...)
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+}
+
+// distinctJob emits the distinct words for each first letter.  With sorted
+// set, they are sorted; otherwise they come out in map iteration order.
+type distinctJob struct {
+	sorted bool
+}
+
+func (j *distinctJob) Map(key string, value string, emitter dmrgo.Emitter) {
+	for _, w := range strings.Fields(value) {
+		emitter.Emit(w[:1], "", w)
+	}
+}
+
+func (j *distinctJob) MapFinal(emitter dmrgo.Emitter) {}
+
+func (j *distinctJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter dmrgo.Emitter) {
+
+	seen := make(map[string]bool)
+	for v := range values {
+		seen[v] = true
+	}
+
+	var words []string
+	for w := range seen {
+		words = append(words, w)
+	}
+	if j.sorted {
+		sort.Strings(words)
+	}
+
+	emitter.Emit(reduceKey, "", strings.Join(words, ","))
+}
+
+func TestAssertDeterministic(t *testing.T) {
+
+	var words []string
+	for i := 0; i < 100; i++ {
+		words = append(words, fmt.Sprintf("w%03d", i))
+	}
+	input := strings.Join(words, " ") + "\n" + strings.Join(words[:50], " ") + "\n"
+
+	var tests = []struct {
+		name  string
+		job   dmrgo.MapReduceJob
+		fails bool
+	}{
+		{"deterministic", &distinctJob{sorted: true}, false},
+		{"map iteration order", &distinctJob{sorted: false}, true},
+	}
+
+	for _, tt := range tests {
+		// two runs can happen to iterate in the same order, so give the nondeterministic job a few chances to differ
+		failed := false
+		for i := 0; i < 10 && !failed; i++ {
+			r := &recorder{TB: t}
+			AssertDeterministic(r, tt.job, input)
+			failed = r.failed
+			if failed && !tt.fails {
+				t.Errorf("%s: %s", tt.name, r.msg)
+			}
+		}
+		if tt.fails && !failed {
+			t.Errorf("%s: AssertDeterministic didn't fail", tt.name)
+		}
+	}
+}
@@ -6,92 +6,630 @@ package dmrgo
 
 import (
 	"bufio"
+	"compress/gzip"
+	"container/list"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"hash/adler32"
+	"io"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // Emitter emits key/value pairs
 type Emitter interface {
 	Emit(reduceKey string, sortKey string, value string)
+
+	// Combine emits a key/value pair which may first be aggregated with
+	// others for the same key by the job's Combiner.  Emitters which don't
+	// combine emit the pair directly.
+	Combine(reduceKey string, value string)
+
+	// EmitAll emits a batch of key/value pairs, which may be cheaper than
+	// calling Emit for each of them
+	EmitAll(kvs []*KeyValue)
+
 	Flush()
+
+	// Close flushes the emitter and releases any files it opened.  The
+	// runner always closes the emitters it creates, even if a phase fails.
+	Close()
+}
+
+// emitAll is the straightforward EmitAll, for emitters with nothing to gain from batching
+func emitAll(e Emitter, kvs []*KeyValue) {
+	for _, kv := range kvs {
+		e.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+	}
 }
 
+// OutputRewriter, if set, is applied to every line of final (reduce) output
+// before it is written.  The line is passed without its trailing newline.
+var OutputRewriter func(line string) string
+
 type printEmitter struct {
-	w *bufio.Writer
+	w       *bufio.Writer
+	rewrite func(line string) string
+	delim   string // record delimiter
+
+	// map output has its keys normalized and its sort keys padded
+	mapOutput bool
+
+	// spill files always have the key separator, even with no sort key,
+	// so sort can split every line at it
+	spill bool
 }
 
 func newPrintEmitter(w *bufio.Writer) *printEmitter {
 	e := new(printEmitter)
 	e.w = w
+	e.delim = "\n"
+	return e
+}
+
+// newMapOutputEmitter returns an emitter for intermediate map output
+func newMapOutputEmitter(w *bufio.Writer) *printEmitter {
+	e := newPrintEmitter(w)
+	e.mapOutput = true
+	return e
+}
+
+// newSpillEmitter returns an emitter for map output to be sorted by sortPartition
+func newSpillEmitter(w *bufio.Writer) *printEmitter {
+	e := newMapOutputEmitter(w)
+	e.spill = true
+	return e
+}
+
+// newOutputEmitter returns an emitter for final job output, as opposed to intermediate map output
+func newOutputEmitter(w *bufio.Writer) Emitter {
+	if optDelimitedOutput {
+		return NewDelimitedEmitter(w)
+	}
+	e := newPrintEmitter(w)
+	e.rewrite = OutputRewriter
+	e.delim = outputDelimiter()
 	return e
 }
 
 func (e *printEmitter) Emit(reduceKey string, sortKey string, value string) {
 
-	e.w.WriteString(url.QueryEscape(reduceKey))
+	if e.mapOutput {
+		reduceKey = normalizeKey(reduceKey)
+		sortKey = padSortKey(sortKey)
+	}
+	withSortKey := sortKey != "" || e.spill
 
-	if sortKey != "" {
-		e.w.WriteString(",")
-		e.w.WriteString(url.QueryEscape(sortKey))
+	if e.rewrite != nil {
+		line := escapeKey(reduceKey)
+		if withSortKey {
+			line += string([]byte{keySeparator}) + escapeKey(sortKey)
+		}
+		line += string([]byte{fieldSeparator}) + escapeValue(value)
+		e.w.WriteString(e.rewrite(line))
+		e.w.WriteString(e.delim)
+		return
 	}
 
-	e.w.WriteByte('\t')
-	e.w.WriteString(value)
-	e.w.WriteByte('\n')
+	e.w.WriteString(escapeKey(reduceKey))
+
+	if withSortKey {
+		e.w.WriteByte(keySeparator)
+		e.w.WriteString(escapeKey(sortKey))
+	}
+
+	e.w.WriteByte(fieldSeparator)
+	e.w.WriteString(escapeValue(value))
+	e.w.WriteString(e.delim)
+}
+
+// emitKey writes just a key on its own line
+func (e *printEmitter) emitKey(reduceKey string) {
+	line := escapeKey(reduceKey)
+	if e.rewrite != nil {
+		line = e.rewrite(line)
+	}
+	e.w.WriteString(line)
+	e.w.WriteString(e.delim)
+}
+
+// fieldSeparator separates the keys from the value in a record, and
+// keySeparator separates the reduce key from the sort key
+var fieldSeparator byte = '\t'
+var keySeparator byte = ','
+
+// SetFieldSeparator sets the byte separating keys from values in map output
+// and reducer input and output, like Hadoop streaming's
+// stream.map.output.field.separator.  The default is a tab.
+func SetFieldSeparator(sep byte) {
+	fieldSeparator = sep
+}
+
+// SetKeySeparator sets the byte separating the reduce key from the sort key.
+// The default is a comma.
+func SetKeySeparator(sep byte) {
+	keySeparator = sep
+}
+
+// checkSeparators makes sure the separators can't be confused with each other or with an escaped key
+func checkSeparators() error {
+	for _, sep := range []byte{fieldSeparator, keySeparator} {
+		if sep == '%' || sep == '\n' {
+			return fmt.Errorf("bad separator %q", sep)
+		}
+	}
+	if fieldSeparator == keySeparator {
+		return fmt.Errorf("the field and key separators are both %q", fieldSeparator)
+	}
+	if optKeyEncoding == "base64" {
+		for _, sep := range []byte{fieldSeparator, keySeparator} {
+			if isBase64URLByte(sep) {
+				return fmt.Errorf("separator %q can appear in base64 keys", sep)
+			}
+		}
+	}
+	return nil
+}
+
+// isBase64URLByte returns whether c is in the alphabet of base64.RawURLEncoding
+func isBase64URLByte(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_'
+}
+
+// escapeKey encodes a key for the stream, with the --key-encoding.  Keys are
+// escaped every time they are written, so a key which decoded to contain a
+// separator or newline (say, from a mapper which escaped it twice) is written
+// back out safely rather than corrupting the record.
+func escapeKey(key string) string {
+
+	switch optKeyEncoding {
+	case "base64":
+		return base64.RawURLEncoding.EncodeToString([]byte(key))
+	case "none":
+		return key
+	}
+
+	k := url.QueryEscape(key)
+	for _, sep := range []byte{fieldSeparator, keySeparator} {
+		// separators such as '.' aren't escaped by QueryEscape, and '+' is how it writes a space
+		if strings.IndexByte(k, sep) < 0 {
+			continue
+		}
+		esc := fmt.Sprintf("%%%02X", sep)
+		if sep == '+' {
+			esc = "%20"
+		}
+		k = strings.Replace(k, string([]byte{sep}), esc, -1)
+	}
+	return k
+}
+
+// with --escape-values, newlines in values are written as "\n" and
+// backslashes as "\\", so a value can't be split over lines
+var valueEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+var valueUnescaper = strings.NewReplacer("\\\\", "\\", "\\n", "\n")
+
+// escapeValue encodes a value for the stream with --escape-values
+func escapeValue(value string) string {
+	if !optEscapeValues {
+		return value
+	}
+	return valueEscaper.Replace(value)
+}
+
+// unescapeValue decodes a value escaped by escapeValue
+func unescapeValue(value string) string {
+	if !optEscapeValues {
+		return value
+	}
+	return valueUnescaper.Replace(value)
+}
+
+// normalizeKey puts a reduce key into Unicode NFC with --nfc-keys, so keys
+// which are canonically equivalent but differently encoded (such as a
+// precomposed "é" and "e" followed by a combining accent) are partitioned and
+// grouped together
+func normalizeKey(key string) string {
+	if !optNFCKeys {
+		return key
+	}
+	return norm.NFC.String(key)
+}
+
+// unescapeKey decodes a key read from the stream
+func unescapeKey(key string) (string, error) {
+
+	switch optKeyEncoding {
+	case "base64":
+		b, err := base64.RawURLEncoding.DecodeString(key)
+		return string(b), err
+	case "none":
+		return key, nil
+	}
+
+	return url.QueryUnescape(key)
+}
+
+// outputDelimiter returns the --record-delimiter with its escape sequences
+// interpreted.  Validate has already checked it.
+func outputDelimiter() string {
+	d, err := strconv.Unquote(`"` + optRecordDelimiter + `"`)
+	if err != nil {
+		fail(fmt.Errorf("bad --record-delimiter %q: %v", optRecordDelimiter, err))
+		return "\n"
+	}
+	return d
+}
+
+// keyEmitter is implemented by emitters which can write a bare key, for --keys-only output
+type keyEmitter interface {
+	emitKey(reduceKey string)
+}
+
+// emitKeyOnly writes just the key if the emitter supports it, or the key with an empty value if not
+func emitKeyOnly(e Emitter, reduceKey string) {
+	if ke, ok := e.(keyEmitter); ok {
+		ke.emitKey(reduceKey)
+		return
+	}
+	e.Emit(reduceKey, "", "")
+}
+
+// writeSentinel writes a line as-is
+func (e *printEmitter) writeSentinel(line string) {
+	e.w.WriteString(line)
+	e.w.WriteString(e.delim)
+}
+
+// sentinelWriter is implemented by emitters which can write a raw line, for --group-sentinel
+type sentinelWriter interface {
+	writeSentinel(line string)
+}
+
+// emitSentinel writes the end-of-group line if the emitter supports it, or an
+// empty record with the line as its key if not.  For --delimited-output that
+// is a zero-length record, which makes a natural marker.
+func emitSentinel(e Emitter, line string) {
+	if sw, ok := e.(sentinelWriter); ok {
+		sw.writeSentinel(line)
+		return
+	}
+	e.Emit(line, "", "")
+}
+
+func (e *printEmitter) Combine(reduceKey string, value string) {
+	e.Emit(reduceKey, "", value)
+}
+
+func (e *printEmitter) EmitAll(kvs []*KeyValue) {
+	emitAll(e, kvs)
 }
 
 func (e *printEmitter) Flush() {
 	e.w.Flush()
 }
 
+// Close flushes the emitter; the underlying writer belongs to the caller
+func (e *printEmitter) Close() {
+	e.Flush()
+}
+
+// partitionEmitter writes map output to spill files, one set per partition.
+// Spill files are only created when the first record for their partition is
+// emitted, so a mapper which emits nothing leaves no empty files to sort.
 type partitionEmitter struct {
 	partitions       uint32
-	FileNames        []string
+	FileNames        [][]string
 	fds              []*os.File
 	emitters         []Emitter
+	writers          []*bufio.Writer
+	counters         []*countingWriter
 	fileNameTemplate string
+
+	// start a new spill file for a partition once it reaches this many bytes (0 means never)
+	rollSize int64
+
+	// the job's partitioner, or nil for PartitionFor
+	partition PartitionFunc
+
+	// in-mapper combining: values are buffered by key until there are
+	// combineLimit of them, then run through the job's Combiner
+	combiner     Combiner
+	combineBuf   map[string][]string
+	combineCount int
+	combineLimit int
+	combining    bool
+}
+
+// PartitionKeyFunc, if set, transforms reduce keys before they are assigned
+// to a partition, e.g. to normalize case so "Foo" and "foo" are reduced by the
+// same reducer.  It is only used for partitioning; the emitted key is
+// unchanged.  If GroupKey is also set, it is applied to the group key.
+var PartitionKeyFunc func(reduceKey string) string
+
+// MapOutputTransform, if set, is applied to every record of map output before
+// it is partitioned and written to the spill files, e.g. to tag values for
+// debugging.  It may modify and return the record, return a new one, or
+// return nil to drop it.  Combined records are transformed as they are
+// spilled, after the combiner has run.
+var MapOutputTransform func(kv *KeyValue) *KeyValue
+
+// PartitionFor returns the partition, in [0, n), that map output with the given reduce key is sent to
+func PartitionFor(key string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return int(adler32.Checksum([]byte(key)) % uint32(n))
+}
+
+// PartitionFunc assigns a reduce key to a partition in [0, numPartitions)
+type PartitionFunc func(reduceKey string, numPartitions uint) uint
+
+// Partitioner is implemented by jobs which choose the partition for their
+// map output, e.g. so related keys are reduced together.  Partition is
+// called with the key after GroupKey and PartitionKeyFunc.  Jobs without a
+// Partitioner are partitioned by PartitionFor.
+type Partitioner interface {
+	Partition(reduceKey string, numPartitions uint) uint
+}
+
+// partitionerFor returns the job's partitioner, or nil to use PartitionFor
+func partitionerFor(mrjob MapReduceJob) PartitionFunc {
+	if p, ok := mrjob.(Partitioner); ok {
+		return p.Partition
+	}
+	return nil
+}
+
+// KeyFieldPartitioner returns a PartitionFunc which partitions on the first
+// n comma-separated fields of the reduce key, like Hadoop's
+// KeyFieldBasedPartitioner, so keys which share them go to the same
+// partition.
+func KeyFieldPartitioner(n int) PartitionFunc {
+	return func(reduceKey string, numPartitions uint) uint {
+		fields := strings.SplitN(reduceKey, ",", n+1)
+		if len(fields) > n {
+			fields = fields[:n]
+		}
+		return uint(PartitionFor(strings.Join(fields, ","), int(numPartitions)))
+	}
 }
 
 // data sink -- useful for benchmarking
 type nullEmitter struct{}
 
-func (*nullEmitter) Emit(key string, value string) { /* nothing */
+func (*nullEmitter) Emit(reduceKey string, sortKey string, value string) { /* nothing */
+}
+func (*nullEmitter) Combine(reduceKey string, value string) { /* nothing */
+}
+func (*nullEmitter) EmitAll(kvs []*KeyValue) { /* nothing */
 }
 func (*nullEmitter) Flush() { /* nothing */
 }
+func (*nullEmitter) Close() { /* nothing */
+}
 
-func newPartitionEmitter(partitions uint, template string) *partitionEmitter {
+func newPartitionEmitter(partitions uint, template string, combiner Combiner, partition PartitionFunc) *partitionEmitter {
 	pe := new(partitionEmitter)
 	pe.partitions = uint32(partitions)
+	pe.partition = partition
 	pe.fileNameTemplate = template
-	pe.FileNames = make([]string, partitions)
+	pe.FileNames = make([][]string, partitions)
 	pe.fds = make([]*os.File, partitions)
 	pe.emitters = make([]Emitter, partitions)
+	pe.writers = make([]*bufio.Writer, partitions)
+	pe.counters = make([]*countingWriter, partitions)
+	pe.rollSize = optSpillSize
+	if combiner != nil {
+		pe.combiner = combiner
+		pe.combineBuf = make(map[string][]string)
+		pe.combineLimit = optCombineBuffer
+	}
 	return pe
 }
 
+// spillFileName returns the name of the n'th spill file for a partition.
+// The partition is always the final suffix so the reducers can glob for it.
+func (e *partitionEmitter) spillFileName(partition uint32, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%s.%04d", e.fileNameTemplate, partition)
+	}
+	return fmt.Sprintf("%s-r%d.%04d", e.fileNameTemplate, n, partition)
+}
+
+// open the next spill file for a partition, closing the current one
+func (e *partitionEmitter) openSpill(partition uint32) error {
+
+	if e.fds[partition] != nil {
+		e.writers[partition].Flush()
+		e.fds[partition].Close()
+		e.fds[partition] = nil
+		e.emitters[partition] = nil
+	}
+
+	fname := e.spillFileName(partition, len(e.FileNames[partition]))
+	// the default TempFileFunc never overwrites an existing spill -- a name collision would silently lose another mapper's output
+	fd, err := TempFileFunc(fname)
+	if err != nil {
+		return err
+	}
+	e.FileNames[partition] = append(e.FileNames[partition], fname)
+	e.fds[partition] = fd
+	e.counters[partition] = &countingWriter{w: fd}
+	e.writers[partition] = bufio.NewWriter(e.counters[partition])
+	e.emitters[partition] = newSpillEmitter(e.writers[partition])
+
+	return nil
+}
+
 func (e *partitionEmitter) Emit(reduceKey string, sortKey string, value string) {
 
-	partition := uint32(0)
+	if MapOutputTransform != nil {
+		kv := MapOutputTransform(&KeyValue{reduceKey, sortKey, value})
+		if kv == nil {
+			return
+		}
+		reduceKey, sortKey, value = kv.ReduceKey, kv.SortKey, kv.Value
+	}
+
+	reduceKey = normalizeKey(reduceKey)
 
-	if e.partitions > 1 {
-		partition = adler32.Checksum([]byte(reduceKey)) % uint32(e.partitions)
+	partition, err := e.partitionFor(reduceKey)
+	if err != nil {
+		fail(err)
+		return
 	}
 
-	if e.emitters[partition] == nil {
-		e.FileNames[partition] = fmt.Sprintf("%s.%04d", e.fileNameTemplate, partition)
-		fd, _ := os.Create(e.FileNames[partition])
-		e.fds[partition] = fd
-		w := bufio.NewWriter(fd)
-		e.emitters[partition] = newPrintEmitter(w)
+	if !e.readySpill(partition) {
+		return
 	}
 
 	e.emitters[partition].Emit(reduceKey, sortKey, value)
 }
 
+func (e *partitionEmitter) Combine(reduceKey string, value string) {
+
+	// without a combiner, or if the combiner itself is calling us
+	if e.combiner == nil || e.combining {
+		e.Emit(reduceKey, "", value)
+		return
+	}
+
+	reduceKey = normalizeKey(reduceKey)
+	e.combineBuf[reduceKey] = append(e.combineBuf[reduceKey], value)
+	e.combineCount++
+
+	if e.combineCount >= e.combineLimit {
+		e.spillCombined()
+	}
+}
+
+// partitionFor returns the partition for a normalized reduce key, after
+// GroupKey and PartitionKeyFunc
+func (e *partitionEmitter) partitionFor(reduceKey string) (uint32, error) {
+
+	partitionKey := reduceKey
+	if GroupKey != nil {
+		partitionKey = GroupKey(reduceKey)
+	}
+	if PartitionKeyFunc != nil {
+		partitionKey = PartitionKeyFunc(partitionKey)
+	}
+
+	return e.partitionOf(partitionKey)
+}
+
+// partitionOf returns the partition for a key, with the job's partitioner if it has one
+func (e *partitionEmitter) partitionOf(key string) (uint32, error) {
+
+	if e.partition == nil {
+		return uint32(PartitionFor(key, int(e.partitions))), nil
+	}
+
+	p := e.partition(key, uint(e.partitions))
+	if p >= uint(e.partitions) {
+		return 0, fmt.Errorf("partitioner returned partition %d for key %q, but there are only %d", p, key, e.partitions)
+	}
+
+	return uint32(p), nil
+}
+
+// readySpill opens a partition's first spill file, or rolls over to the next
+// one once the current one has reached the spill size.  It returns false if
+// the run has failed because the file couldn't be opened.
+func (e *partitionEmitter) readySpill(partition uint32) bool {
+
+	if e.emitters[partition] != nil && (e.rollSize <= 0 || e.counters[partition].n+int64(e.writers[partition].Buffered()) < e.rollSize) {
+		return true
+	}
+
+	if err := e.openSpill(partition); err != nil {
+		fail(err)
+		return false
+	}
+
+	return true
+}
+
+// EmitAll sorts the whole batch into partitions first, then writes each
+// partition's records to its spill file in one pass.  The spill file is
+// opened or rolled over once per batch rather than once per record, so with
+// --spill-size a spill file can overshoot by up to one batch.
+func (e *partitionEmitter) EmitAll(kvs []*KeyValue) {
+
+	transform := MapOutputTransform
+
+	batches := make([][]*KeyValue, e.partitions)
+	for _, kv := range kvs {
+		if transform != nil {
+			if kv = transform(&KeyValue{kv.ReduceKey, kv.SortKey, kv.Value}); kv == nil {
+				continue
+			}
+		}
+
+		reduceKey := normalizeKey(kv.ReduceKey)
+		partition, err := e.partitionFor(reduceKey)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		if reduceKey != kv.ReduceKey {
+			kv = &KeyValue{reduceKey, kv.SortKey, kv.Value}
+		}
+		batches[partition] = append(batches[partition], kv)
+	}
+
+	for partition, batch := range batches {
+		if len(batch) == 0 || !e.readySpill(uint32(partition)) {
+			continue
+		}
+		e.emitters[partition].EmitAll(batch)
+	}
+}
+
+// run the combiner over the buffered values and write its output to the spill files
+func (e *partitionEmitter) spillCombined() {
+
+	if e.combineCount == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(e.combineBuf))
+	for k := range e.combineBuf {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	e.combining = true
+	for _, k := range keys {
+		vs := e.combineBuf[k]
+		values := make(chan string, len(vs))
+		for _, v := range vs {
+			values <- v
+		}
+		close(values)
+		e.combiner.Combine(k, "", values, e)
+	}
+	e.combining = false
+
+	e.combineBuf = make(map[string][]string)
+	e.combineCount = 0
+}
+
 func (e *partitionEmitter) Flush() {
+	if e.combiner != nil {
+		e.spillCombined()
+	}
 	for _, w := range e.emitters {
 		if w != nil {
 			w.Flush()
@@ -100,9 +638,564 @@ func (e *partitionEmitter) Flush() {
 }
 
 func (e *partitionEmitter) Close() {
+	e.Flush()
 	for _, w := range e.fds {
 		if w != nil {
 			w.Close()
 		}
 	}
 }
+
+// routeEmitter sends each record to an output file chosen per record by a routing function.
+// A single routeEmitter is shared by all the reducers, so access is serialized.
+type routeEmitter struct {
+	mu               sync.Mutex
+	route            func(reduceKey, sortKey, value string) string
+	fileNameTemplate string
+	FileNames        []string
+	fds              map[string]outputFile
+	emitters         map[string]Emitter
+}
+
+func newRouteEmitter(route func(reduceKey, sortKey, value string) string, template string) *routeEmitter {
+	re := new(routeEmitter)
+	re.route = route
+	re.fileNameTemplate = template
+	re.fds = make(map[string]outputFile)
+	re.emitters = make(map[string]Emitter)
+	return re
+}
+
+func (e *routeEmitter) Emit(reduceKey string, sortKey string, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.emitLocked(reduceKey, sortKey, value)
+}
+
+func (e *routeEmitter) emitLocked(reduceKey string, sortKey string, value string) {
+
+	name := e.route(reduceKey, sortKey, value)
+
+	w, ok := e.emitters[name]
+	if !ok {
+		fname := fmt.Sprintf("%s.%s%s", e.fileNameTemplate, fileNamePart(name), outputExt())
+		fd, err := createOutputFile(fname)
+		if err != nil {
+			fail(err)
+			return
+		}
+		e.FileNames = append(e.FileNames, fname)
+		e.fds[name] = fd
+		w = newOutputEmitter(bufio.NewWriter(fd))
+		e.emitters[name] = w
+	}
+
+	w.Emit(reduceKey, sortKey, value)
+}
+
+func (e *routeEmitter) Flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, w := range e.emitters {
+		w.Flush()
+	}
+}
+
+func (e *routeEmitter) Combine(reduceKey string, value string) {
+	e.Emit(reduceKey, "", value)
+}
+
+// EmitAll routes a batch of records, taking the lock only once
+func (e *routeEmitter) EmitAll(kvs []*KeyValue) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, kv := range kvs {
+		e.emitLocked(kv.ReduceKey, kv.SortKey, kv.Value)
+	}
+}
+
+func (e *routeEmitter) Close() {
+	e.Flush()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, fd := range e.fds {
+		if err := closeOutputFile(fd); err != nil {
+			fail(err)
+		}
+	}
+}
+
+// fileNamePart escapes a key or output name for use in a file name.  The name
+// comes from the job's data, so it is url-encoded to make sure it can't
+// contain a path separator, and "." and ".." are encoded too, so it can't
+// escape the output directory.
+func fileNamePart(name string) string {
+	if name == "." || name == ".." {
+		return strings.Replace(name, ".", "%2E", -1)
+	}
+	return url.QueryEscape(name)
+}
+
+// outputFile is a reduce output file
+type outputFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// createOutputFile creates a reduce output file
+var createOutputFile = func(name string) (outputFile, error) {
+	return os.Create(name)
+}
+
+// closeOutputFile closes a reduce output file, first syncing it to disk if --fsync-output is set.
+// The caller must already have flushed anything buffered for it.
+func closeOutputFile(f outputFile) error {
+	if optFsyncOutput {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// sharedOutput is an emitter shared by all the reducers which writes to files it names itself
+type sharedOutput interface {
+	Emitter
+	fileNames() []string
+}
+
+func (e *routeEmitter) fileNames() []string {
+	return e.FileNames
+}
+
+// keyFileEmitter writes the records for each reduce key to a file of their
+// own, <dir>/<key>.txt (or the --output-ext).  Only maxOpen files are kept open: the least recently
+// written is closed to open another, and reopened for appending if its key
+// turns up again.  A single keyFileEmitter is shared by all the reducers, so
+// access is serialized.
+type keyFileEmitter struct {
+	mu      sync.Mutex
+	dir     string
+	maxOpen int
+	lru     *list.List // of *keyFile, most recently used first
+	open    map[string]*list.Element
+	created map[string]bool
+	names   []string
+}
+
+type keyFile struct {
+	key     string
+	fd      outputFile
+	emitter Emitter
+}
+
+func newKeyFileEmitter(dir string, maxOpen int) (*keyFileEmitter, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	if maxOpen < 1 {
+		maxOpen = 1
+	}
+	return &keyFileEmitter{
+		dir:     dir,
+		maxOpen: maxOpen,
+		lru:     list.New(),
+		open:    make(map[string]*list.Element),
+		created: make(map[string]bool),
+	}, nil
+}
+
+// file returns the open file for a key, opening it if need be.  If the file
+// can't be opened the run fails, and file returns nil.
+func (e *keyFileEmitter) file(key string) *keyFile {
+
+	if el, ok := e.open[key]; ok {
+		e.lru.MoveToFront(el)
+		return el.Value.(*keyFile)
+	}
+
+	if e.lru.Len() >= e.maxOpen {
+		e.closeFile(e.lru.Back())
+	}
+
+	ext := outputExt()
+	if ext == "" {
+		ext = ".txt"
+	}
+	fname := filepath.Join(e.dir, fileNamePart(key)+ext)
+
+	// truncate any file left from an earlier run, but append if we closed it ourselves
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !e.created[key] {
+		flags |= os.O_TRUNC
+	}
+
+	fd, err := os.OpenFile(fname, flags, 0666)
+	if err != nil {
+		fail(err)
+		return nil
+	}
+
+	if !e.created[key] {
+		e.created[key] = true
+		e.names = append(e.names, fname)
+	}
+
+	kf := &keyFile{key, fd, newOutputEmitter(bufio.NewWriter(fd))}
+	e.open[key] = e.lru.PushFront(kf)
+	return kf
+}
+
+func (e *keyFileEmitter) closeFile(el *list.Element) {
+	kf := e.lru.Remove(el).(*keyFile)
+	delete(e.open, kf.key)
+	kf.emitter.Close()
+	if err := closeOutputFile(kf.fd); err != nil {
+		fail(err)
+	}
+}
+
+func (e *keyFileEmitter) Emit(reduceKey string, sortKey string, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if kf := e.file(reduceKey); kf != nil {
+		kf.emitter.Emit(reduceKey, sortKey, value)
+	}
+}
+
+func (e *keyFileEmitter) Combine(reduceKey string, value string) {
+	e.Emit(reduceKey, "", value)
+}
+
+// EmitAll writes a batch of records, taking the lock only once
+func (e *keyFileEmitter) EmitAll(kvs []*KeyValue) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, kv := range kvs {
+		if kf := e.file(kv.ReduceKey); kf != nil {
+			kf.emitter.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+		}
+	}
+}
+
+func (e *keyFileEmitter) Flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for el := e.lru.Front(); el != nil; el = el.Next() {
+		el.Value.(*keyFile).emitter.Flush()
+	}
+}
+
+func (e *keyFileEmitter) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for e.lru.Len() > 0 {
+		e.closeFile(e.lru.Front())
+	}
+}
+
+func (e *keyFileEmitter) fileNames() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.names...)
+}
+
+// delimitedEmitter writes each value as a varint-length-prefixed binary record
+type delimitedEmitter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+// NewDelimitedEmitter returns an Emitter which writes only the values, each
+// prefixed with its length as an unsigned varint.  This is the
+// length-delimited framing used for streams of protocol buffer messages, so
+// a Reduce which emits marshaled messages as its values produces a file that
+// can be read with a standard delimited protobuf reader.  Keys are not
+// written.
+func NewDelimitedEmitter(w io.Writer) Emitter {
+	e := new(delimitedEmitter)
+	if bw, ok := w.(*bufio.Writer); ok {
+		e.w = bw
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+	return e
+}
+
+func (e *delimitedEmitter) Emit(reduceKey string, sortKey string, value string) {
+	n := binary.PutUvarint(e.buf[:], uint64(len(value)))
+	e.w.Write(e.buf[:n])
+	e.w.WriteString(value)
+}
+
+func (e *delimitedEmitter) Combine(reduceKey string, value string) {
+	e.Emit(reduceKey, "", value)
+}
+
+func (e *delimitedEmitter) EmitAll(kvs []*KeyValue) {
+	emitAll(e, kvs)
+}
+
+func (e *delimitedEmitter) Flush() {
+	e.w.Flush()
+}
+
+func (e *delimitedEmitter) Close() {
+	e.Flush()
+}
+
+// Producer publishes messages to a message queue such as a Kafka topic.
+// Wrap your client library's producer to use it with NewProducerEmitter.
+type Producer interface {
+	Produce(key, value []byte) error
+}
+
+// producerEmitter publishes each record as a message
+type producerEmitter struct {
+	p   Producer
+	err error
+}
+
+// NewProducerEmitter returns an Emitter which publishes each record to p as a
+// message, with the reduce key as the message key and the value as the
+// message body.  Publishing stops at the first error, which is returned by
+// EmitterError.
+func NewProducerEmitter(p Producer) Emitter {
+	return &producerEmitter{p: p}
+}
+
+func (e *producerEmitter) Emit(reduceKey string, sortKey string, value string) {
+	if e.err != nil {
+		return
+	}
+	e.err = e.p.Produce([]byte(reduceKey), []byte(value))
+}
+
+func (e *producerEmitter) Combine(reduceKey string, value string) {
+	e.Emit(reduceKey, "", value)
+}
+
+func (e *producerEmitter) EmitAll(kvs []*KeyValue) {
+	emitAll(e, kvs)
+}
+
+// Flush flushes the producer too, if it has a Flush method
+func (e *producerEmitter) Flush() {
+	if f, ok := e.p.(interface {
+		Flush() error
+	}); ok && e.err == nil {
+		e.err = f.Flush()
+	}
+}
+
+// Close flushes the emitter and closes the producer, if it has a Close method
+func (e *producerEmitter) Close() {
+	e.Flush()
+	if c, ok := e.p.(io.Closer); ok {
+		if err := c.Close(); err != nil && e.err == nil {
+			e.err = err
+		}
+	}
+}
+
+func (e *producerEmitter) Err() error {
+	return e.err
+}
+
+// funcEmitter passes each record to a callback
+type funcEmitter struct {
+	mu sync.Mutex
+	fn func(kv *KeyValue)
+}
+
+// NewFuncEmitter returns an Emitter which calls fn with each record, for
+// consuming output in the same process.  Calls to fn are serialized, so it
+// needn't be safe for concurrent use.  Combine calls fn with an empty sort key.
+func NewFuncEmitter(fn func(kv *KeyValue)) Emitter {
+	return &funcEmitter{fn: fn}
+}
+
+func (e *funcEmitter) Emit(reduceKey string, sortKey string, value string) {
+	e.mu.Lock()
+	e.fn(&KeyValue{ReduceKey: reduceKey, SortKey: sortKey, Value: value})
+	e.mu.Unlock()
+}
+
+func (e *funcEmitter) Combine(reduceKey string, value string) {
+	e.Emit(reduceKey, "", value)
+}
+
+func (e *funcEmitter) EmitAll(kvs []*KeyValue) {
+	emitAll(e, kvs)
+}
+
+func (e *funcEmitter) Flush() { /* nothing */
+}
+
+func (e *funcEmitter) Close() { /* nothing */
+}
+
+// EmitterError returns the first error encountered by an emitter which
+// reports errors (such as one from NewProducerEmitter), or nil
+func EmitterError(e Emitter) error {
+	if ee, ok := e.(interface {
+		Err() error
+	}); ok {
+		return ee.Err()
+	}
+	return nil
+}
+
+// lineFlushEmitter flushes the underlying emitter after every record, so
+// output reaches a live consumer (a pipe or socket) promptly
+type lineFlushEmitter struct {
+	Emitter
+}
+
+func (e *lineFlushEmitter) Emit(reduceKey string, sortKey string, value string) {
+	e.Emitter.Emit(reduceKey, sortKey, value)
+	e.Emitter.Flush()
+}
+
+func (e *lineFlushEmitter) emitKey(reduceKey string) {
+	emitKeyOnly(e.Emitter, reduceKey)
+	e.Emitter.Flush()
+}
+
+func (e *lineFlushEmitter) writeSentinel(line string) {
+	emitSentinel(e.Emitter, line)
+	e.Emitter.Flush()
+}
+
+func (e *lineFlushEmitter) Combine(reduceKey string, value string) {
+	e.Emitter.Combine(reduceKey, value)
+	e.Emitter.Flush()
+}
+
+// EmitAll flushes once after the whole batch
+func (e *lineFlushEmitter) EmitAll(kvs []*KeyValue) {
+	e.Emitter.EmitAll(kvs)
+	e.Emitter.Flush()
+}
+
+// sortedEmitter buffers the records emitted for one reduce key and writes them sorted
+type sortedEmitter struct {
+	Emitter
+	less func(a, b *KeyValue) bool
+	key  string
+	buf  []*KeyValue
+}
+
+// SortedEmitter returns an Emitter for Reduce which buffers the records
+// emitted for each reduce key and writes them to e sorted by less when the
+// key changes.  Wrap the emitter passed to Reduce once and reuse the wrapper
+// across calls, or Flush it before Reduce returns; the last key's records are
+// written on Flush or Close.
+func SortedEmitter(e Emitter, less func(a, b *KeyValue) bool) Emitter {
+	return &sortedEmitter{Emitter: e, less: less}
+}
+
+func (e *sortedEmitter) Emit(reduceKey string, sortKey string, value string) {
+	if len(e.buf) > 0 && reduceKey != e.key {
+		e.writeSorted()
+	}
+	e.key = reduceKey
+	e.buf = append(e.buf, &KeyValue{reduceKey, sortKey, value})
+}
+
+func (e *sortedEmitter) Combine(reduceKey string, value string) {
+	e.Emit(reduceKey, "", value)
+}
+
+func (e *sortedEmitter) EmitAll(kvs []*KeyValue) {
+	emitAll(e, kvs)
+}
+
+// writeSorted writes out the buffered records in order
+func (e *sortedEmitter) writeSorted() {
+	sort.SliceStable(e.buf, func(i, j int) bool {
+		return e.less(e.buf[i], e.buf[j])
+	})
+	e.Emitter.EmitAll(e.buf)
+	e.buf = nil
+}
+
+func (e *sortedEmitter) Flush() {
+	if len(e.buf) > 0 {
+		e.writeSorted()
+	}
+	e.Emitter.Flush()
+}
+
+func (e *sortedEmitter) Close() {
+	e.Flush()
+	e.Emitter.Close()
+}
+
+// newGzipWriter returns a gzip.Writer for w at the --gzip-level compression
+// level.  Validate has already checked the level.
+func newGzipWriter(w io.Writer) *gzip.Writer {
+	gz, err := gzip.NewWriterLevel(w, optGzipLevel)
+	if err != nil {
+		fail(err)
+		return gzip.NewWriter(w)
+	}
+	return gz
+}
+
+// recordCountEmitter counts the records passing through to the underlying emitter
+type recordCountEmitter struct {
+	Emitter
+	n *int64
+}
+
+func (e *recordCountEmitter) Emit(reduceKey string, sortKey string, value string) {
+	atomic.AddInt64(e.n, 1)
+	e.Emitter.Emit(reduceKey, sortKey, value)
+}
+
+func (e *recordCountEmitter) Combine(reduceKey string, value string) {
+	atomic.AddInt64(e.n, 1)
+	e.Emitter.Combine(reduceKey, value)
+}
+
+func (e *recordCountEmitter) EmitAll(kvs []*KeyValue) {
+	atomic.AddInt64(e.n, int64(len(kvs)))
+	e.Emitter.EmitAll(kvs)
+}
+
+func (e *recordCountEmitter) emitKey(reduceKey string) {
+	atomic.AddInt64(e.n, 1)
+	emitKeyOnly(e.Emitter, reduceKey)
+}
+
+// sentinels aren't records, so they aren't counted
+func (e *recordCountEmitter) writeSentinel(line string) {
+	emitSentinel(e.Emitter, line)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader adds the bytes read through it to a total shared between goroutines
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,1418 @@
+package dmrgo
+
+// Tests for the emitters
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// benchmarkRecords returns n records spread over many reduce keys
+func benchmarkRecords(n int) []*KeyValue {
+	kvs := make([]*KeyValue, n)
+	for i := range kvs {
+		kvs[i] = &KeyValue{fmt.Sprintf("key%d", i%1000), "", "value"}
+	}
+	return kvs
+}
+
+func benchmarkPartitionEmitter(b *testing.B, emit func(e *partitionEmitter, kvs []*KeyValue)) {
+	kvs := benchmarkRecords(1000)
+	e := newPartitionEmitter(8, filepath.Join(b.TempDir(), "tmp-map-out"), nil, nil)
+	defer e.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		emit(e, kvs)
+	}
+}
+
+func BenchmarkPartitionEmitterEmit(b *testing.B) {
+	benchmarkPartitionEmitter(b, func(e *partitionEmitter, kvs []*KeyValue) {
+		for _, kv := range kvs {
+			e.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+		}
+	})
+}
+
+func BenchmarkPartitionEmitterEmitAll(b *testing.B) {
+	benchmarkPartitionEmitter(b, func(e *partitionEmitter, kvs []*KeyValue) {
+		e.EmitAll(kvs)
+	})
+}
+
+// readSpills returns the contents of each of a partitionEmitter's spill files, partition by partition
+func readSpills(t testing.TB, e *partitionEmitter) [][]string {
+	t.Helper()
+	spills := make([][]string, len(e.FileNames))
+	for p, fns := range e.FileNames {
+		for _, fn := range fns {
+			b, err := os.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spills[p] = append(spills[p], string(b))
+		}
+	}
+	return spills
+}
+
+func TestPartitionEmitterEmitAll(t *testing.T) {
+
+	batches := [][]*KeyValue{
+		{{"a", "", "1"}, {"b", "s", "2"}, {"c", "", "3"}, {"a", "", "4"}},
+		{{"b", "", "5"}, {"d", "", "6"}},
+		{{"a", "t", "7"}, {"A\u030a", "", "8"}},
+	}
+
+	var tests = []struct {
+		name      string
+		spillSize int64
+		transform func(kv *KeyValue) *KeyValue
+		// the number of spill files EmitAll leaves for each partition
+		files []int
+	}{
+		{"plain", 0, nil, []int{1, 1}},
+		{"drop", 0, func(kv *KeyValue) *KeyValue {
+			if kv.ReduceKey == "b" {
+				return nil
+			}
+			kv.Value += "!"
+			return kv
+		}, []int{1, 1}},
+		// rolled over once per batch, not once per record
+		{"spill-size 1", 1, nil, []int{2, 2}},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optSpillSize, tt.spillSize)
+		setOpt(t, &MapOutputTransform, tt.transform)
+
+		one := newPartitionEmitter(2, filepath.Join(t.TempDir(), "tmp-map-out"), nil, nil)
+		all := newPartitionEmitter(2, filepath.Join(t.TempDir(), "tmp-map-out"), nil, nil)
+		for _, batch := range batches {
+			for _, kv := range batch {
+				one.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+			}
+			all.EmitAll(batch)
+		}
+		one.Close()
+		all.Close()
+
+		// the batch is left as it was
+		if v := batches[0][0].Value; v != "1" {
+			t.Errorf("%s: EmitAll changed a record's value to %q", tt.name, v)
+		}
+
+		got, want := readSpills(t, all), readSpills(t, one)
+		for p := range want {
+			if g, w := strings.Join(got[p], ""), strings.Join(want[p], ""); g != w {
+				t.Errorf("%s: partition %d: EmitAll spilled %q, Emit spilled %q", tt.name, p, g, w)
+			}
+			if len(got[p]) != tt.files[p] {
+				t.Errorf("%s: partition %d: %d spill files, want %d", tt.name, p, len(got[p]), tt.files[p])
+			}
+		}
+	}
+}
+
+func TestFileNamePart(t *testing.T) {
+
+	var tests = []struct {
+		name string
+		want string
+	}{
+		{"books", "books"},
+		{"a b", "a+b"},
+		{"../../etc/passwd", "..%2F..%2Fetc%2Fpasswd"},
+		{".", "%2E"},
+		{"..", "%2E%2E"},
+		{"...", "..."},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := fileNamePart(tt.name); got != tt.want {
+			t.Errorf("fileNamePart(%q)=%q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeyFileEmitter(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// with only two files open, "a" is closed for "c" and reopened after
+	e, err := newKeyFileEmitter(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range []KeyValue{
+		{"a", "", "1"},
+		{"b", "", "2"},
+		{"c", "", "3"},
+		{"a", "", "4"},
+		{"../x", "", "5"},
+	} {
+		e.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+	}
+	e.Close()
+
+	var tests = []struct {
+		file string
+		want string
+	}{
+		{"a.txt", "a\t1\na\t4\n"},
+		{"b.txt", "b\t2\n"},
+		{"c.txt", "c\t3\n"},
+		{"..%2Fx.txt", "..%2Fx\t5\n"},
+	}
+
+	for _, tt := range tests {
+		b, err := os.ReadFile(filepath.Join(dir, tt.file))
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s=%q, want %q", tt.file, b, tt.want)
+		}
+	}
+
+	if names := e.fileNames(); len(names) != len(tests) {
+		t.Errorf("fileNames()=%q, want %d files", names, len(tests))
+	}
+}
+
+func TestSpillRollOver(t *testing.T) {
+
+	var input strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&input, "k%02d\n", i%10)
+	}
+
+	var tests = []struct {
+		spillSize int64
+		minFiles  int
+	}{
+		{0, 1},
+		{1, 100},
+		{64, 8},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optSpillSize, tt.spillSize)
+		setOpt(t, &optKeepTemp, true)
+
+		got := runTestJob(t, new(countJob), input.String())
+
+		spills := globSpills(t, testJobID, 0)
+		if len(spills) < tt.minFiles {
+			t.Errorf("spill-size %d: %d spill files, want at least %d", tt.spillSize, len(spills), tt.minFiles)
+		}
+		if tt.spillSize == 0 && len(spills) != 1 {
+			t.Errorf("spill-size 0: %d spill files, want 1", len(spills))
+		}
+
+		// every rolled-over file must still be sorted and reduced
+		if len(got) != 10 {
+			t.Fatalf("spill-size %d: got %q, want 10 keys", tt.spillSize, got)
+		}
+		for _, line := range got {
+			if !strings.HasSuffix(line, "\t10") {
+				t.Errorf("spill-size %d: got %q, want a count of 10", tt.spillSize, line)
+			}
+		}
+	}
+}
+
+// countJob counts the lines of its input
+type countJob struct{}
+
+func (*countJob) Map(key string, value string, emitter Emitter) {
+	emitter.Emit(value, "", "1")
+}
+
+func (*countJob) MapFinal(emitter Emitter) {}
+
+func (*countJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	n := 0
+	for range values {
+		n++
+	}
+	emitter.Emit(reduceKey, "", strconv.Itoa(n))
+}
+
+func TestReduceOutputRouter(t *testing.T) {
+
+	// route each key by its first letter, whichever partition it was reduced in
+	setOpt(t, &ReduceOutputRouter, func(reduceKey, sortKey, value string) string {
+		return reduceKey[:1]
+	})
+
+	var tests = []struct {
+		name string
+		want []string
+	}{
+		{"x", []string{"x1\t2", "x2\t1", "x3\t1"}},
+		{"y", []string{"y1\t1", "y2\t2"}},
+		{".", []string{"..%2Fz\t1"}},
+	}
+
+	dir := setupTestRun(t, "x1\ny1\nx2\ny2\nx3\ny2\nx1\n../z\n")
+	setOpt(t, &optNumPartitions, 3)
+
+	if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+		t.Fatalf("RunContext: %v", err)
+	}
+
+	for _, tt := range tests {
+		fname := filepath.Join(dir, fmt.Sprintf("red-out-p%d.%s", testJobID, fileNamePart(tt.name)))
+		b, err := os.ReadFile(fname)
+		if err != nil {
+			t.Errorf("output %q: %v", tt.name, err)
+			continue
+		}
+		got := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("output %q: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// nothing goes to the partition output files
+	for p := 0; p < optNumPartitions; p++ {
+		if b, err := os.ReadFile(outputFileName(testJobID, p)); err == nil && len(b) != 0 {
+			t.Errorf("partition %d output: %q, want nothing", p, b)
+		}
+	}
+}
+
+func TestOutputRewriter(t *testing.T) {
+
+	var lines []string
+	setOpt(t, &OutputRewriter, func(line string) string {
+		lines = append(lines, line)
+		return line + "\t" + strconv.Itoa(len(line))
+	})
+
+	var tests = []struct {
+		reduceKey, sortKey, value string
+		want                      string
+	}{
+		{"a", "", "1", "a\t1\t3\n"},
+		{"a b", "", "x y", "a+b\tx y\t7\n"},
+		{"a", "s", "1", "a,s\t1\t5\n"},
+	}
+
+	for _, tt := range tests {
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		newOutputEmitter(w).Emit(tt.reduceKey, tt.sortKey, tt.value)
+		w.Flush()
+		if sb.String() != tt.want {
+			t.Errorf("Emit(%q, %q, %q)=%q, want %q", tt.reduceKey, tt.sortKey, tt.value, sb.String(), tt.want)
+		}
+	}
+
+	// map output isn't final output, so it isn't rewritten
+	lines = nil
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	newMapOutputEmitter(w).Emit("a", "", "1")
+	w.Flush()
+	if len(lines) != 0 || sb.String() != "a\t1\n" {
+		t.Errorf("map output rewritten: %q", sb.String())
+	}
+
+	// the rewriter runs on every line of a run's output
+	got := runTestJob(t, new(countJob), "x\ny\nx\n")
+	if want := []string{"x\t2\t3", "y\t1\t3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("run output %q, want %q", got, want)
+	}
+	if len(lines) != 2 {
+		t.Errorf("rewriter called on %q, want 2 lines", lines)
+	}
+}
+
+func TestPartitionFor(t *testing.T) {
+
+	var tests = []struct {
+		key    string
+		p1, p2 int
+		p8     int
+	}{
+		{"", 0, 1, 1},
+		{"a", 0, 0, 2},
+		{"apple", 0, 1, 3},
+		{"banana", 0, 0, 2},
+		{"cherry", 0, 0, 6},
+		{"key42", 0, 0, 0},
+		{"日本", 0, 1, 1},
+	}
+
+	for _, tt := range tests {
+		for _, p := range []struct{ n, want int }{{1, tt.p1}, {2, tt.p2}, {8, tt.p8}} {
+			if got := PartitionFor(tt.key, p.n); got != p.want {
+				t.Errorf("PartitionFor(%q, %d)=%d, want %d", tt.key, p.n, got, p.want)
+			}
+		}
+	}
+
+	// the partition emitter spills each key to the partition PartitionFor says
+	e := newPartitionEmitter(8, filepath.Join(t.TempDir(), "tmp-map-out"), nil, nil)
+	for _, tt := range tests {
+		e.Emit(tt.key, "", "v")
+	}
+	e.Close()
+
+	for _, tt := range tests {
+		b, err := os.ReadFile(e.FileNames[tt.p8][0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains("\n"+string(b), "\n"+escapeKey(tt.key)+",\t") {
+			t.Errorf("key %q not in partition %d: %q", tt.key, tt.p8, b)
+		}
+	}
+}
+
+// sumJob's Map passes a 1 for each line to Emitter.Combine, and Reduce sums them
+type sumJob struct{}
+
+func (*sumJob) Map(key string, value string, emitter Emitter) {
+	emitter.Combine(value, "1")
+}
+
+func (*sumJob) MapFinal(emitter Emitter) {}
+
+func (*sumJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	sum := 0
+	for v := range values {
+		n, _ := strconv.Atoi(v)
+		sum += n
+	}
+	emitter.Emit(reduceKey, "", strconv.Itoa(sum))
+}
+
+// combiningSumJob is a sumJob which uses its Reduce as its Combiner
+type combiningSumJob struct {
+	sumJob
+}
+
+func (j *combiningSumJob) Combine(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	j.Reduce(reduceKey, sortKey, values, emitter)
+}
+
+func TestCombine(t *testing.T) {
+
+	var input strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&input, "k%d\n", i%3)
+	}
+
+	var tests = []struct {
+		name          string
+		job           MapReduceJob
+		combineBuffer int
+		spilled       int
+	}{
+		{"no combiner", new(sumJob), 10000, 100},
+		{"combiner", new(combiningSumJob), 10000, 3},
+		{"combiner, small buffer", new(combiningSumJob), 10, 30},
+		{"combiner, buffer of one", new(combiningSumJob), 1, 100},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optCombineBuffer, tt.combineBuffer)
+		setOpt(t, &optKeepTemp, true)
+
+		got := runTestJob(t, tt.job, input.String())
+		if want := []string{"k0\t34", "k1\t33", "k2\t33"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, want)
+		}
+
+		spilled := 0
+		for _, fn := range globSpills(t, testJobID, 0) {
+			b, err := os.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spilled += strings.Count(string(b), "\n")
+		}
+		if spilled != tt.spilled {
+			t.Errorf("%s: spilled %d records, want %d", tt.name, spilled, tt.spilled)
+		}
+	}
+}
+
+// readDelimited reads varint-length-prefixed records until the end of r
+func readDelimited(t testing.TB, r io.Reader) []string {
+	t.Helper()
+
+	br := bufio.NewReader(r)
+	var records []string
+	for {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			t.Fatalf("record %d: %v", len(records), err)
+		}
+		records = append(records, string(b))
+	}
+}
+
+func TestDelimitedEmitter(t *testing.T) {
+
+	var tests = [][]string{
+		{"a", "b\tc", "d\ne"},
+		{"", "\x00\x80\xff"},
+		{strings.Repeat("x", 200), strings.Repeat("y", 70000)},
+		nil,
+	}
+
+	for _, values := range tests {
+		var buf bytes.Buffer
+		e := NewDelimitedEmitter(&buf)
+		for _, v := range values {
+			e.Emit("key", "sort", v)
+		}
+		e.Close()
+
+		if got := readDelimited(t, &buf); !reflect.DeepEqual(got, values) {
+			t.Errorf("read back %q, want %q", got, values)
+		}
+	}
+
+	// --delimited-output writes the values of a run's output
+	setOpt(t, &optDelimitedOutput, true)
+	setupTestRun(t, "x\ny\nx\n")
+	if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+		t.Fatalf("RunContext: %v", err)
+	}
+	f, err := os.Open(outputFileName(testJobID, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, want := readDelimited(t, f), []string{"2", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("run output %q, want %q", got, want)
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+
+	var input strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&input, "a fairly long and very compressible key number %d\n", i)
+	}
+
+	var tests = []struct {
+		level   int
+		wantErr bool
+	}{
+		{1, false},
+		{9, false},
+		{-1, false},
+		{10, true},
+		{-3, true},
+	}
+
+	sizes := make(map[int]int64)
+	for _, tt := range tests {
+		setupTestRun(t, input.String())
+		setOpt(t, &optCompressOutput, true)
+		setOpt(t, &optGzipLevel, tt.level)
+
+		_, err := RunContext(context.Background(), new(countJob))
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("level %d: RunContext()=%v, want error %v", tt.level, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+
+		fname := outputFileName(testJobID, 0)
+		f, err := os.Open(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("level %d: %v", tt.level, err)
+		}
+		b, err := io.ReadAll(zr)
+		f.Close()
+		if err != nil {
+			t.Fatalf("level %d: %v", tt.level, err)
+		}
+		if n := strings.Count(string(b), "\t1\n"); n != 5000 {
+			t.Errorf("level %d: %d records, want 5000", tt.level, n)
+		}
+
+		fi, err := os.Stat(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[tt.level] = fi.Size()
+	}
+
+	if sizes[1] <= sizes[9] {
+		t.Errorf("level 1 output is %d bytes, level 9 %d: want level 9 smaller", sizes[1], sizes[9])
+	}
+}
+
+// fakeProducer records the messages it is given, failing once it has failAfter of them
+type fakeProducer struct {
+	messages  []string
+	failAfter int
+	flushed   bool
+	closed    bool
+}
+
+var errProduce = errors.New("produce failed")
+
+func (p *fakeProducer) Produce(key, value []byte) error {
+	if p.failAfter > 0 && len(p.messages) >= p.failAfter {
+		return errProduce
+	}
+	p.messages = append(p.messages, string(key)+"="+string(value))
+	return nil
+}
+
+func (p *fakeProducer) Flush() error {
+	p.flushed = true
+	return nil
+}
+
+func (p *fakeProducer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestProducerEmitter(t *testing.T) {
+
+	records := []KeyValue{{"a", "s", "1"}, {"b", "", "2"}, {"a", "", "3"}}
+
+	var tests = []struct {
+		failAfter int
+		want      []string
+		wantErr   error
+	}{
+		{0, []string{"a=1", "b=2", "a=3"}, nil},
+		{1, []string{"a=1"}, errProduce},
+	}
+
+	for _, tt := range tests {
+		p := &fakeProducer{failAfter: tt.failAfter}
+		e := NewProducerEmitter(p)
+		for _, kv := range records {
+			e.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+		}
+		e.Close()
+
+		if !reflect.DeepEqual(p.messages, tt.want) {
+			t.Errorf("failAfter=%d: messages %q, want %q", tt.failAfter, p.messages, tt.want)
+		}
+		if err := EmitterError(e); err != tt.wantErr {
+			t.Errorf("failAfter=%d: EmitterError()=%v, want %v", tt.failAfter, err, tt.wantErr)
+		}
+		if !p.closed {
+			t.Errorf("failAfter=%d: producer not closed", tt.failAfter)
+		}
+		// there's no point flushing after a failure
+		if p.flushed != (tt.wantErr == nil) {
+			t.Errorf("failAfter=%d: flushed=%v", tt.failAfter, p.flushed)
+		}
+	}
+}
+
+func TestRecordDelimiter(t *testing.T) {
+
+	var tests = []struct {
+		delimiter string
+		want      string
+		fails     bool
+	}{
+		{`\n`, "a\t1\nb\t2\n", false},
+		{`\x00`, "a\t1\x00b\t2\x00", false},
+		{`\r\n`, "a\t1\r\nb\t2\r\n", false},
+		{`;`, "a\t1;b\t2;", false},
+		{`\q`, "a\t1\nb\t2\n", true},
+	}
+
+	defer resetFailure()
+
+	for _, tt := range tests {
+		setOpt(t, &optRecordDelimiter, tt.delimiter)
+		resetFailure()
+
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		e := newOutputEmitter(w)
+		e.Emit("a", "", "1")
+		e.Emit("b", "", "2")
+		e.Flush()
+
+		if sb.String() != tt.want {
+			t.Errorf("--record-delimiter %s: got %q, want %q", tt.delimiter, sb.String(), tt.want)
+		}
+		if err := failed(); (err != nil) != tt.fails {
+			t.Errorf("--record-delimiter %s: failed()=%v, want failure %v", tt.delimiter, err, tt.fails)
+		}
+	}
+
+	// a run's output is NUL delimited too
+	setOpt(t, &optRecordDelimiter, `\x00`)
+	setupTestRun(t, "x\ny\nx\n")
+	if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+		t.Fatalf("RunContext: %v", err)
+	}
+	b, err := os.ReadFile(outputFileName(testJobID, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "x\t2\x00y\t1\x00"; string(b) != want {
+		t.Errorf("run output %q, want %q", b, want)
+	}
+}
+
+func TestPartitionKeyFunc(t *testing.T) {
+
+	setOpt(t, &PartitionKeyFunc, strings.ToLower)
+
+	// Foo and foo, and Bar and bar, hash to different partitions of 5
+	const partitions = 5
+	setupTestRun(t, "Foo\nfoo\nFOO\nfoo\nbar\nBar\nbaz\n")
+	setOpt(t, &optNumPartitions, partitions)
+
+	if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+		t.Fatalf("RunContext: %v", err)
+	}
+
+	// the keys keep their casing, but are reduced in the partition of their lowercase form
+	var tests = []struct {
+		line      string
+		partition int
+	}{
+		{"FOO\t1", PartitionFor("foo", partitions)},
+		{"Foo\t1", PartitionFor("foo", partitions)},
+		{"foo\t2", PartitionFor("foo", partitions)},
+		{"Bar\t1", PartitionFor("bar", partitions)},
+		{"bar\t1", PartitionFor("bar", partitions)},
+		{"baz\t1", PartitionFor("baz", partitions)},
+	}
+
+	if PartitionFor("foo", partitions) == PartitionFor("Foo", partitions) {
+		t.Fatal("Foo and foo are in the same partition anyway")
+	}
+
+	found := 0
+	for p := 0; p < partitions; p++ {
+		b, err := os.ReadFile(outputFileName(testJobID, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			if strings.Contains("\n"+string(b), "\n"+tt.line+"\n") {
+				found++
+				if p != tt.partition {
+					t.Errorf("%q reduced in partition %d, want %d", tt.line, p, tt.partition)
+				}
+			}
+		}
+	}
+	if found != len(tests) {
+		t.Errorf("found %d of the %d output lines", found, len(tests))
+	}
+}
+
+// syncFile records whether an output file was synced before it was closed
+type syncFile struct {
+	*os.File
+	synced *int64
+	closed bool
+}
+
+func (f *syncFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	atomic.AddInt64(f.synced, 1)
+	return f.File.Sync()
+}
+
+func (f *syncFile) Close() error {
+	f.closed = true
+	return f.File.Close()
+}
+
+func TestFsyncOutput(t *testing.T) {
+
+	var tests = []struct {
+		name       string
+		fsync      bool
+		partitions int
+		want       int64
+	}{
+		{"off", false, 3, 0},
+		{"one partition", true, 1, 1},
+		{"every partition", true, 3, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestRun(t, "a\nb\nc\na\n")
+			setOpt(t, &optNumPartitions, tt.partitions)
+			setOpt(t, &optFsyncOutput, tt.fsync)
+
+			var synced int64
+			setOpt(t, &createOutputFile, func(name string) (outputFile, error) {
+				f, err := os.Create(name)
+				if err != nil {
+					return nil, err
+				}
+				return &syncFile{File: f, synced: &synced}, nil
+			})
+
+			if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+				t.Fatalf("RunContext: %v", err)
+			}
+			if synced != tt.want {
+				t.Errorf("Sync called %d times, want %d", synced, tt.want)
+			}
+
+			lines := readOutput(t, testJobID)
+			sort.Strings(lines)
+			if want := []string{"a\t2", "b\t1", "c\t1"}; !reflect.DeepEqual(lines, want) {
+				t.Errorf("output=%q, want %q", lines, want)
+			}
+		})
+	}
+}
+
+func TestSortedEmitter(t *testing.T) {
+
+	byValue := func(a, b *KeyValue) bool { return a.Value < b.Value }
+	bySortKeyDesc := func(a, b *KeyValue) bool { return a.SortKey > b.SortKey }
+
+	var tests = []struct {
+		name string
+		less func(a, b *KeyValue) bool
+		in   []KeyValue
+		want []KeyValue
+	}{
+		{"empty", byValue, nil, nil},
+		{"one key", byValue,
+			[]KeyValue{{"a", "", "c"}, {"a", "", "a"}, {"a", "", "b"}},
+			[]KeyValue{{"a", "", "a"}, {"a", "", "b"}, {"a", "", "c"}}},
+		{"sorted within each key, not across keys", byValue,
+			[]KeyValue{{"b", "", "z"}, {"b", "", "y"}, {"a", "", "2"}, {"a", "", "1"}},
+			[]KeyValue{{"b", "", "y"}, {"b", "", "z"}, {"a", "", "1"}, {"a", "", "2"}}},
+		{"stable", bySortKeyDesc,
+			[]KeyValue{{"a", "1", "x"}, {"a", "2", "y"}, {"a", "1", "z"}},
+			[]KeyValue{{"a", "2", "y"}, {"a", "1", "x"}, {"a", "1", "z"}}},
+		{"key seen again later", byValue,
+			[]KeyValue{{"a", "", "2"}, {"b", "", "1"}, {"a", "", "1"}},
+			[]KeyValue{{"a", "", "2"}, {"b", "", "1"}, {"a", "", "1"}}},
+	}
+
+	for _, tt := range tests {
+		var got []KeyValue
+		e := SortedEmitter(recordEmitter(&got), tt.less)
+		for _, kv := range tt.in {
+			e.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+		}
+		e.Flush()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// sortedOutputJob's Reduce emits each key's values in reverse, through a SortedEmitter which puts them back in order
+type sortedOutputJob struct {
+	countJob
+}
+
+func (*sortedOutputJob) Map(key string, value string, emitter Emitter) {
+	f := strings.Fields(value)
+	emitter.Emit(f[0], "", f[1])
+}
+
+func (*sortedOutputJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	var vs []string
+	for v := range values {
+		vs = append(vs, v)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(vs)))
+
+	e := SortedEmitter(emitter, func(a, b *KeyValue) bool { return a.Value < b.Value })
+	for _, v := range vs {
+		e.Emit(reduceKey, "", v)
+	}
+	e.Flush()
+}
+
+func TestSortedEmitterReduce(t *testing.T) {
+
+	lines := runTestJob(t, new(sortedOutputJob), "a 2\nb 9\na 3\nb 8\na 1\n")
+
+	want := []string{"a\t1", "a\t2", "a\t3", "b\t8", "b\t9"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("output=%q, want %q", lines, want)
+	}
+}
+
+func TestNFCKeys(t *testing.T) {
+
+	const (
+		nfc = "caf\u00e9"  // precomposed é
+		nfd = "cafe\u0301" // e and a combining acute accent
+	)
+	input := strings.Join([]string{nfc, nfd, nfd, "cafe", nfc}, "\n") + "\n"
+
+	var tests = []struct {
+		name       string
+		nfcKeys    bool
+		partitions int
+		want       []string
+	}{
+		{"off", false, 1, []string{"caf%C3%A9\t2", "cafe\t1", "cafe%CC%81\t2"}},
+		{"on", true, 1, []string{"caf%C3%A9\t4", "cafe\t1"}},
+		{"on, partitioned", true, 5, []string{"caf%C3%A9\t4", "cafe\t1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOpt(t, &optNFCKeys, tt.nfcKeys)
+			setupTestRun(t, input)
+			setOpt(t, &optNumPartitions, tt.partitions)
+
+			if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+				t.Fatalf("RunContext: %v", err)
+			}
+			got := readOutput(t, testJobID)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("--mapreduce: got %q, want %q", got, tt.want)
+			}
+
+			kvs, err := RunLocal(new(countJob), strings.NewReader(input))
+			if err != nil {
+				t.Fatalf("RunLocal: %v", err)
+			}
+			var local []string
+			for _, kv := range kvs {
+				local = append(local, escapeKey(kv.ReduceKey)+"\t"+kv.Value)
+			}
+			sort.Strings(local)
+			if !reflect.DeepEqual(local, tt.want) {
+				t.Errorf("RunLocal: got %q, want %q", local, tt.want)
+			}
+		})
+	}
+}
+
+// sortKeyValuesJob's Reduce emits the sort key it was called with and the values joined with "+"
+type sortKeyValuesJob struct {
+	sortKeyJob
+}
+
+func (*sortKeyValuesJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	var vs []string
+	for v := range values {
+		vs = append(vs, v)
+	}
+	emitter.Emit(reduceKey, "", sortKey+"="+strings.Join(vs, "+"))
+}
+
+func TestSeparators(t *testing.T) {
+
+	var tests = []struct {
+		field, key byte
+		input      string
+		want       string
+	}{
+		{'\t', ',', "a,1\tx\na,2\ty\nb\tz\n", "a\t1=x+y\nb\t=z\n"},
+		{'|', ';', "a;1|x\na;2|y\nb|z\n", "a|1=x+y\nb|=z\n"},
+		// the default separators are only data now
+		{'|', ';', "a,b;1|x\tq\n", "a%2Cb|1=x\tq\n"},
+		{':', '/', "a/1:x:y\n", "a:1=x:y\n"},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &fieldSeparator, fieldSeparator)
+		setOpt(t, &keySeparator, keySeparator)
+		SetFieldSeparator(tt.field)
+		SetKeySeparator(tt.key)
+		if err := checkSeparators(); err != nil {
+			t.Fatalf("separators %q %q: %v", tt.field, tt.key, err)
+		}
+
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		out := newOutputEmitter(w)
+		reducer(new(sortKeyValuesJob), strings.NewReader(tt.input), readLineKeyValue, out, stdReporter)
+		out.Flush()
+
+		if sb.String() != tt.want {
+			t.Errorf("separators %q %q: reduced %q to %q, want %q", tt.field, tt.key, tt.input, sb.String(), tt.want)
+		}
+	}
+}
+
+func TestSeparatorsMapReduce(t *testing.T) {
+
+	var tests = []struct {
+		field, key byte
+		goSort     bool
+		want       []string
+	}{
+		{'\t', ',', false, []string{"a\t1 2 3", "a%21\t1", "b\t1 2"}},
+		{'|', ';', false, []string{"a|1 2 3", "a%21|1", "b|1 2"}},
+		{'|', ';', true, []string{"a|1 2 3", "a%21|1", "b|1 2"}},
+		{' ', '/', false, []string{"a 1 2 3", "a%21 1", "b 1 2"}},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &fieldSeparator, fieldSeparator)
+		setOpt(t, &keySeparator, keySeparator)
+		SetFieldSeparator(tt.field)
+		SetKeySeparator(tt.key)
+		setOpt(t, &optSecondaryKey, true)
+		setOpt(t, &optGoSort, tt.goSort)
+
+		got := runTestJob(t, new(sortKeyJob), "b 2\na 3\na! 1\na 1\nb 1\na 2\n")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("separators %q %q goSort=%v: got %q, want %q", tt.field, tt.key, tt.goSort, got, tt.want)
+		}
+	}
+}
+
+// nullJob emits nothing
+type nullJob struct {
+	countJob
+}
+
+func (*nullJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	for range values {
+	}
+}
+
+func TestGroupSentinel(t *testing.T) {
+
+	const input = "a\t1\na\t2\nb\t3\nc\t4\n"
+
+	var tests = []struct {
+		name     string
+		sentinel string
+		job      MapReduceJob
+		want     string
+	}{
+		{"off", "", new(countJob), "a\t2\nb\t1\nc\t1\n"},
+		{"one record per key", "--", new(countJob), "a\t2\n--\nb\t1\n--\nc\t1\n--\n"},
+		{"several records per key", "END", new(eachValueJob), "a\t1\na\t2\nextra\tx\nEND\nb\t3\nextra\tx\nEND\nc\t4\nextra\tx\nEND\n"},
+		{"key with no output", "--", new(nullJob), "--\n--\n--\n"},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optGroupSentinel, tt.sentinel)
+
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		out := newOutputEmitter(w)
+		reducer(tt.job, strings.NewReader(input), readLineKeyValue, out, stdReporter)
+		out.Flush()
+
+		if sb.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, sb.String(), tt.want)
+		}
+	}
+
+	// an emitter which can't write lines gets an empty record keyed by the sentinel
+	setOpt(t, &optGroupSentinel, "--")
+	var got []KeyValue
+	reducer(new(countJob), strings.NewReader(input), readLineKeyValue, recordEmitter(&got), stdReporter)
+	want := []KeyValue{{"a", "", "2"}, {"--", "", ""}, {"b", "", "1"}, {"--", "", ""}, {"c", "", "1"}, {"--", "", ""}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("record emitter: got %v, want %v", got, want)
+	}
+}
+
+func TestKeyFieldPartitioner(t *testing.T) {
+
+	var tests = []struct {
+		n    int
+		key  string
+		same string // a key which must share its partition
+	}{
+		{1, "user1,a", "user1"},
+		{1, "user1,a,x", "user1,b"},
+		{1, "user1", "user1,"},
+		{2, "user1,a,x", "user1,a,y"},
+		{2, "user1,a", "user1,a,"},
+		{3, "a,b", "a,b"},
+	}
+
+	for _, tt := range tests {
+		p := KeyFieldPartitioner(tt.n)
+		for _, partitions := range []uint{1, 5, 8, 64} {
+			got, want := p(tt.key, partitions), p(tt.same, partitions)
+			if got != want || got >= partitions {
+				t.Errorf("KeyFieldPartitioner(%d): %q to partition %d and %q to %d of %d", tt.n, tt.key, got, tt.same, want, partitions)
+			}
+		}
+	}
+}
+
+// keyFieldJob is a countJob which partitions on the first field of its keys
+type keyFieldJob struct {
+	countJob
+}
+
+func (*keyFieldJob) Partition(reduceKey string, numPartitions uint) uint {
+	return KeyFieldPartitioner(1)(reduceKey, numPartitions)
+}
+
+func TestPartitioner(t *testing.T) {
+
+	const partitions = 8
+
+	var tests = []struct {
+		name    string
+		job     MapReduceJob
+		grouped bool
+	}{
+		{"default", new(countJob), false},
+		{"key field", new(keyFieldJob), true},
+	}
+
+	var input strings.Builder
+	for u := 0; u < 4; u++ {
+		for _, s := range []string{"a", "b", "c", "d", "e", "f"} {
+			fmt.Fprintf(&input, "user%d,%s\n", u, s)
+		}
+	}
+
+	for _, tt := range tests {
+		setupTestRun(t, input.String())
+		setOpt(t, &optNumPartitions, partitions)
+
+		if _, err := RunContext(context.Background(), tt.job); err != nil {
+			t.Fatalf("%s: RunContext: %v", tt.name, err)
+		}
+
+		// the partition files the keys of each user were written to
+		files := make(map[string]map[int]bool)
+		records := 0
+		for p := 0; p < partitions; p++ {
+			b, err := os.ReadFile(outputFileName(testJobID, p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+				if line == "" {
+					continue
+				}
+				user, _, _ := strings.Cut(line, "%2C")
+				if files[user] == nil {
+					files[user] = make(map[int]bool)
+				}
+				files[user][p] = true
+				records++
+			}
+		}
+
+		if records != 24 {
+			t.Errorf("%s: %d records, want 24", tt.name, records)
+		}
+		together := true
+		for user, ps := range files {
+			if len(ps) != 1 {
+				together = false
+				if tt.grouped {
+					t.Errorf("%s: keys of %s are in partitions %v", tt.name, user, ps)
+				}
+			}
+		}
+		if !tt.grouped && together {
+			t.Errorf("%s: each user's keys happened to share a partition, so the test shows nothing", tt.name)
+		}
+	}
+}
+
+func TestFuncEmitter(t *testing.T) {
+
+	var tests = []struct {
+		name string
+		emit func(e Emitter)
+		want []KeyValue
+	}{
+		{"nothing", func(e Emitter) {}, nil},
+		{"Emit", func(e Emitter) {
+			e.Emit("a", "s", "1")
+			e.Emit("b", "", "2")
+		}, []KeyValue{{"a", "s", "1"}, {"b", "", "2"}}},
+		{"Combine", func(e Emitter) { e.Combine("a", "1") }, []KeyValue{{"a", "", "1"}}},
+		{"EmitAll", func(e Emitter) {
+			e.EmitAll([]*KeyValue{{"a", "", "1"}, {"a", "t", "2"}})
+			e.Flush()
+			e.Close()
+		}, []KeyValue{{"a", "", "1"}, {"a", "t", "2"}}},
+		{"reducer output", func(e Emitter) {
+			reducer(new(countJob), strings.NewReader("a\t1\na\t1\nb\t1\n"), readLineKeyValue, e, stdReporter)
+		}, []KeyValue{{"a", "", "2"}, {"b", "", "1"}}},
+	}
+
+	for _, tt := range tests {
+		var got []KeyValue
+		tt.emit(NewFuncEmitter(func(kv *KeyValue) { got = append(got, *kv) }))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: callback got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// the callback isn't called concurrently, so it needn't lock
+	n := 0
+	e := NewFuncEmitter(func(kv *KeyValue) { n++ })
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				e.Emit("k", "", "v")
+			}
+		}()
+	}
+	wg.Wait()
+	if n != 800 {
+		t.Errorf("callback called %d times, want 800", n)
+	}
+}
+
+func TestEscapeValues(t *testing.T) {
+
+	var tests = []struct {
+		value string
+		want  string
+	}{
+		{"plain", "k\tplain\n"},
+		{"two\nlines", "k\ttwo\\nlines\n"},
+		{`back\slash`, "k\tback\\\\slash\n"},
+		{`not a \n newline`, "k\tnot a \\\\n newline\n"},
+		{"trailing\\", "k\ttrailing\\\\\n"},
+		{"\n\n", "k\t\\n\\n\n"},
+		{"{\"text\":\"a\\nb\"}\n", "k\t{\"text\":\"a\\\\nb\"}\\n\n"},
+	}
+
+	setOpt(t, &optEscapeValues, true)
+
+	for _, tt := range tests {
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		e := newPrintEmitter(w)
+		e.Emit("k", "", tt.value)
+		e.Flush()
+
+		if sb.String() != tt.want {
+			t.Errorf("Emit(%q) wrote %q, want %q", tt.value, sb.String(), tt.want)
+		}
+
+		kv, err := readLineKeyValue(bufio.NewReader(strings.NewReader(sb.String())))
+		if err != nil {
+			t.Errorf("reading %q: %v", sb.String(), err)
+			continue
+		}
+		if kv.Value != tt.value {
+			t.Errorf("round trip of %q gave %q", tt.value, kv.Value)
+		}
+	}
+}
+
+// multilineJob's Map emits each line with "|" replaced by a newline, keyed by
+// the line; Reduce passes the values through
+type multilineJob struct {
+	eachValueJob
+}
+
+func (*multilineJob) Map(key string, value string, emitter Emitter) {
+	emitter.Emit(value, "", strings.ReplaceAll(value, "|", "\n"))
+}
+
+func (*multilineJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	for v := range values {
+		emitter.Emit(reduceKey, "", v)
+	}
+}
+
+func TestEscapeValuesMapReduce(t *testing.T) {
+
+	var tests = []struct {
+		escape bool
+		want   []string
+	}{
+		{true, []string{"a%7Cb\ta\\nb", "c%5C\tc\\\\", "d%7C%7C\td\\n\\n"}},
+		// unescaped, the newlines split the records
+		{false, []string{"\t", "\t", "a%7Cb\ta", "b\t", "c%5C\tc\\", "d%7C%7C\td"}},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optEscapeValues, tt.escape)
+
+		got := runTestJob(t, new(multilineJob), "d||\na|b\nc\\\n")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("escape=%v: got %q, want %q", tt.escape, got, tt.want)
+		}
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+
+	var tests = []struct {
+		encoding  string
+		reduceKey string
+		sortKey   string
+		want      string
+	}{
+		{"url", "a b,c", "", "a+b%2Cc\tv\n"},
+		{"url", "\x00\xff\t\n", "1", "%00%FF%09%0A,1\tv\n"},
+		{"base64", "a b,c", "", "YSBiLGM\tv\n"},
+		{"base64", "\x00\xff\t\n", "\xfe,", "AP8JCg,_iw\tv\n"},
+		{"base64", "", "", "\tv\n"},
+		{"none", "a b", "2", "a b,2\tv\n"},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optKeyEncoding, tt.encoding)
+
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		e := newPrintEmitter(w)
+		e.Emit(tt.reduceKey, tt.sortKey, "v")
+		e.Flush()
+
+		if sb.String() != tt.want {
+			t.Errorf("%s: Emit(%q, %q) wrote %q, want %q", tt.encoding, tt.reduceKey, tt.sortKey, sb.String(), tt.want)
+		}
+
+		kv, err := readLineKeyValue(bufio.NewReader(strings.NewReader(sb.String())))
+		if err != nil {
+			t.Errorf("%s: reading %q: %v", tt.encoding, sb.String(), err)
+			continue
+		}
+		if want := (KeyValue{tt.reduceKey, tt.sortKey, "v"}); *kv != want {
+			t.Errorf("%s: round trip gave %q, want %q", tt.encoding, *kv, want)
+		}
+	}
+}
+
+func TestKeyEncodingSeparators(t *testing.T) {
+
+	var tests = []struct {
+		encoding   string
+		field, key byte
+		ok         bool
+	}{
+		{"url", '\t', ',', true},
+		{"base64", '\t', ',', true},
+		{"base64", '-', ',', false},
+		{"base64", '\t', '_', false},
+		{"url", '\t', '_', true},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optKeyEncoding, tt.encoding)
+		setOpt(t, &fieldSeparator, tt.field)
+		setOpt(t, &keySeparator, tt.key)
+
+		if err := checkSeparators(); (err == nil) != tt.ok {
+			t.Errorf("%s, separators %q %q: checkSeparators()=%v", tt.encoding, tt.field, tt.key, err)
+		}
+	}
+}
+
+func TestMapOutputTransform(t *testing.T) {
+
+	var tests = []struct {
+		name      string
+		transform func(kv *KeyValue) *KeyValue
+		spilled   []string
+		want      []string
+	}{
+		{"none", nil, []string{"a,\ta", "b,\tb", "b,\tb"}, []string{"a\ta", "b\tb|b"}},
+		{"tag", func(kv *KeyValue) *KeyValue {
+			kv.Value += "@p" + strconv.Itoa(PartitionFor(kv.ReduceKey, 1))
+			return kv
+		}, []string{"a,\ta@p0", "b,\tb@p0", "b,\tb@p0"}, []string{"a\ta@p0", "b\tb@p0|b@p0"}},
+		{"drop", func(kv *KeyValue) *KeyValue {
+			if kv.ReduceKey == "a" {
+				return nil
+			}
+			return kv
+		}, []string{"b,\tb", "b,\tb"}, []string{"b\tb|b"}},
+		{"new record", func(kv *KeyValue) *KeyValue {
+			return &KeyValue{strings.ToUpper(kv.ReduceKey), "", kv.Value}
+		}, []string{"A,\ta", "B,\tb", "B,\tb"}, []string{"A\ta", "B\tb|b"}},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &MapOutputTransform, tt.transform)
+		setOpt(t, &optKeepTemp, true)
+
+		got := runTestJob(t, new(joinJob), "b\na\nb\n")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+
+		var spilled []string
+		for _, fn := range globSpills(t, testJobID, 0) {
+			b, err := os.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spilled = append(spilled, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")...)
+		}
+		sort.Strings(spilled)
+		if !reflect.DeepEqual(spilled, tt.spilled) {
+			t.Errorf("%s: spilled %q, want %q", tt.name, spilled, tt.spilled)
+		}
+
+		// RunLocal transforms the map output too
+		local, err := RunLocal(new(joinJob), strings.NewReader("b\na\nb\n"))
+		if err != nil {
+			t.Fatalf("%s: RunLocal: %v", tt.name, err)
+		}
+		var lines []string
+		for _, kv := range local {
+			lines = append(lines, kv.ReduceKey+"\t"+kv.Value)
+		}
+		if !reflect.DeepEqual(lines, tt.want) {
+			t.Errorf("%s: RunLocal gave %q, want %q", tt.name, lines, tt.want)
+		}
+	}
+}
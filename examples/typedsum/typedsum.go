@@ -0,0 +1,48 @@
+// Summing numbers by key with a typed job
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+package main
+
+import (
+	"flag"
+	"github.com/dgryski/dmrgo"
+	"strconv"
+	"strings"
+)
+
+// TypedSum sums the numbers for each key in lines of the form "key number"
+type TypedSum struct{}
+
+func (TypedSum) Map(key string, value string, emit func(reduceKey, sortKey string, n int64)) {
+
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		dmrgo.IncrCounter("Program", "bad lines", 1)
+		return
+	}
+
+	n, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		dmrgo.IncrCounter("Program", "bad numbers", 1)
+		return
+	}
+
+	emit(fields[0], "", n)
+}
+
+func (TypedSum) Reduce(key string, sortKey string, values <-chan int64, emit func(reduceKey, sortKey string, n int64)) {
+
+	var sum int64
+	for n := range values {
+		sum += n
+	}
+
+	emit(key, "", sum)
+}
+
+func main() {
+
+	flag.Parse()
+
+	dmrgo.Main(dmrgo.Adapt[int64](TypedSum{}, dmrgo.JSONCodec[int64]{}))
+}
@@ -18,7 +18,7 @@ import (
 // As example, just to show we can write our own custom protocols
 type WordCountProto struct{}
 
-func (p *WordCountProto) UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) {
+func (p *WordCountProto) UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) error {
 
 	kptr := k.(*string)
 	*kptr = key
@@ -27,22 +27,31 @@ func (p *WordCountProto) UnmarshalKVs(key string, values []string, k interface{}
 
 	v := make([]int, len(values))
 
+	// bad counts are skipped, and the last error returned
+	var err error
 	for i, s := range values {
-		v[i], _ = strconv.Atoi(s)
+		n, e := strconv.Atoi(s)
+		if e != nil {
+			err = e
+			continue
+		}
+		v[i] = n
 	}
 
 	*vsptr = v
+
+	return err
 }
 
-func (p *WordCountProto) MarshalKV(key interface{}, value interface{}) *dmrgo.KeyValue {
+func (p *WordCountProto) Marshal(key interface{}, sortKey interface{}, value interface{}) *dmrgo.KeyValue {
 	ks := key.(string)
 	vi := value.(int)
 
 	if vi == 1 {
-		return &dmrgo.KeyValue{ks, "1"}
+		return &dmrgo.KeyValue{ReduceKey: ks, Value: "1"}
 	}
 
-	return &dmrgo.KeyValue{ks, strconv.Itoa(vi)}
+	return &dmrgo.KeyValue{ReduceKey: ks, Value: strconv.Itoa(vi)}
 }
 
 type MRWordCount struct {
@@ -79,8 +88,8 @@ func (mr *MRWordCount) Map(key string, value string, emitter dmrgo.Emitter) {
 	w := uint32(0)
 	for _, word := range words {
 		w++
-		kv := mr.protocol.MarshalKV(word, 1)
-		emitter.Emit(kv.Key, kv.Value)
+		kv := mr.protocol.Marshal(word, nil, 1)
+		emitter.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
 	}
 	atomic.AddUint32(&mr.mappedWords, w)
 
@@ -91,18 +100,25 @@ func (mr *MRWordCount) MapFinal(emitter dmrgo.Emitter) {
 	dmrgo.IncrCounter("Program", "mapped words", int(mr.mappedWords))
 }
 
-func (mr *MRWordCount) Reduce(key string, values []string, emitter dmrgo.Emitter) {
+func (mr *MRWordCount) Reduce(key string, sortKey string, valuesCh <-chan string, emitter dmrgo.Emitter) {
+
+	var values []string
+	for v := range valuesCh {
+		values = append(values, v)
+	}
 
 	counts := []int{}
-	mr.protocol.UnmarshalKVs(key, values, &key, &counts)
+	if err := mr.protocol.UnmarshalKVs(key, values, &key, &counts); err != nil {
+		dmrgo.IncrCounter("Program", "bad counts", 1)
+	}
 
 	count := 0
 	for _, c := range counts {
 		count += c
 	}
 
-	kv := mr.protocol.MarshalKV(key, count)
-	emitter.Emit(kv.Key, kv.Value)
+	kv := mr.protocol.Marshal(key, nil, count)
+	emitter.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
 }
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
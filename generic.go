@@ -0,0 +1,154 @@
+package dmrgo
+
+// Type-safe jobs using generics
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Codec marshals and unmarshals the values of a TypedJob
+type Codec[V any] interface {
+	Marshal(v V) (string, error)
+	Unmarshal(s string) (V, error)
+}
+
+// JSONCodec is a Codec which encodes values as JSON, as JSONProtocol does
+type JSONCodec[V any] struct{}
+
+// Marshal implements the Codec interface
+func (JSONCodec[V]) Marshal(v V) (string, error) {
+	b, err := marshalJSON(json.Marshal, v)
+	return string(b), err
+}
+
+// Unmarshal implements the Codec interface
+func (JSONCodec[V]) Unmarshal(s string) (V, error) {
+	var v V
+	err := unmarshalJSON([]byte(s), &v)
+	return v, err
+}
+
+// TypedJob is a map reduce job whose intermediate and output values are of
+// type V.  Use Adapt to run it.  A TypedJob may also have a MapFinal method
+// taking an emit function, which is called at the end of the map phase.
+type TypedJob[V any] interface {
+	Map(key, value string, emit func(reduceKey, sortKey string, v V))
+	Reduce(reduceKey, sortKey string, values <-chan V, emit func(reduceKey, sortKey string, v V))
+}
+
+// typedMapFinal is implemented by TypedJobs which need to finish the map phase
+type typedMapFinal[V any] interface {
+	MapFinal(emit func(reduceKey, sortKey string, v V))
+}
+
+// Adapt turns a TypedJob into a MapReduceJob, marshalling its values with
+// codec.  Values which can't be marshalled or unmarshalled are skipped (or
+// abort the job in --strict mode).  The values are streamed to Reduce
+// through a buffered channel, as for MapReduceJob.
+func Adapt[V any](job TypedJob[V], codec Codec[V]) MapReduceJob {
+	return &adaptedJob[V]{job, codec}
+}
+
+type adaptedJob[V any] struct {
+	job   TypedJob[V]
+	codec Codec[V]
+}
+
+// emitFunc returns an emit function for the typed job which marshals its values to emitter
+func (a *adaptedJob[V]) emitFunc(emitter Emitter) func(reduceKey, sortKey string, v V) {
+	return func(reduceKey, sortKey string, v V) {
+		s, err := a.codec.Marshal(v)
+		if err != nil {
+			badRecord(err)
+			return
+		}
+		emitter.Emit(reduceKey, sortKey, s)
+	}
+}
+
+func (a *adaptedJob[V]) Map(key string, value string, emitter Emitter) {
+	a.job.Map(key, value, a.emitFunc(emitter))
+}
+
+func (a *adaptedJob[V]) MapFinal(emitter Emitter) {
+	if f, ok := a.job.(typedMapFinal[V]); ok {
+		f.MapFinal(a.emitFunc(emitter))
+	}
+}
+
+func (a *adaptedJob[V]) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	decode := func(s string) (V, error) {
+		v, err := a.codec.Unmarshal(s)
+		if err != nil {
+			badRecord(err)
+		}
+		return v, err
+	}
+	decodeValues(values, decode, func(typed <-chan V) {
+		a.job.Reduce(reduceKey, sortKey, typed, a.emitFunc(emitter))
+	})
+}
+
+// ReduceAs adapts a reduce function over values of type V, each decoded by
+// the protocol p, which must implement ValueUnmarshaler, as the built-in
+// protocols do.  Values which can't be decoded are skipped (or abort the job
+// in --strict mode).  Call the returned function from the job's Reduce:
+//
+//	func (j *Job) Reduce(reduceKey string, sortKey string, values <-chan string, emitter dmrgo.Emitter) {
+//		j.typedReduce(reduceKey, sortKey, values, emitter)
+//	}
+func ReduceAs[V any](p StreamProtocol, reduce func(reduceKey string, sortKey string, values <-chan V, emitter Emitter)) func(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+
+	u, ok := p.(ValueUnmarshaler)
+	if !ok {
+		panic(fmt.Sprintf("dmrgo: ReduceAs needs a protocol which can unmarshal single values, got %T", p))
+	}
+
+	decode := func(s string) (V, error) {
+		var v V
+		err := u.UnmarshalValue(s, &v)
+		return v, err
+	}
+
+	return func(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+		decodeValues(values, decode, func(typed <-chan V) {
+			reduce(reduceKey, sortKey, typed, emitter)
+		})
+	}
+}
+
+// decodeValues streams values to reduce, decoded, through a buffered
+// channel.  Values decode fails on are skipped; decode reports them.  It
+// returns once reduce has, even if there are values left.
+func decodeValues[V any](values <-chan string, decode func(s string) (V, error), reduce func(typed <-chan V)) {
+
+	typed := make(chan V, 64)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		reduce(typed)
+	}()
+
+	defer func() {
+		close(typed)
+		<-done
+	}()
+
+	for s := range values {
+		v, err := decode(s)
+		if err != nil {
+			continue
+		}
+
+		// if reduce has already returned, nobody is reading the values
+		select {
+		case typed <- v:
+		case <-done:
+			return
+		}
+	}
+}
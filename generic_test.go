@@ -0,0 +1,148 @@
+package dmrgo
+
+// Tests for typed jobs
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// typedSumJob sums the numbers for each key in lines of the form "key number"
+type typedSumJob struct{}
+
+func (typedSumJob) Map(key, value string, emit func(reduceKey, sortKey string, n int64)) {
+	f := strings.Fields(value)
+	n, _ := strconv.ParseInt(f[1], 10, 64)
+	emit(f[0], "", n)
+}
+
+func (typedSumJob) Reduce(reduceKey, sortKey string, values <-chan int64, emit func(reduceKey, sortKey string, n int64)) {
+	var sum int64
+	for n := range values {
+		sum += n
+	}
+	emit(reduceKey, "", sum)
+}
+
+// typedTotalJob is a typedSumJob which also emits the number of lines under the key "lines" from MapFinal
+type typedTotalJob struct {
+	typedSumJob
+	lines int64
+}
+
+func (j *typedTotalJob) Map(key, value string, emit func(reduceKey, sortKey string, n int64)) {
+	j.lines++
+	j.typedSumJob.Map(key, value, emit)
+}
+
+func (j *typedTotalJob) MapFinal(emit func(reduceKey, sortKey string, n int64)) {
+	emit("lines", "", j.lines)
+}
+
+// positiveCodec is a JSONCodec which refuses to marshal negative numbers
+type positiveCodec struct {
+	JSONCodec[int64]
+}
+
+func (c positiveCodec) Marshal(n int64) (string, error) {
+	if n < 0 {
+		return "", errors.New("negative number")
+	}
+	return c.JSONCodec.Marshal(n)
+}
+
+func TestAdapt(t *testing.T) {
+
+	defer resetFailure()
+
+	var tests = []struct {
+		name      string
+		job       TypedJob[int64]
+		codec     Codec[int64]
+		strict    bool
+		input     string
+		want      []KeyValue
+		malformed int64
+	}{
+		{"sum", typedSumJob{}, JSONCodec[int64]{}, false, "a 1\nb 2\na 3\n", []KeyValue{{"a", "", "4"}, {"b", "", "2"}}, 0},
+		{"map final", new(typedTotalJob), JSONCodec[int64]{}, false, "a 1\nb 2\na 3\n", []KeyValue{{"a", "", "4"}, {"b", "", "2"}, {"lines", "", "3"}}, 0},
+		{"unmarshallable value skipped", typedSumJob{}, positiveCodec{}, false, "a 1\na -5\nb 2\n", []KeyValue{{"a", "", "1"}, {"b", "", "2"}}, 1},
+		{"unmarshallable value in strict mode", typedSumJob{}, positiveCodec{}, true, "a 1\na -5\nb 2\n", nil, 1},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optStrict, tt.strict)
+
+		malformed := MalformedRecords()
+		got, err := RunLocal(Adapt(tt.job, tt.codec), strings.NewReader(tt.input))
+		if (err != nil) != tt.strict {
+			t.Errorf("%s: RunLocal error %v, want an error %v", tt.name, err, tt.strict)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if n := MalformedRecords() - malformed; n != tt.malformed {
+			t.Errorf("%s: %d malformed records, want %d", tt.name, n, tt.malformed)
+		}
+	}
+}
+
+func TestReduceAs(t *testing.T) {
+
+	defer resetFailure()
+
+	var tests = []struct {
+		name      string
+		p         StreamProtocol
+		values    []string
+		strict    bool
+		want      string
+		malformed int64
+	}{
+		{"json", new(JSONProtocol), []string{`{"Item":"apple","Price":3}`, `{"Item":"plum","Price":4}`}, false, "apple,plum 7", 0},
+		{"tsv", new(TSVProtocol), []string{"apple\t3", "plum\t4"}, false, "apple,plum 7", 0},
+		{"csv", new(CSVProtocol), []string{"apple,3", `"plum, red",4`}, false, "apple,plum, red 7", 0},
+		{"bad value skipped", new(JSONProtocol), []string{`{"Item":"apple","Price":3}`, `{"Item":`, `{"Item":"plum","Price":4}`}, false, "apple,plum 7", 1},
+		{"bad value in strict mode", new(TSVProtocol), []string{"apple\tthree", "plum\t4"}, true, "plum 4", 1},
+	}
+
+	for _, tt := range tests {
+		resetFailure()
+		setOpt(t, &optStrict, tt.strict)
+
+		reduce := ReduceAs(tt.p, func(reduceKey string, sortKey string, values <-chan sale, emitter Emitter) {
+			var items []string
+			total := 0
+			for s := range values {
+				items = append(items, s.Item)
+				total += s.Price
+			}
+			emitter.Emit(reduceKey, "", strings.Join(items, ",")+" "+strconv.Itoa(total))
+		})
+
+		values := make(chan string, len(tt.values))
+		for _, v := range tt.values {
+			values <- v
+		}
+		close(values)
+
+		malformed := MalformedRecords()
+		var got []KeyValue
+		reduce("north", "", values, recordEmitter(&got))
+
+		if len(got) != 1 || got[0].Value != tt.want {
+			t.Errorf("%s: got %v, want %q", tt.name, got, tt.want)
+		}
+		if n := MalformedRecords() - malformed; n != tt.malformed {
+			t.Errorf("%s: %d malformed records, want %d", tt.name, n, tt.malformed)
+		}
+		if err := failed(); (err != nil) != tt.strict {
+			t.Errorf("%s: failed()=%v, want failure %v", tt.name, err, tt.strict)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package dmrgo
+
+// A HyperLogLog sketch for approximate distinct counts
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+type hyperLogLog struct {
+	p    uint8
+	regs []uint8
+}
+
+// newHyperLogLog returns a sketch with 2^p registers.  The standard error of the estimate is about 1.04/sqrt(2^p).
+func newHyperLogLog(p uint8) *hyperLogLog {
+	if p < 4 {
+		p = 4
+	}
+	if p > 16 {
+		p = 16
+	}
+	return &hyperLogLog{p: p, regs: make([]uint8, 1<<p)}
+}
+
+// hash64 is FNV-1a with the murmur3 finalizer mixed in to spread the bits out
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h *hyperLogLog) add(s string) {
+	x := hash64(s)
+	idx := x >> (64 - h.p)
+	// the sentinel bit caps the run of zeros so rho fits in the remaining bits
+	w := x<<h.p | 1<<(h.p-1)
+	rho := uint8(bits.LeadingZeros64(w)) + 1
+	if rho > h.regs[idx] {
+		h.regs[idx] = rho
+	}
+}
+
+func (h *hyperLogLog) estimate() uint64 {
+
+	m := float64(len(h.regs))
+
+	var alpha float64
+	switch len(h.regs) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.regs {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	e := alpha * m * m / sum
+
+	// small range correction: linear counting
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(e + 0.5)
+}
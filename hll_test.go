@@ -0,0 +1,51 @@
+package dmrgo
+
+// Tests for the HyperLogLog sketch
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHLLCount(t *testing.T) {
+
+	var tests = []struct {
+		precision uint8
+		distinct  int
+		repeats   int
+	}{
+		{14, 0, 1},
+		{14, 10, 5},
+		{14, 1000, 3},
+		{14, 100000, 2},
+		{10, 100000, 1},
+		{4, 10000, 1},
+		{20, 10000, 1},
+	}
+
+	for _, tt := range tests {
+		var vs []string
+		for r := 0; r < tt.repeats; r++ {
+			vs = append(vs, numbers(tt.distinct)...)
+		}
+
+		got := reduceValues(HLLCount(tt.precision), []string{"k"}, map[string][]string{"k": vs})
+		if len(got) != 1 {
+			t.Fatalf("p=%d n=%d: emitted %v, want one estimate", tt.precision, tt.distinct, got)
+		}
+		est, err := strconv.Atoi(got[0].Value)
+		if err != nil {
+			t.Fatalf("p=%d n=%d: estimate %q: %v", tt.precision, tt.distinct, got[0].Value, err)
+		}
+
+		// allow four standard errors, for the precision after clamping
+		p := math.Min(math.Max(float64(tt.precision), 4), 16)
+		bound := 4 * 1.04 / math.Sqrt(math.Exp2(p)) * float64(tt.distinct)
+		if math.Abs(float64(est-tt.distinct)) > math.Max(bound, 1) {
+			t.Errorf("p=%d n=%d: estimate %d, want within %.0f", tt.precision, tt.distinct, est, bound)
+		}
+	}
+}
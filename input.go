@@ -0,0 +1,180 @@
+package dmrgo
+
+// Input formats for map input
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// RecordReader reads the next record from a stream.  It returns io.EOF when there are no more records.
+type RecordReader func(br *bufio.Reader) (*KeyValue, error)
+
+// InputFormats are the record readers which can be selected for a --mapreduce
+// input file by suffixing its name with ":format", e.g. "part-0000:tsv".
+// Jobs may register their own.
+//
+//	raw   the whole line is the value, the key is empty (the default,
+//	      unless --map-input-keyed)
+//	tsv   dmrgo/Hadoop streaming output: url-encoded key, a tab, then the value
+//	json  as tsv, but the key is JSON (as written by JSONProtocol) and is
+//	      decoded if it is a JSON string; the value is passed through as JSON
+var InputFormats = map[string]RecordReader{
+	"raw":  readLineValue,
+	"tsv":  readLineKeyValue,
+	"json": readJSONKeyValue,
+}
+
+// Decompressors are applied to --mapreduce input files by file name
+// extension, so compressed files are mapped as their uncompressed contents.
+// Jobs may register their own.
+var Decompressors = map[string]func(r io.Reader) (io.Reader, error){
+	".gz":  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	".bz2": func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil },
+}
+
+// openInput opens an input file, decompressing it if its extension has a Decompressor
+func openInput(fname string) (io.ReadCloser, error) {
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	decompress, ok := Decompressors[strings.ToLower(filepath.Ext(fname))]
+	if !ok {
+		return f, nil
+	}
+
+	r, err := decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// openSplit opens the lines of a file which start in the byte range [start,
+// end).  A line which straddles a split boundary belongs to the split it
+// starts in, as with Hadoop's input splits, so together the splits of a file
+// hold each of its lines exactly once.  Records must be single lines.
+func openSplit(fname string, start, end int64) (io.ReadCloser, error) {
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := lineBoundary(f, start)
+	if err == nil {
+		var to int64
+		to, err = lineBoundary(f, end)
+		if err == nil {
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.NewSectionReader(f, from, to-from), f}, nil
+		}
+	}
+
+	f.Close()
+	return nil, err
+}
+
+// lineBoundary returns the offset of the first line in f which starts at or after off
+func lineBoundary(f *os.File, off int64) (int64, error) {
+
+	if off == 0 {
+		return 0, nil
+	}
+
+	// if the byte before off is a newline, a line starts at off
+	br := bufio.NewReader(io.NewSectionReader(f, off-1, math.MaxInt64-(off-1)))
+
+	var n int64
+	for {
+		line, err := br.ReadSlice('\n')
+		n += int64(len(line))
+		if err == nil || err == io.EOF {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return 0, err
+		}
+	}
+
+	return off - 1 + n, nil
+}
+
+// readJSONKeyValue reads a key/value line whose key was marshaled as JSON
+func readJSONKeyValue(br *bufio.Reader) (*KeyValue, error) {
+
+	kv, err := readLineKeyValue(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var s string
+	if json.Unmarshal([]byte(kv.ReduceKey), &s) == nil {
+		kv.ReduceKey = s
+	}
+
+	return kv, nil
+}
+
+// parseInputSpec splits an input argument of the form "name:format" into the
+// file name and its record reader.  Arguments without a known format suffix
+// are read with mapReader.
+func parseInputSpec(arg string) (string, RecordReader) {
+	if i := strings.LastIndex(arg, ":"); i >= 0 {
+		if read, ok := InputFormats[arg[i+1:]]; ok {
+			return arg[:i], read
+		}
+	}
+	return arg, mapReader()
+}
+
+var emitterType = reflect.TypeOf((*Emitter)(nil)).Elem()
+
+// JSONLinesMap adapts a typed map function for JSON Lines input, where each
+// input line is a single JSON value.  mapFn must be a func(v T, emitter
+// Emitter) for some type T; each line is decoded into a new T which is passed
+// to mapFn.  Lines which can't be decoded are skipped (or abort the job in
+// --strict mode).  Call the returned function from the job's Map:
+//
+//	func (j *Job) Map(key string, value string, emitter dmrgo.Emitter) {
+//		j.jsonMap(key, value, emitter)
+//	}
+func JSONLinesMap(mapFn interface{}) func(key string, value string, emitter Emitter) {
+
+	fn := reflect.ValueOf(mapFn)
+	ft := fn.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.NumOut() != 0 || ft.In(1) != emitterType {
+		panic("dmrgo: JSONLinesMap needs a func(v T, emitter Emitter), got " + ft.String())
+	}
+
+	vType := ft.In(0)
+
+	return func(key string, value string, emitter Emitter) {
+		v := reflect.New(vType)
+		if err := json.Unmarshal([]byte(value), v.Interface()); err != nil {
+			badRecord(err)
+			return
+		}
+		fn.Call([]reflect.Value{v.Elem(), reflect.ValueOf(&emitter).Elem()})
+	}
+}
@@ -0,0 +1,352 @@
+package dmrgo
+
+// Tests for the input formats
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// keyValueJob's Map emits its input records as they were read, and Reduce
+// emits each key's values sorted and joined with "|"
+type keyValueJob struct{}
+
+func (*keyValueJob) Map(key string, value string, emitter Emitter) {
+	emitter.Emit(key, "", value)
+}
+
+func (*keyValueJob) MapFinal(emitter Emitter) {}
+
+func (*keyValueJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	var vs []string
+	for v := range values {
+		vs = append(vs, v)
+	}
+	sort.Strings(vs)
+	emitter.Emit(reduceKey, "", strings.Join(vs, "|"))
+}
+
+func TestPerInputFormats(t *testing.T) {
+
+	var tests = []struct {
+		fname    string
+		contents string
+		arg      string
+	}{
+		{"in.json", "\"a b\"\t{\"X\":1}\n\"c\"\t[2]\n", "in.json:json"},
+		{"in.tsv", "a+b\t3\n", "in.tsv:tsv"},
+		{"in.txt", "raw line\n", "in.txt"},
+		// an unknown format is part of the file name
+		{"in.txt:csv", "x,y\n", "in.txt:csv"},
+	}
+
+	dir := setupTestRun(t, "")
+
+	var args []string
+	for _, tt := range tests {
+		fname := filepath.Join(dir, tt.fname)
+		if err := os.WriteFile(fname, []byte(tt.contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, filepath.Join(dir, tt.arg))
+	}
+	setArgs(t, args...)
+
+	if _, err := RunContext(context.Background(), new(keyValueJob)); err != nil {
+		t.Fatalf("RunContext: %v", err)
+	}
+
+	got := readOutput(t, testJobID)
+	sort.Strings(got)
+
+	// the json and tsv keys decode to the same key; raw lines have no key
+	want := []string{"\traw line|x,y", "a+b\t3|{\"X\":1}", "c\t[2]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJSONLinesMap(t *testing.T) {
+
+	type event struct {
+		User  string
+		Count int
+		Tags  []string
+	}
+
+	var tests = []struct {
+		line string
+		want *event
+	}{
+		{`{"User":"ann","Count":3,"Tags":["a","b"]}`, &event{"ann", 3, []string{"a", "b"}}},
+		{`{"User":"bob"}`, &event{User: "bob"}},
+		{`{"User":"cat","Extra":true}`, &event{User: "cat"}},
+		{`{"User":`, nil},
+		{`[1,2]`, nil},
+	}
+
+	for _, tt := range tests {
+		var got *event
+		m := JSONLinesMap(func(e event, emitter Emitter) {
+			got = &e
+			emitter.Emit(e.User, "", strconv.Itoa(e.Count))
+		})
+
+		var kvs []KeyValue
+		before := MalformedRecords()
+		m("", tt.line, recordEmitter(&kvs))
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Map got %+v, want %+v", tt.line, got, tt.want)
+		}
+		if tt.want == nil {
+			if n := MalformedRecords() - before; n != 1 || len(kvs) != 0 {
+				t.Errorf("%s: %d records counted malformed and %v emitted, want 1 and none", tt.line, n, kvs)
+			}
+		} else if len(kvs) != 1 || kvs[0] != (KeyValue{tt.want.User, "", strconv.Itoa(tt.want.Count)}) {
+			t.Errorf("%s: emitted %v", tt.line, kvs)
+		}
+	}
+}
+
+func TestJSONLinesMapBadFunc(t *testing.T) {
+
+	var tests = []interface{}{
+		"not a func",
+		func(v int) {},
+		func(v int, e Emitter) error { return nil },
+		func(v int, s string) {},
+	}
+
+	for _, fn := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("JSONLinesMap(%T) didn't panic", fn)
+				}
+			}()
+			JSONLinesMap(fn)
+		}()
+	}
+}
+
+func TestCompressedInput(t *testing.T) {
+
+	const input = "b\na\nc\na\nb\na\n"
+
+	gz := func(s string) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(s))
+		w.Close()
+		return buf.Bytes()
+	}
+
+	// bzip2 -9 of input; the standard library can only decompress bzip2
+	bz2 := []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\x50\x97\xd7\x7f\x00\x00\x05\x41\x00\x00\x10\x38\x00\x20\x00\x21\x21\xa0\xcd\x34\x51\x89\x38\xbb\x92\x29\xc2\x84\x82\x84\xbe\xbb\xf8")
+
+	// a decompressor a job might register: the bytes reversed
+	setOpt(t, &Decompressors, maps.Clone(Decompressors))
+	Decompressors[".rev"] = func(r io.Reader) (io.Reader, error) {
+		b, err := io.ReadAll(r)
+		slices.Reverse(b)
+		return bytes.NewReader(b), err
+	}
+	reversed := []byte(input)
+	slices.Reverse(reversed)
+
+	var tests = []struct {
+		name     string
+		contents []byte
+	}{
+		{"input.txt", []byte(input)},
+		{"input.gz", gz(input)},
+		{"INPUT.GZ", gz(input)},
+		{"input.txt.gz", gz(input)},
+		{"input.bz2", bz2},
+		{"input.rev", reversed},
+	}
+
+	want := []string{"a\t3", "b\t2", "c\t1"}
+
+	for _, tt := range tests {
+		for _, splitSize := range []int64{0, 4} {
+			dir := setupTestRun(t, "")
+			// compressed files can't be split
+			setOpt(t, &optSplitSize, splitSize)
+
+			fname := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(fname, tt.contents, 0666); err != nil {
+				t.Fatal(err)
+			}
+			setArgs(t, fname)
+
+			if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+				t.Fatalf("%s: RunContext: %v", tt.name, err)
+			}
+			if got := readOutput(t, testJobID); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s split at %d: got %q, want %q", tt.name, splitSize, got, want)
+			}
+		}
+	}
+
+	// a file which isn't what its name says is an error
+	dir := setupTestRun(t, "")
+	fname := filepath.Join(dir, "input.gz")
+	if err := os.WriteFile(fname, []byte(input), 0666); err != nil {
+		t.Fatal(err)
+	}
+	setArgs(t, fname)
+	if _, err := RunContext(context.Background(), new(countJob)); err == nil {
+		t.Errorf("RunContext of a .gz file which isn't gzipped succeeded")
+	}
+}
+
+func TestOpenSplit(t *testing.T) {
+
+	long := strings.Repeat("x", 10000)
+
+	var tests = []struct {
+		name      string
+		contents  string
+		splitSize int64
+	}{
+		{"one split", "a\nb\nc\n", 100},
+		{"split on line boundaries", "aa\nbb\ncc\n", 3},
+		{"lines straddle splits", "a\nbbbb\nc\ndddddd\ne\n", 4},
+		{"byte-sized splits", "a\nbb\n\nccc\n", 1},
+		{"no final newline", "a\nbb\nccc", 2},
+		{"lines longer than the buffer", "a\n" + long + "\nb\n" + long + "\n", 1000},
+	}
+
+	for _, tt := range tests {
+		fname := filepath.Join(t.TempDir(), "input.txt")
+		if err := os.WriteFile(fname, []byte(tt.contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		var got strings.Builder
+		for start := int64(0); start < int64(len(tt.contents)); start += tt.splitSize {
+			r, err := openSplit(fname, start, start+tt.splitSize)
+			if err != nil {
+				t.Fatalf("%s: openSplit(%d): %v", tt.name, start, err)
+			}
+			b, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a split holds only whole lines
+			if len(b) > 0 && got.Len()+len(b) < len(tt.contents) && b[len(b)-1] != '\n' {
+				t.Errorf("%s: split at %d ends mid-line: %q", tt.name, start, b)
+			}
+			got.Write(b)
+		}
+
+		// each line is in exactly one split
+		if got.String() != tt.contents {
+			t.Errorf("%s: splits joined to %q, want %q", tt.name, got.String(), tt.contents)
+		}
+	}
+}
+
+// concurrentMapJob sums the numbered records of each bucket, recording the most Map calls running at once
+type concurrentMapJob struct {
+	sumJob
+	running, most int64
+}
+
+func (j *concurrentMapJob) Map(key string, value string, emitter Emitter) {
+	n := atomic.AddInt64(&j.running, 1)
+	defer atomic.AddInt64(&j.running, -1)
+	for {
+		most := atomic.LoadInt64(&j.most)
+		if n <= most || atomic.CompareAndSwapInt64(&j.most, most, n) {
+			break
+		}
+	}
+	// give the other mappers a chance to run alongside
+	runtime.Gosched()
+
+	// "<bucket> <id> <padding>"
+	f := strings.Fields(value)
+	emitter.Emit(f[0], "", f[1])
+}
+
+func TestSplitLargeFile(t *testing.T) {
+
+	const (
+		size    = 10 << 20
+		buckets = 7
+	)
+
+	var tests = []struct {
+		name      string
+		splitSize int64
+		mappers   int
+		splits    int
+	}{
+		{"unsplit", 0, 4, 1},
+		{"1MB splits", 1 << 20, 4, 10},
+		{"odd splits", 3<<20 + 12345, 3, 4},
+	}
+
+	// numbered lines of varying length, so splits fall mid-line
+	var input strings.Builder
+	counts := make([]int, buckets)
+	sums := make([]int, buckets)
+	for id := 0; input.Len() < size; id++ {
+		b := id % buckets
+		fmt.Fprintf(&input, "b%d %d %s\n", b, id, strings.Repeat("x", id%97))
+		counts[b]++
+		sums[b] += id
+	}
+	var want []string
+	for b := range counts {
+		want = append(want, fmt.Sprintf("b%d\t%d", b, sums[b]))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestRun(t, input.String())
+			setOpt(t, &optSplitSize, tt.splitSize)
+			setOpt(t, &optNumMappers, tt.mappers)
+			setOpt(t, &optKeepTemp, true)
+
+			job := new(concurrentMapJob)
+			if _, err := RunContext(context.Background(), job); err != nil {
+				t.Fatalf("RunContext: %v", err)
+			}
+
+			// each record is summed exactly once
+			got := readOutput(t, testJobID)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+
+			// one spill file for each split
+			if spills := globSpills(t, testJobID, 0); len(spills) != tt.splits {
+				t.Errorf("%d spill files, want %d", len(spills), tt.splits)
+			}
+			if tt.splits > 1 && job.most < 2 {
+				t.Errorf("at most %d Map calls ran at once", job.most)
+			}
+		})
+	}
+}
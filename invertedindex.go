@@ -0,0 +1,65 @@
+package dmrgo
+
+// A built-in inverted index job
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// InvertedIndexJob builds an inverted index.  Its input lines are
+// "docID\ttext"; its output lines are "word\tdocID1,docID2,..." with the
+// document IDs for each word sorted and de-duplicated.  Words are the runs
+// of letters in the lowercased text.
+//
+// The map output uses the document ID as the sort key, so with a secondary
+// sort the IDs for a word arrive in order.
+type InvertedIndexJob struct{}
+
+// Map implements the MapReduceJob interface
+func (j *InvertedIndexJob) Map(key string, value string, emitter Emitter) {
+
+	tab := strings.IndexByte(value, '\t')
+	if tab < 0 {
+		return
+	}
+
+	docID, text := value[:tab], value[tab+1:]
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	seen := make(map[string]bool)
+	for _, w := range words {
+		if seen[w] {
+			continue
+		}
+		seen[w] = true
+		emitter.Emit(w, docID, docID)
+	}
+}
+
+// MapFinal implements the MapReduceJob interface
+func (j *InvertedIndexJob) MapFinal(emitter Emitter) {}
+
+// Reduce implements the MapReduceJob interface
+func (j *InvertedIndexJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+
+	var docs []string
+	seen := make(map[string]bool)
+	for v := range values {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		docs = append(docs, v)
+	}
+
+	sort.Strings(docs)
+
+	emitter.Emit(reduceKey, "", strings.Join(docs, ","))
+}
@@ -0,0 +1,73 @@
+package dmrgo
+
+// Tests for the inverted index job
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestInvertedIndexJob(t *testing.T) {
+
+	corpus := "d2\tthe dog; THE CAT!\n" +
+		"d1\tThe cat sat.\n" +
+		"d3\tcafé crème, naïve\n" +
+		"no tab here\n" +
+		"d1\tagain the cat\n"
+
+	want := []string{
+		"again\td1",
+		"café\td3",
+		"cat\td1,d2",
+		"crème\td3",
+		"dog\td2",
+		"naïve\td3",
+		"sat\td1",
+		"the\td1,d2",
+	}
+
+	var tests = []struct {
+		name string
+		run  func(t *testing.T) []string
+	}{
+		{"RunLocal", func(t *testing.T) []string {
+			kvs, err := RunLocal(new(InvertedIndexJob), strings.NewReader(corpus))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var lines []string
+			for _, kv := range kvs {
+				lines = append(lines, kv.ReduceKey+"\t"+kv.Value)
+			}
+			return lines
+		}},
+		{"mapreduce", func(t *testing.T) []string {
+			setOpt(t, &optSecondaryKey, true)
+			var lines []string
+			for _, line := range runTestJob(t, new(InvertedIndexJob), corpus) {
+				// the words are written escaped
+				kv, err := readLineKeyValue(bufio.NewReader(strings.NewReader(line + "\n")))
+				if err != nil {
+					t.Fatal(err)
+				}
+				lines = append(lines, kv.ReduceKey+"\t"+kv.Value)
+			}
+			return lines
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.run(t)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
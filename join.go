@@ -0,0 +1,93 @@
+package dmrgo
+
+// Joining sorted streams
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// joinCursor reads groups of key/value lines with the same key from a sorted stream
+type joinCursor struct {
+	br *bufio.Reader
+
+	// the first line of the next group, already read
+	key, value string
+	ok         bool
+	err        error
+}
+
+func newJoinCursor(r io.Reader) *joinCursor {
+	c := &joinCursor{br: bufio.NewReader(r)}
+	c.advance()
+	return c
+}
+
+func (c *joinCursor) advance() {
+	line, err := c.br.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		c.ok = false
+		if err != io.EOF {
+			c.err = err
+		}
+		return
+	}
+
+	line = strings.TrimRight(line, "\n")
+	c.key, c.value = line, ""
+	if i := strings.IndexByte(line, fieldSeparator); i >= 0 {
+		c.key, c.value = line[:i], line[i+1:]
+	}
+	c.ok = true
+}
+
+// group returns the values of all the consecutive lines with the current key
+func (c *joinCursor) group() []string {
+	key := c.key
+	var values []string
+	for c.ok && c.key == key {
+		values = append(values, c.value)
+		c.advance()
+	}
+	return values
+}
+
+// MergeJoin joins two streams of key/value lines, split at the field
+// separator (see SetFieldSeparator), which are both sorted by key, bytewise
+// (as with LC_ALL=C sort), advancing through them together so neither has to
+// fit in memory.  onMatch is called for every pair of left and right values
+// which share a key.  Keys are compared exactly as written, without
+// unescaping; only the values for one key from each side are held in memory
+// at a time.
+func MergeJoin(left, right io.Reader, onMatch func(key, l, r string)) error {
+
+	lc := newJoinCursor(left)
+	rc := newJoinCursor(right)
+
+	for lc.ok && rc.ok {
+		switch {
+		case lc.key < rc.key:
+			lc.group()
+		case lc.key > rc.key:
+			rc.group()
+		default:
+			key := lc.key
+			ls := lc.group()
+			rs := rc.group()
+			for _, l := range ls {
+				for _, r := range rs {
+					onMatch(key, l, r)
+				}
+			}
+		}
+	}
+
+	if lc.err != nil {
+		return lc.err
+	}
+
+	return rc.err
+}
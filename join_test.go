@@ -0,0 +1,93 @@
+package dmrgo
+
+// Tests for joining sorted streams
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestMergeJoin(t *testing.T) {
+
+	var tests = []struct {
+		name        string
+		sep         byte
+		left, right string
+		want        []string
+	}{
+		{
+			"one to one",
+			'\t',
+			"a\t1\nb\t2\nd\t4\n",
+			"b\tB\nc\tC\nd\tD\n",
+			[]string{"b 2 B", "d 4 D"},
+		},
+		{
+			"many to many",
+			'\t',
+			"a\t1\na\t2\nb\t3\n",
+			"a\tx\na\ty\nb\tz\nb\tw\n",
+			[]string{"a 1 x", "a 1 y", "a 2 x", "a 2 y", "b 3 z", "b 3 w"},
+		},
+		{
+			"no trailing newline",
+			'\t',
+			"k\tl",
+			"k\tr",
+			[]string{"k l r"},
+		},
+		{
+			"bytewise order",
+			'\t',
+			"B\t1\na\t2\n",
+			"B\tx\na\ty\n",
+			[]string{"B 1 x", "a 2 y"},
+		},
+		{
+			"no value",
+			'\t',
+			"k\nm\t1\n",
+			"k\tr\n",
+			[]string{"k  r"},
+		},
+		{"empty left", '\t', "", "a\t1\n", nil},
+		{"empty right", '\t', "a\t1\n", "", nil},
+		{
+			"field separator",
+			'|',
+			"a|1\tx\nb|2\n",
+			"a|A\nb\tB\n",
+			[]string{"a 1\tx A"},
+		},
+		{"no matches", '\t', "a\t1\nc\t3\n", "b\t2\nd\t4\n", nil},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &fieldSeparator, fieldSeparator)
+		SetFieldSeparator(tt.sep)
+
+		var got []string
+		err := MergeJoin(strings.NewReader(tt.left), strings.NewReader(tt.right), func(key, l, r string) {
+			got = append(got, key+" "+l+" "+r)
+		})
+		if err != nil {
+			t.Errorf("%s: MergeJoin: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergeJoinReadError(t *testing.T) {
+	errRead := errors.New("read failed")
+	err := MergeJoin(strings.NewReader("a\t1\n"), iotest.ErrReader(errRead), func(key, l, r string) {})
+	if !errors.Is(err, errRead) {
+		t.Errorf("MergeJoin()=%v, want %v", err, errRead)
+	}
+}
@@ -0,0 +1,76 @@
+package dmrgo
+
+// Running a job in memory, for tests
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+)
+
+// RunLocal runs mrjob over the lines of input entirely in memory, with no
+// temp files or sort subprocess, and returns what the reducers emitted.  The
+// map output is sorted by reduce key and then sort key; records with the same
+// keys keep the order they were emitted in.  It is meant for testing jobs:
+// counters are summed in memory and can be read with Counter.
+func RunLocal(mrjob MapReduceJob, input io.Reader) ([]KeyValue, error) {
+
+	if err := Validate(mrjob); err != nil {
+		return nil, err
+	}
+
+	countersMu.Lock()
+	localCounters = true
+	countersMu.Unlock()
+
+	resetFailure()
+
+	mapped := new(bufferEmitter)
+	mapper(mrjob, input, mapReader(), mapped, stdReporter)
+	mapperFinal(mrjob, mapped, stdReporter)
+
+	if err := failed(); err != nil {
+		return nil, err
+	}
+
+	var kvs []KeyValue
+	for _, kv := range mapped.kvs {
+		if MapOutputTransform != nil {
+			t := MapOutputTransform(&kv)
+			if t == nil {
+				continue
+			}
+			kv = *t
+		}
+		kv.ReduceKey = normalizeKey(kv.ReduceKey)
+		kv.SortKey = padSortKey(kv.SortKey)
+		kvs = append(kvs, kv)
+	}
+	sort.SliceStable(kvs, func(i, j int) bool {
+		if kvs[i].ReduceKey != kvs[j].ReduceKey {
+			return kvs[i].ReduceKey < kvs[j].ReduceKey
+		}
+		return kvs[i].SortKey < kvs[j].SortKey
+	})
+
+	// the reducer reads the sorted records as lines, as it would from sort
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	e := newPrintEmitter(w)
+	for _, kv := range kvs {
+		e.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+	}
+	e.Flush()
+
+	reduced := new(bufferEmitter)
+	reducer(mrjob, &buf, readLineKeyValue, reduced, stdReporter)
+
+	if err := failed(); err != nil {
+		return nil, err
+	}
+
+	return reduced.kvs, nil
+}
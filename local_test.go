@@ -0,0 +1,88 @@
+package dmrgo
+
+// Tests for running a job in memory
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// wordCountJob counts the words of its input
+type wordCountJob struct{}
+
+func (*wordCountJob) Map(key string, value string, emitter Emitter) {
+	for _, w := range strings.Fields(value) {
+		emitter.Emit(strings.ToLower(w), "", "1")
+	}
+}
+
+func (*wordCountJob) MapFinal(emitter Emitter) {}
+
+func (*wordCountJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	n := 0
+	for range values {
+		n++
+	}
+	emitter.Emit(reduceKey, "", strconv.Itoa(n))
+}
+
+func TestRunLocal(t *testing.T) {
+
+	var tests = []struct {
+		name  string
+		job   MapReduceJob
+		input string
+		want  []KeyValue
+	}{
+		{"word count", new(wordCountJob), "the cat\nThe hat\n\nthe end\n",
+			[]KeyValue{{"cat", "", "1"}, {"end", "", "1"}, {"hat", "", "1"}, {"the", "", "3"}}},
+		{"no input", new(wordCountJob), "", nil},
+		{"keys needing escapes", new(wordCountJob), "a,b a\tb a,b\n",
+			[]KeyValue{{"a", "", "1"}, {"a,b", "", "2"}, {"b", "", "1"}}},
+		{"MapFinal", new(finalJob), "x\nx\n",
+			[]KeyValue{{"final", "", "1"}, {"x", "", "2"}}},
+		// values reach Reduce in sort key order, whatever order they were mapped in
+		{"sort keys", new(sortKeyJob), "b 2\na 3\nb 1\na 1\na 2\n",
+			[]KeyValue{{"a", "", "1 2 3"}, {"b", "", "1 2"}}},
+	}
+
+	for _, tt := range tests {
+		got, err := RunLocal(tt.job, strings.NewReader(tt.input))
+		if err != nil {
+			t.Errorf("%s: RunLocal: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunLocalErrors(t *testing.T) {
+
+	var tests = []struct {
+		name  string
+		job   MapReduceJob
+		setup func(t *testing.T)
+	}{
+		{"invalid job", &validatingJob{err: errors.New("bad configuration")}, func(t *testing.T) {}},
+		{"malformed record in strict mode", new(countJob), func(t *testing.T) {
+			setOpt(t, &optStrict, true)
+			setOpt(t, &optMapInputKeyed, true)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup(t)
+			if got, err := RunLocal(tt.job, strings.NewReader("%zz\tv\n")); err == nil {
+				t.Errorf("RunLocal()=%v, want an error", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package dmrgo
+
+// Merging sorted files
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// a sorted stream of lines, with its current line
+type mergeSource struct {
+	br   *bufio.Reader
+	line string
+}
+
+// lineHeap is a min-heap of sources ordered by their current line
+type lineHeap []*mergeSource
+
+func (h lineHeap) Len() int            { return len(h) }
+func (h lineHeap) Less(i, j int) bool  { return h[i].line < h[j].line }
+func (h lineHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *lineHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+func (h *lineHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// readMergeLine reads the next line, adding the trailing newline if the stream doesn't end with one
+func readMergeLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err == io.EOF && line != "" {
+		return line + "\n", nil
+	}
+	return line, err
+}
+
+// mergeLines merges streams of lines, each sorted bytewise, into a single sorted stream
+func mergeLines(w io.Writer, readers ...io.Reader) error {
+
+	h := make(lineHeap, 0, len(readers))
+
+	for _, r := range readers {
+		br := bufio.NewReader(r)
+		line, err := readMergeLine(br)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		h = append(h, &mergeSource{br, line})
+	}
+
+	heap.Init(&h)
+
+	bw := bufio.NewWriter(w)
+
+	for h.Len() > 0 {
+		src := h[0]
+		if _, err := bw.WriteString(src.line); err != nil {
+			return err
+		}
+
+		line, err := readMergeLine(src.br)
+		switch {
+		case err == io.EOF:
+			heap.Pop(&h)
+		case err != nil:
+			return err
+		default:
+			src.line = line
+			heap.Fix(&h, 0)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ReduceAll merges the sorted reduce input of every partition of the
+// --mapreduce run with the given pid and reduces it in one pass, writing the
+// output to w.  Comparing its output with the partitioned output checks that
+// keys were grouped correctly across partitions.  The reduce input files
+// (tmp-red-in-p<pid>.* in --tmp-dir) are only written with --sort-to-disk,
+// and are removed as each partition finishes unless --keep-temp is set, so
+// this is for debugging runs which kept them.
+func ReduceAll(mrjob MapReduceJob, pid int, w io.Writer) error {
+
+	resetFailure()
+
+	fns, err := filepath.Glob(reduceInputGlob(pid))
+	if err != nil {
+		return err
+	}
+	if len(fns) == 0 {
+		return fmt.Errorf("no reduce input files for pid %d", pid)
+	}
+
+	var readers []io.Reader
+	for _, fn := range fns {
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := mergeLines(pw, readers...)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+
+	bw := bufio.NewWriter(w)
+	emitter := newOutputEmitter(bw)
+	reducer(mrjob, pr, readLineKeyValue, emitter, stdReporter)
+	emitter.Close()
+	pr.Close()
+
+	// a merge error would have cut the reducer's input short
+	if err := <-errc; err != nil && err != io.ErrClosedPipe {
+		return err
+	}
+
+	if err := failed(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
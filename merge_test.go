@@ -0,0 +1,94 @@
+package dmrgo
+
+// Tests for merging sorted files
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMergeLines(t *testing.T) {
+
+	var tests = []struct {
+		inputs []string
+		want   string
+	}{
+		{[]string{"a\nc\ne\n", "b\nd\nf\n"}, "a\nb\nc\nd\ne\nf\n"},
+		{[]string{"a\na\n", "a\n"}, "a\na\na\n"},
+		{[]string{"", "x\n", ""}, "x\n"},
+		{[]string{"b", "a"}, "a\nb\n"},
+		{[]string{"B\n", "a\n"}, "B\na\n"},
+		{nil, ""},
+	}
+
+	for _, tt := range tests {
+		var readers []io.Reader
+		for _, in := range tt.inputs {
+			readers = append(readers, strings.NewReader(in))
+		}
+		var buf bytes.Buffer
+		if err := mergeLines(&buf, readers...); err != nil {
+			t.Errorf("mergeLines(%q): %v", tt.inputs, err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("mergeLines(%q)=%q, want %q", tt.inputs, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestReduceAll(t *testing.T) {
+
+	var input strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&input, "k%d\n", i%23)
+	}
+
+	setupTestRun(t, input.String())
+	setOpt(t, &optNumPartitions, 4)
+	setOpt(t, &optSortToDisk, true)
+	setOpt(t, &optKeepTemp, true)
+
+	if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+		t.Fatalf("RunContext: %v", err)
+	}
+	partitioned := readOutput(t, testJobID)
+	sort.Strings(partitioned)
+
+	// one pass over every partition's input groups each key once, in order
+	job := new(callCountJob)
+	var buf bytes.Buffer
+	if err := ReduceAll(job, testJobID, &buf); err != nil {
+		t.Fatalf("ReduceAll: %v", err)
+	}
+
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if !reflect.DeepEqual(got, partitioned) {
+		t.Errorf("ReduceAll output %q, want %q", got, partitioned)
+	}
+	if job.calls != 23 {
+		t.Errorf("%d Reduce calls, want 23", job.calls)
+	}
+
+	if err := ReduceAll(new(countJob), testJobID+1, io.Discard); err == nil {
+		t.Error("ReduceAll of a run with no reduce input succeeded")
+	}
+}
+
+// callCountJob is a countJob which counts its Reduce calls
+type callCountJob struct {
+	countJob
+	calls int
+}
+
+func (j *callCountJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	j.calls++
+	j.countJob.Reduce(reduceKey, sortKey, values, emitter)
+}
@@ -0,0 +1,56 @@
+package dmrgo
+
+// Forwarding counters and status to a metrics system
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"strings"
+)
+
+// MetricsSink receives every counter increment and status update as it
+// happens, for live monitoring of a job.  Its methods may be called from
+// several goroutines at once.  Float counters are not forwarded.
+type MetricsSink interface {
+	Count(group, counter string, amount int64)
+	Status(msg string)
+}
+
+// Metrics, if set, is sent the job's counter increments and status updates,
+// in addition to their being reported as usual.
+var Metrics MetricsSink
+
+// StatsDClient is the part of a StatsD client NewStatsDSink needs.  Wrap
+// your StatsD library's client to use it; dmrgo doesn't depend on one.
+type StatsDClient interface {
+	Count(bucket string, n int64)
+}
+
+// statsDSink forwards counters to StatsD
+type statsDSink struct {
+	client StatsDClient
+	prefix string
+}
+
+// NewStatsDSink returns a MetricsSink which sends counters to client, in
+// the bucket prefix.group.counter ("group.counter" for an empty prefix).
+// Characters StatsD doesn't allow in bucket names are replaced by
+// underscores.  StatsD has no status messages, so they are dropped.
+func NewStatsDSink(client StatsDClient, prefix string) MetricsSink {
+	return &statsDSink{client, prefix}
+}
+
+// statsDBucketChars replaces the characters which would break the StatsD line protocol
+var statsDBucketChars = strings.NewReplacer(" ", "_", ":", "_", "|", "_", "@", "_", "\n", "_")
+
+func (s *statsDSink) Count(group, counter string, amount int64) {
+	bucket := statsDBucketChars.Replace(group) + "." + statsDBucketChars.Replace(counter)
+	if s.prefix != "" {
+		bucket = s.prefix + "." + bucket
+	}
+	s.client.Count(bucket, amount)
+}
+
+func (s *statsDSink) Status(msg string) {
+	// nothing
+}
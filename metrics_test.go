@@ -0,0 +1,120 @@
+package dmrgo
+
+// Tests for the metrics sinks
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSink records what it is sent
+type fakeSink struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (s *fakeSink) Count(group, counter string, amount int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, fmt.Sprintf("count %s/%s %d", group, counter, amount))
+}
+
+func (s *fakeSink) Status(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, "status "+msg)
+}
+
+func TestMetricsSink(t *testing.T) {
+
+	var tests = []struct {
+		name   string
+		report func(r *Reporter)
+		want   []string
+	}{
+		{"counter", func(r *Reporter) { r.IncrCounter("Program", "lines", 3) }, []string{"count Program/lines 3"}},
+		{"increments", func(r *Reporter) {
+			r.IncrCounter("g", "c", 1)
+			r.IncrCounter("g", "c", -2)
+		}, []string{"count g/c 1", "count g/c -2"}},
+		{"status", func(r *Reporter) { r.SetStatus("halfway") }, []string{"status halfway"}},
+		{"float counter", func(r *Reporter) { IncrFloatCounter("g", "f", 1.5) }, nil},
+	}
+
+	setOpt(t, &localCounters, true)
+
+	for _, tt := range tests {
+		sink := new(fakeSink)
+		setOpt[MetricsSink](t, &Metrics, sink)
+
+		tt.report(newReporter(io.Discard))
+		if !reflect.DeepEqual(sink.events, tt.want) {
+			t.Errorf("%s: sink got %q, want %q", tt.name, sink.events, tt.want)
+		}
+	}
+}
+
+// countingJob counts its input lines with IncrCounter
+type countingJob struct {
+	countJob
+}
+
+func (j *countingJob) Map(key string, value string, emitter Emitter) {
+	IncrCounter("Program", "lines", 1)
+	j.countJob.Map(key, value, emitter)
+}
+
+func TestMetricsSinkRun(t *testing.T) {
+
+	sink := new(fakeSink)
+	setOpt[MetricsSink](t, &Metrics, sink)
+
+	if _, err := RunLocal(new(countingJob), strings.NewReader("a\nb\na\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"count Program/lines 1", "count Program/lines 1", "count Program/lines 1"}
+	if !reflect.DeepEqual(sink.events, want) {
+		t.Errorf("sink got %q, want %q", sink.events, want)
+	}
+}
+
+// fakeStatsD records the buckets it is sent
+type fakeStatsD struct {
+	counts []string
+}
+
+func (c *fakeStatsD) Count(bucket string, n int64) {
+	c.counts = append(c.counts, fmt.Sprintf("%s:%d", bucket, n))
+}
+
+func TestStatsDSink(t *testing.T) {
+
+	var tests = []struct {
+		prefix, group, counter string
+		want                   string
+	}{
+		{"", "Program", "lines", "Program.lines:1"},
+		{"jobs.wc", "Program", "lines", "jobs.wc.Program.lines:1"},
+		{"", "Map Input", "bad|records:all", "Map_Input.bad_records_all:1"},
+		{"p", "a@b", "two\nlines", "p.a_b.two_lines:1"},
+	}
+
+	for _, tt := range tests {
+		client := new(fakeStatsD)
+		sink := NewStatsDSink(client, tt.prefix)
+
+		sink.Count(tt.group, tt.counter, 1)
+		sink.Status("dropped")
+
+		if want := []string{tt.want}; !reflect.DeepEqual(client.counts, want) {
+			t.Errorf("prefix %q, counter %q/%q: sent %q, want %q", tt.prefix, tt.group, tt.counter, client.counts, want)
+		}
+	}
+}
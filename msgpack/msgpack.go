@@ -0,0 +1,71 @@
+// Package msgpack provides a dmrgo.BinaryCodec for MessagePack, so dmrgo
+// itself doesn't depend on a MessagePack library
+package msgpack
+
+// MessagePack codec for dmrgo.BinaryProtocol
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bytes"
+
+	"github.com/dgryski/dmrgo"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes values as MessagePack.  Structs are encoded as arrays,
+// without their field names, so they must be decoded into a struct with the
+// same fields in the same order.
+type Codec struct {
+	// empty -- just a type
+}
+
+var _ dmrgo.BinaryCodec = Codec{}
+
+// Marshal implements the dmrgo.BinaryCodec interface
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseArrayEncodedStructs(true)
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+// Unmarshal implements the dmrgo.BinaryCodec interface
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// MsgpackProtocol is a StreamProtocol which encodes values as base64
+// MessagePack, which is smaller and faster to decode than JSON for
+// struct-heavy jobs.  It is a dmrgo.BinaryProtocol with Codec; the zero
+// value is ready to use.
+type MsgpackProtocol struct {
+	// empty -- just a type
+}
+
+var _ dmrgo.StreamProtocol = (*MsgpackProtocol)(nil)
+var _ dmrgo.ValueUnmarshaler = (*MsgpackProtocol)(nil)
+
+// binary does the encoding for every MsgpackProtocol; it has no state of its own
+var binary = &dmrgo.BinaryProtocol{Codec: Codec{}}
+
+// NewProtocol returns a MsgpackProtocol
+func NewProtocol() *MsgpackProtocol {
+	return new(MsgpackProtocol)
+}
+
+// Marshal implements the dmrgo.StreamProtocol interface.  A nil sortKey is written as no sort key.
+func (p *MsgpackProtocol) Marshal(reduceKey interface{}, sortKey interface{}, value interface{}) *dmrgo.KeyValue {
+	return binary.Marshal(reduceKey, sortKey, value)
+}
+
+// UnmarshalKVs implements the dmrgo.StreamProtocol interface
+func (p *MsgpackProtocol) UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) error {
+	return binary.UnmarshalKVs(key, values, k, vs)
+}
+
+// UnmarshalValue implements the dmrgo.ValueUnmarshaler interface
+func (p *MsgpackProtocol) UnmarshalValue(value string, v interface{}) error {
+	return binary.UnmarshalValue(value, v)
+}
@@ -0,0 +1,109 @@
+package msgpack
+
+// Tests and benchmarks for the MessagePack codec
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dgryski/dmrgo"
+)
+
+// order is a representative struct-heavy value
+type order struct {
+	ID       int64
+	Customer string
+	Items    []lineItem
+	Total    float64
+	Paid     bool
+}
+
+type lineItem struct {
+	SKU      string
+	Quantity int
+	Price    float64
+}
+
+var testOrder = order{
+	ID:       1234567,
+	Customer: "customer-42",
+	Items: []lineItem{
+		{"sku-0001", 2, 9.99},
+		{"sku-0002", 1, 24.50},
+		{"sku-0003", 12, 0.35},
+	},
+	Total: 48.68,
+	Paid:  true,
+}
+
+func TestProtocolRoundTrip(t *testing.T) {
+
+	var tests = []struct {
+		name string
+		p    *MsgpackProtocol
+	}{
+		{"NewProtocol", NewProtocol()},
+		{"zero value", new(MsgpackProtocol)},
+	}
+
+	for _, tt := range tests {
+		kv := tt.p.Marshal("key", nil, testOrder)
+
+		var key string
+		var orders []order
+		if err := tt.p.UnmarshalKVs(kv.ReduceKey, []string{kv.Value, "not base64!", kv.Value}, &key, &orders); err == nil {
+			t.Errorf("%s: UnmarshalKVs didn't report the bad value", tt.name)
+		}
+
+		if key != "key" || len(orders) != 3 {
+			t.Fatalf("%s: UnmarshalKVs decoded %q, %d values", tt.name, key, len(orders))
+		}
+		if !reflect.DeepEqual(orders[0], testOrder) || !reflect.DeepEqual(orders[2], testOrder) {
+			t.Errorf("%s: UnmarshalKVs decoded %+v, want %+v", tt.name, orders, testOrder)
+		}
+
+		var o order
+		if err := tt.p.UnmarshalValue(kv.Value, &o); err != nil || !reflect.DeepEqual(o, testOrder) {
+			t.Errorf("%s: UnmarshalValue decoded %+v, %v, want %+v", tt.name, o, err, testOrder)
+		}
+	}
+}
+
+var protocols = []struct {
+	name string
+	p    dmrgo.StreamProtocol
+}{
+	{"Msgpack", NewProtocol()},
+	{"JSON", new(dmrgo.JSONProtocol)},
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	for _, bp := range protocols {
+		b.Run(bp.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var size int
+			for i := 0; i < b.N; i++ {
+				size = len(bp.p.Marshal("key", nil, testOrder).Value)
+			}
+			b.ReportMetric(float64(size), "bytes/value")
+		})
+	}
+}
+
+func BenchmarkUnmarshalValue(b *testing.B) {
+	for _, bp := range protocols {
+		b.Run(bp.name, func(b *testing.B) {
+			value := bp.p.Marshal("key", nil, testOrder).Value
+			u := bp.p.(dmrgo.ValueUnmarshaler)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var o order
+				if err := u.UnmarshalValue(value, &o); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
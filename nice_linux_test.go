@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+package dmrgo
+
+// Tests for running the sort subprocesses at a lower priority
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// niceness returns the niceness of a process from a copy of its /proc/<pid>/stat
+func niceness(t *testing.T, stat string) int {
+	t.Helper()
+	b, err := os.ReadFile(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fields after the parenthesised command name, which may contain spaces
+	fields := strings.Fields(string(b[strings.LastIndexByte(string(b), ')')+1:]))
+	n, err := strconv.Atoi(fields[16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSortNice(t *testing.T) {
+
+	sortPath, err := exec.LookPath("sort")
+	if err != nil {
+		t.Skip("no sort command")
+	}
+
+	// a stub sort which records its niceness, once it has had time to be changed, and then sorts
+	bin := t.TempDir()
+	niceFile := filepath.Join(bin, "nice")
+	script := fmt.Sprintf("#!/bin/sh\nsleep 0.2\ncp /proc/$$/stat %s\nexec %s \"$@\"\n", niceFile, sortPath)
+	if err := os.WriteFile(filepath.Join(bin, "sort"), []byte(script), 0777); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setOpt(t, &optGoSort, false)
+
+	base := niceness(t, "/proc/self/stat")
+
+	var tests = []struct {
+		nice int
+		want int
+	}{
+		{0, base},
+		{base + 5, base + 5},
+		{19, 19},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optNice, tt.nice)
+
+		os.Remove(niceFile)
+		if got := runTestJob(t, new(countJob), "b\na\nb\n"); !reflect.DeepEqual(got, []string{"a\t1", "b\t2"}) {
+			t.Errorf("--nice=%d: output %q", tt.nice, got)
+		}
+
+		if got := niceness(t, niceFile); got != tt.want {
+			t.Errorf("--nice=%d: sort ran at niceness %d, want %d", tt.nice, got, tt.want)
+		}
+		if got := niceness(t, "/proc/self/stat"); got != base {
+			t.Errorf("--nice=%d: our niceness changed to %d", tt.nice, got)
+		}
+	}
+}
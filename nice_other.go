@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package dmrgo
+
+// Running the sort subprocesses at a lower priority
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"errors"
+)
+
+// setNice sets the niceness of the process pid
+func setNice(pid int, nice int) error {
+	return errors.New("--nice isn't supported on this platform")
+}
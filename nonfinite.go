@@ -0,0 +1,137 @@
+package dmrgo
+
+// Round-tripping NaN and infinite floats through the protocols
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// The tokens the protocols write for floats which are NaN or infinite, and
+// parse back into them.  JSON has no numbers for them, so JSONProtocol
+// writes them as JSON strings; see Float.
+var (
+	NaNToken    = "NaN"
+	PosInfToken = "+Inf"
+	NegInfToken = "-Inf"
+)
+
+// nonFiniteToken returns the token for f, or false if f is finite
+func nonFiniteToken(f float64) (string, bool) {
+	switch {
+	case math.IsNaN(f):
+		return NaNToken, true
+	case math.IsInf(f, 1):
+		return PosInfToken, true
+	case math.IsInf(f, -1):
+		return NegInfToken, true
+	}
+	return "", false
+}
+
+// parseNonFinite returns the float for a token, or false if s isn't one
+func parseNonFinite(s string) (float64, bool) {
+	switch s {
+	case NaNToken:
+		return math.NaN(), true
+	case PosInfToken:
+		return math.Inf(1), true
+	case NegInfToken:
+		return math.Inf(-1), true
+	}
+	return 0, false
+}
+
+// scanValue parses s into the value ptr points to, as fmt.Sscan does, but
+// also parsing the non-finite float tokens
+func scanValue(s string, ptr interface{}) error {
+	v := reflect.ValueOf(ptr).Elem()
+	if k := v.Kind(); k == reflect.Float32 || k == reflect.Float64 {
+		if f, ok := parseNonFinite(s); ok {
+			v.SetFloat(f)
+			return nil
+		}
+		// fmt can't scan named float types such as Float
+		if v.Type().PkgPath() != "" {
+			var f float64
+			if _, err := fmt.Sscan(s, &f); err != nil {
+				return err
+			}
+			v.SetFloat(f)
+			return nil
+		}
+	}
+	_, err := fmt.Sscan(s, ptr)
+	return err
+}
+
+// Float is a float64 which can be NaN or infinite in JSON: it is written as
+// the JSON string NaNToken, PosInfToken or NegInfToken, and parsed back from
+// them.  encoding/json refuses to marshal a plain float64 which isn't finite,
+// so use Float for fields which may not be.  A float marshaled on its own by
+// JSONProtocol or JSONCodec is handled either way.
+type Float float64
+
+// MarshalJSON implements the json.Marshaler interface
+func (f Float) MarshalJSON() ([]byte, error) {
+	if t, ok := nonFiniteToken(float64(f)); ok {
+		return json.Marshal(t)
+	}
+	return json.Marshal(float64(f))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (f *Float) UnmarshalJSON(data []byte) error {
+	if v, ok := parseJSONNonFinite(data); ok {
+		*f = Float(v)
+		return nil
+	}
+	return json.Unmarshal(data, (*float64)(f))
+}
+
+// parseJSONNonFinite returns the float for a JSON string holding one of the
+// non-finite float tokens, or false if data isn't one
+func parseJSONNonFinite(data []byte) (float64, bool) {
+	var s string
+	if len(data) == 0 || data[0] != '"' || json.Unmarshal(data, &s) != nil {
+		return 0, false
+	}
+	return parseNonFinite(s)
+}
+
+// marshalJSON marshals v with marshal, as a Float if it is a float which isn't finite
+func marshalJSON(marshal func(v interface{}) ([]byte, error), v interface{}) ([]byte, error) {
+	switch f := v.(type) {
+	case float64:
+		if _, ok := nonFiniteToken(f); ok {
+			v = Float(f)
+		}
+	case float32:
+		if _, ok := nonFiniteToken(float64(f)); ok {
+			v = Float(f)
+		}
+	}
+	return marshal(v)
+}
+
+// unmarshalJSON decodes data into the value ptr points to, parsing the
+// non-finite float tokens if it is a float
+func unmarshalJSON(data []byte, ptr interface{}) error {
+	switch p := ptr.(type) {
+	case *float64:
+		if f, ok := parseJSONNonFinite(data); ok {
+			*p = f
+			return nil
+		}
+	case *float32:
+		if f, ok := parseJSONNonFinite(data); ok {
+			*p = float32(f)
+			return nil
+		}
+	}
+	return json.Unmarshal(data, ptr)
+}
@@ -0,0 +1,153 @@
+package dmrgo
+
+// Named reduce outputs, like Hadoop's MultipleOutputs
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// NamedEmitter is an Emitter which can also write records to named outputs,
+// e.g. to split a reduce's records into "valid" and "rejected".  The emitter
+// passed to Reduce (or TryReduce, whose named records are buffered and
+// written with the rest of a successful attempt's) is always a NamedEmitter:
+//
+//	emitter.(dmrgo.NamedEmitter).EmitTo("rejected", &dmrgo.KeyValue{reduceKey, "", value})
+//
+// In --mapreduce mode each named output is written to
+// red-out-<name>-p<pid>.<partition>, created the first time a record is
+// written to it.  Elsewhere, e.g. under Hadoop streaming, there are no named
+// outputs and records are written to the primary output.
+type NamedEmitter interface {
+	Emitter
+	EmitTo(name string, kv *KeyValue)
+}
+
+// EmitTo writes a record to the named output if the emitter has named outputs, or emits it if not
+func (e *reportingEmitter) EmitTo(name string, kv *KeyValue) {
+	if ne, ok := e.Emitter.(NamedEmitter); ok {
+		ne.EmitTo(name, kv)
+		return
+	}
+	e.Emitter.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+}
+
+// namedOutputEmitter adds the named outputs of a partition to its primary output
+type namedOutputEmitter struct {
+	Emitter
+	pid       int
+	partition int
+	stats     *RunStats
+
+	mu      sync.Mutex
+	outputs map[string]*namedOutput
+}
+
+// namedOutput is an open named output file
+type namedOutput struct {
+	fd      outputFile
+	cw      *countingWriter
+	gz      *gzip.Writer
+	emitter Emitter
+}
+
+func newNamedOutputEmitter(e Emitter, pid int, partition int, stats *RunStats) *namedOutputEmitter {
+	return &namedOutputEmitter{
+		Emitter:   e,
+		pid:       pid,
+		partition: partition,
+		stats:     stats,
+		outputs:   make(map[string]*namedOutput),
+	}
+}
+
+func (e *namedOutputEmitter) EmitTo(name string, kv *KeyValue) {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out, ok := e.outputs[name]
+	if !ok {
+		var err error
+		out, err = e.create(name)
+		if err != nil {
+			fail(err)
+			return
+		}
+		e.outputs[name] = out
+	}
+
+	atomic.AddInt64(&e.stats.OutputRecords, 1)
+	out.emitter.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+}
+
+// create opens the file for a named output and records its name in the partition's stats
+func (e *namedOutputEmitter) create(name string) (*namedOutput, error) {
+
+	fname := namedOutputFileName(name, e.pid, e.partition)
+	fd, err := createOutputFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	pstats := &e.stats.Partitions[e.partition]
+	pstats.NamedOutputs = append(pstats.NamedOutputs, fname)
+
+	out := &namedOutput{fd: fd, cw: &countingWriter{w: fd}}
+	var w io.Writer = out.cw
+	if optCompressOutput {
+		out.gz = newGzipWriter(out.cw)
+		w = out.gz
+	}
+	out.emitter = newOutputEmitter(bufio.NewWriter(w))
+
+	return out, nil
+}
+
+// closeNamed flushes and closes the named outputs, returning the first error
+func (e *namedOutputEmitter) closeNamed() error {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var err error
+	for _, out := range e.outputs {
+		out.emitter.Close()
+		// the gzip trailer must be written before the file is closed
+		if out.gz != nil {
+			if gerr := out.gz.Close(); gerr != nil && err == nil {
+				err = gerr
+			}
+		}
+		if cerr := closeOutputFile(out.fd); cerr != nil && err == nil {
+			err = cerr
+		}
+		atomic.AddInt64(&e.stats.OutputBytes, out.cw.n)
+	}
+
+	return err
+}
+
+func (e *namedOutputEmitter) emitKey(reduceKey string) {
+	emitKeyOnly(e.Emitter, reduceKey)
+}
+
+func (e *namedOutputEmitter) writeSentinel(line string) {
+	emitSentinel(e.Emitter, line)
+}
+
+// namedOutputFileName returns the name of a named output file for a partition, in --output-dir
+func namedOutputFileName(name string, pid int, partition int) string {
+	fname := filepath.Join(optOutputDir, fmt.Sprintf("red-out-%s-p%d.%04d%s", fileNamePart(name), pid, partition, outputExt()))
+	if optCompressOutput {
+		fname += ".gz"
+	}
+	return fname
+}
@@ -0,0 +1,95 @@
+package dmrgo
+
+// Tests for named outputs
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// splitJob writes even values to the "even" output, odd ones to "odd" and their count to the primary output
+type splitJob struct {
+	sortKeyJob
+}
+
+func (*splitJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	n := 0
+	for v := range values {
+		i, _ := strconv.Atoi(v)
+		name := "even"
+		if i%2 == 1 {
+			name = "odd"
+		}
+		emitter.(NamedEmitter).EmitTo(name, &KeyValue{reduceKey, "", v})
+		n++
+	}
+	emitter.Emit(reduceKey, "", strconv.Itoa(n))
+}
+
+// trySplitJob is splitJob as an ErrorReducer whose first attempt at each key fails
+type trySplitJob struct {
+	splitJob
+	attempts map[string]int
+}
+
+func (j *trySplitJob) TryReduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) error {
+	j.attempts[reduceKey]++
+	j.splitJob.Reduce(reduceKey, sortKey, values, emitter)
+	if j.attempts[reduceKey] == 1 {
+		return Retryable(errors.New("first attempt"))
+	}
+	return nil
+}
+
+func TestNamedOutputs(t *testing.T) {
+
+	var tests = []struct {
+		name string
+		job  MapReduceJob
+	}{
+		{"Reduce", new(splitJob)},
+		{"TryReduce", &trySplitJob{attempts: make(map[string]int)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOpt(t, &Retry, RetryPolicy{MaxAttempts: 2})
+
+			got := runTestJob(t, tt.job, "a 1\na 2\nb 3\na 4\n")
+			if want := []string{"a\t3", "b\t1"}; strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("primary output %q, want %q", got, want)
+			}
+
+			named := map[string]string{
+				"even": "a\t2\na\t4\n",
+				"odd":  "a\t1\nb\t3\n",
+			}
+
+			var fnames []string
+			for _, p := range LastRunStats().Partitions {
+				fnames = append(fnames, p.NamedOutputs...)
+			}
+			sort.Strings(fnames)
+			if len(fnames) != 2 || fnames[0] != namedOutputFileName("even", testJobID, 0) || fnames[1] != namedOutputFileName("odd", testJobID, 0) {
+				t.Errorf("named outputs %q", fnames)
+			}
+
+			for name, want := range named {
+				b, err := os.ReadFile(namedOutputFileName(name, testJobID, 0))
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				if string(b) != want {
+					t.Errorf("%s output %q, want %q", name, b, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package dmrgo
+
+// Zero-padded numbers, so numeric keys sort correctly bytewise
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"strconv"
+	"strings"
+)
+
+// PadInt formats n zero-padded to width digits, so that numbers sort in
+// numeric order when compared bytewise, as the sort phase does: PadInt(2, 4)
+// is "0002", which sorts before PadInt(10, 4), "0010".  Negative numbers are
+// written as "-" and the nines' complement of the padded digits, so they sort
+// before the non-negative numbers and in numeric order among themselves.
+// Numbers with more than width digits aren't truncated, but then don't sort
+// correctly.  UnpadInt parses the result.
+func PadInt(n int64, width int) string {
+
+	neg := n < 0
+	u := uint64(n)
+	if neg {
+		u = -u
+	}
+
+	s := strconv.FormatUint(u, 10)
+	if len(s) < width {
+		s = strings.Repeat("0", width-len(s)) + s
+	}
+
+	if !neg {
+		return s
+	}
+
+	return "-" + strings.Map(func(r rune) rune { return '9' - r + '0' }, s)
+}
+
+// UnpadInt parses a number formatted by PadInt
+func UnpadInt(s string) (int64, error) {
+
+	digits := strings.TrimPrefix(s, "-")
+	neg := digits != s
+	if neg {
+		digits = strings.Map(func(r rune) rune {
+			if r < '0' || r > '9' {
+				return r
+			}
+			return '9' - r + '0'
+		}, digits)
+	}
+
+	u, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, &strconv.NumError{Func: "UnpadInt", Num: s, Err: err.(*strconv.NumError).Err}
+	}
+
+	if neg {
+		return -int64(u), nil
+	}
+	return int64(u), nil
+}
+
+// padSortKey pads a sort key which is an integer to --pad-sort-keys digits
+func padSortKey(sortKey string) string {
+	if optPadSortKeys <= 0 {
+		return sortKey
+	}
+	n, err := strconv.ParseInt(sortKey, 10, 64)
+	if err != nil {
+		return sortKey
+	}
+	return PadInt(n, optPadSortKeys)
+}
+
+// unpadSortKey reverses padSortKey for the reducer
+func unpadSortKey(sortKey string) string {
+	if optPadSortKeys <= 0 {
+		return sortKey
+	}
+	n, err := UnpadInt(sortKey)
+	if err != nil {
+		return sortKey
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,95 @@
+package dmrgo
+
+// Tests for zero-padded numbers
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPadInt(t *testing.T) {
+
+	var tests = []struct {
+		n     int64
+		width int
+		want  string
+	}{
+		{0, 4, "0000"},
+		{2, 4, "0002"},
+		{10, 4, "0010"},
+		{12345, 4, "12345"},
+		{7, 0, "7"},
+		{-1, 4, "-9998"},
+		{-10, 4, "-9989"},
+		{math.MaxInt64, 4, "9223372036854775807"},
+		{math.MinInt64, 4, "-0776627963145224191"},
+	}
+
+	for _, tt := range tests {
+		got := PadInt(tt.n, tt.width)
+		if got != tt.want {
+			t.Errorf("PadInt(%d, %d)=%q, want %q", tt.n, tt.width, got, tt.want)
+		}
+		if n, err := UnpadInt(got); err != nil || n != tt.n {
+			t.Errorf("UnpadInt(%q)=(%d, %v), want %d", got, n, err, tt.n)
+		}
+	}
+}
+
+func TestPadIntSorts(t *testing.T) {
+
+	var tests = []struct {
+		less, more int64
+	}{
+		{2, 10},
+		{9, 1000},
+		{0, 1},
+		{-1, 0},
+		{-10, -2},
+		{-1000, -999},
+	}
+
+	for _, tt := range tests {
+		if l, m := PadInt(tt.less, 4), PadInt(tt.more, 4); l >= m {
+			t.Errorf("PadInt(%d, 4)=%q doesn't sort before PadInt(%d, 4)=%q", tt.less, l, tt.more, m)
+		}
+	}
+}
+
+func TestUnpadIntErrors(t *testing.T) {
+
+	var tests = []string{"", "-", "12a", "x", "--1", "18446744073709551616"}
+
+	for _, s := range tests {
+		if n, err := UnpadInt(s); err == nil {
+			t.Errorf("UnpadInt(%q)=%d, want an error", s, n)
+		}
+	}
+}
+
+func TestPadSortKeys(t *testing.T) {
+
+	input := "a 10\na 2\na x\na -3\na 1\n"
+
+	var tests = []struct {
+		pad  int
+		want string
+	}{
+		{0, "a\t-3 1 10 2 x"},
+		{4, "a\t-3 1 2 10 x"},
+		{1, "a\t-3 1 10 2 x"},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optPadSortKeys, tt.pad)
+		setOpt(t, &optSecondaryKey, true)
+
+		got := strings.Join(runTestJob(t, new(sortKeyJob), input), "\n")
+		if got != tt.want {
+			t.Errorf("--pad-sort-keys=%d: got %q, want %q", tt.pad, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package dmrgo
+
+// Writing output as Parquet row groups
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParquetWriter writes rows to a Parquet file.  Wrap your Parquet library's
+// writer to use it with NewParquetEmitter; dmrgo doesn't depend on one.
+type ParquetWriter interface {
+	// WriteRowGroup writes rows as a single row group.  Each row has a
+	// value for each column of the schema, typed as the column's
+	// ColumnType: string, int64, uint64, float64 or bool.
+	WriteRowGroup(rows [][]interface{}) error
+
+	Close() error
+}
+
+// ParquetColumn is a column of a Parquet schema
+type ParquetColumn struct {
+	Name string
+	Type ColumnType
+}
+
+// DefaultParquetRowGroupSize is the number of rows in a row group if NewParquetEmitter isn't given a size
+const DefaultParquetRowGroupSize = 64 * 1024
+
+// parquetEmitter buffers records into row groups for a ParquetWriter
+type parquetEmitter struct {
+	w       ParquetWriter
+	columns []ParquetColumn
+	size    int
+	rows    [][]interface{}
+	err     error
+}
+
+// NewParquetEmitter returns an Emitter which writes records to w in row
+// groups of rowGroupSize rows (<= 0 means DefaultParquetRowGroupSize).  The
+// first column of the schema is the reduce key, and the rest are the value's
+// tab-separated fields, as TSVProtocol writes them.  Records which don't
+// match the schema are skipped (or abort the job in --strict mode).  Writing
+// stops at the first error from w, which is returned by EmitterError.  Close
+// writes the final row group and closes w.
+func NewParquetEmitter(w ParquetWriter, columns []ParquetColumn, rowGroupSize int) Emitter {
+	if rowGroupSize <= 0 {
+		rowGroupSize = DefaultParquetRowGroupSize
+	}
+	return &parquetEmitter{w: w, columns: columns, size: rowGroupSize}
+}
+
+func (e *parquetEmitter) Emit(reduceKey string, sortKey string, value string) {
+
+	if e.err != nil {
+		return
+	}
+
+	row, err := e.parseRow(append([]string{reduceKey}, strings.Split(value, "\t")...))
+	if err != nil {
+		badRecord(err)
+		return
+	}
+
+	e.rows = append(e.rows, row)
+	if len(e.rows) >= e.size {
+		e.Flush()
+	}
+}
+
+// parseRow converts a record's fields to the types of the schema's columns
+func (e *parquetEmitter) parseRow(fields []string) ([]interface{}, error) {
+
+	if len(fields) != len(e.columns) {
+		return nil, fmt.Errorf("parquet: record has %d columns, schema has %d", len(fields), len(e.columns))
+	}
+
+	row := make([]interface{}, len(fields))
+
+	for i, f := range fields {
+		var v interface{}
+		var err error
+		switch e.columns[i].Type {
+		case StringColumn:
+			v = f
+		case IntColumn:
+			v, err = strconv.ParseInt(f, 10, 64)
+		case UintColumn:
+			v, err = strconv.ParseUint(f, 10, 64)
+		case FloatColumn:
+			v, err = strconv.ParseFloat(f, 64)
+		case BoolColumn:
+			v, err = strconv.ParseBool(f)
+		default:
+			err = fmt.Errorf("unknown column type %v", e.columns[i].Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parquet: column %s: %v", e.columns[i].Name, err)
+		}
+		row[i] = v
+	}
+
+	return row, nil
+}
+
+func (e *parquetEmitter) Combine(reduceKey string, value string) {
+	e.Emit(reduceKey, "", value)
+}
+
+func (e *parquetEmitter) EmitAll(kvs []*KeyValue) {
+	emitAll(e, kvs)
+}
+
+// Flush writes the buffered rows as a row group
+func (e *parquetEmitter) Flush() {
+	if e.err != nil || len(e.rows) == 0 {
+		return
+	}
+	e.err = e.w.WriteRowGroup(e.rows)
+	e.rows = nil
+}
+
+// Close writes the final row group and closes the writer
+func (e *parquetEmitter) Close() {
+	e.Flush()
+	if err := e.w.Close(); err != nil && e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *parquetEmitter) Err() error {
+	return e.err
+}
@@ -0,0 +1,99 @@
+package dmrgo
+
+// Tests for writing output as Parquet row groups
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// stubParquetFile is a ParquetWriter which keeps the row groups in memory, and a reader for them
+type stubParquetFile struct {
+	groups [][][]interface{}
+	closed bool
+	err    error // returned by the second WriteRowGroup
+}
+
+func (f *stubParquetFile) WriteRowGroup(rows [][]interface{}) error {
+	if f.closed {
+		return errors.New("write after close")
+	}
+	if f.err != nil && len(f.groups) == 1 {
+		return f.err
+	}
+	f.groups = append(f.groups, rows)
+	return nil
+}
+
+func (f *stubParquetFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+// ReadRows reads back the rows of all the row groups
+func (f *stubParquetFile) ReadRows() [][]interface{} {
+	var rows [][]interface{}
+	for _, g := range f.groups {
+		rows = append(rows, g...)
+	}
+	return rows
+}
+
+func TestParquetEmitter(t *testing.T) {
+
+	columns := []ParquetColumn{{"item", StringColumn}, {"qty", IntColumn}, {"price", FloatColumn}, {"sold", BoolColumn}}
+
+	var tests = []struct {
+		name      string
+		records   []KeyValue
+		size      int
+		writeErr  error
+		groups    []int
+		rows      [][]interface{}
+		malformed int64
+	}{
+		{"no records", nil, 2, nil, nil, nil, 0},
+		{"one group", []KeyValue{{"tea", "", "2\t1.5\ttrue"}, {"jam", "", "1\t3\tfalse"}}, 0, nil,
+			[]int{2}, [][]interface{}{{"tea", int64(2), 1.5, true}, {"jam", int64(1), 3.0, false}}, 0},
+		{"row groups", []KeyValue{{"a", "", "1\t1\ttrue"}, {"b", "", "2\t2\ttrue"}, {"c", "", "3\t3\ttrue"}}, 2, nil,
+			[]int{2, 1}, [][]interface{}{{"a", int64(1), 1.0, true}, {"b", int64(2), 2.0, true}, {"c", int64(3), 3.0, true}}, 0},
+		{"mismatched records skipped", []KeyValue{{"a", "", "1\t1"}, {"b", "", "x\t2\ttrue"}, {"c", "", "3\t3\ttrue"}}, 0, nil,
+			[]int{1}, [][]interface{}{{"c", int64(3), 3.0, true}}, 2},
+		{"write error", []KeyValue{{"a", "", "1\t1\ttrue"}, {"b", "", "2\t2\ttrue"}, {"c", "", "3\t3\ttrue"}}, 1, errors.New("disk full"),
+			[]int{1}, [][]interface{}{{"a", int64(1), 1.0, true}}, 0},
+	}
+
+	for _, tt := range tests {
+		before := MalformedRecords()
+
+		f := &stubParquetFile{err: tt.writeErr}
+		e := NewParquetEmitter(f, columns, tt.size)
+		for _, kv := range tt.records {
+			e.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+		}
+		e.Close()
+
+		if !f.closed {
+			t.Errorf("%s: writer not closed", tt.name)
+		}
+		var groups []int
+		for _, g := range f.groups {
+			groups = append(groups, len(g))
+		}
+		if !reflect.DeepEqual(groups, tt.groups) {
+			t.Errorf("%s: row groups of %v rows, want %v", tt.name, groups, tt.groups)
+		}
+		if rows := f.ReadRows(); !reflect.DeepEqual(rows, tt.rows) {
+			t.Errorf("%s: read back %v, want %v", tt.name, rows, tt.rows)
+		}
+		if err := EmitterError(e); err != tt.writeErr {
+			t.Errorf("%s: EmitterError()=%v, want %v", tt.name, err, tt.writeErr)
+		}
+		if n := MalformedRecords() - before; n != tt.malformed {
+			t.Errorf("%s: MalformedRecords went up by %d, want %d", tt.name, n, tt.malformed)
+		}
+	}
+}
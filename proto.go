@@ -5,9 +5,13 @@ package dmrgo
 // License: GPLv3 or, at your option, any later version
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -16,24 +20,104 @@ import (
 // Map Reduce jobs can define their own protocols.
 type StreamProtocol interface {
 
-	// UnmarshalKV turns strings into their associated values.
+	// UnmarshalKVs turns strings into their associated values.
 	// k should be a pointer to the destination value for the unmarshalled "key"
-	// vs should be a pointer to an array for the unmarshalled "values"
-	UnmarshalKVs(key string, values []string, k interface{}, vs interface{})
+	// vs should be a pointer to an array for the unmarshalled "values".
+	// Values which can't be decoded are left as zero values and reported in
+	// the returned RecordErrors, and counted in MalformedRecords.
+	UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) error
 
-	// MarshalKV turns a key/value pair into a KeyValue
+	// Marshal turns a key/value pair into a KeyValue
 	Marshal(reduceKey interface{}, sortKey interface{}, value interface{}) *KeyValue
 }
 
+// ValueUnmarshaler is implemented by protocols which can decode a single
+// value on its own.  v must be a pointer to the destination value.  Errors
+// are reported as by UnmarshalKVs, with the value's Index 0.
+type ValueUnmarshaler interface {
+	UnmarshalValue(value string, v interface{}) error
+}
+
+// RecordError is a key or value which UnmarshalKVs couldn't decode
+type RecordError struct {
+	Index int // of the value, or -1 for the key
+	Err   error
+}
+
+// RecordErrors is returned by UnmarshalKVs when some of the key and values couldn't be decoded
+type RecordErrors []RecordError
+
+func (e RecordErrors) Error() string {
+	var msgs []string
+	for _, re := range e {
+		if re.Index < 0 {
+			msgs = append(msgs, "key: "+re.Err.Error())
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("value %d: %v", re.Index, re.Err))
+	}
+	return "malformed records: " + strings.Join(msgs, "; ")
+}
+
+// add records a decoding error, which fails the run in --strict mode
+func (e *RecordErrors) add(index int, err error) {
+	badRecord(err)
+	*e = append(*e, RecordError{index, err})
+}
+
+// err returns the errors as an error, or nil if there weren't any
+func (e RecordErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// the protocols must keep up with StreamProtocol
+var _ StreamProtocol = (*JSONProtocol)(nil)
+var _ StreamProtocol = (*TSVProtocol)(nil)
+var _ StreamProtocol = (*CSVProtocol)(nil)
+var _ ValueUnmarshaler = (*JSONProtocol)(nil)
+var _ ValueUnmarshaler = (*TSVProtocol)(nil)
+var _ ValueUnmarshaler = (*CSVProtocol)(nil)
+
+// ProtoEmitter emits native Go values, marshalled through a StreamProtocol.
+// It is still an Emitter, so it can be passed on wherever one is expected.
+type ProtoEmitter struct {
+	Emitter
+	Protocol StreamProtocol
+}
+
+// NewProtoEmitter returns a ProtoEmitter which marshals with p and emits to e.
+// Wrap the emitter passed to Map or Reduce to emit values without
+// depending on how they are encoded.
+func NewProtoEmitter(e Emitter, p StreamProtocol) *ProtoEmitter {
+	return &ProtoEmitter{e, p}
+}
+
+// EmitKV marshals a key/value pair and emits it, unless the protocol rejected it
+func (e *ProtoEmitter) EmitKV(reduceKey interface{}, sortKey interface{}, value interface{}) {
+	if kv := e.Protocol.Marshal(reduceKey, sortKey, value); kv != nil {
+		e.Emitter.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+	}
+}
+
 // JSONProtocol parse input/output values as JSON strings
 type JSONProtocol struct {
-	// empty -- just a type
+	// Canonical makes Marshal produce canonical JSON, stable across Go
+	// versions: object keys (including struct fields) are sorted, numbers are
+	// written in their shortest form, and HTML characters are not escaped.
+	Canonical bool
 }
 
 // UnmarshalKVs implements the StreamProtocol interface
-func (p *JSONProtocol) UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) {
+func (p *JSONProtocol) UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) error {
 
-	json.Unmarshal([]byte(key), &k)
+	var errs RecordErrors
+
+	if err := json.Unmarshal([]byte(key), &k); err != nil {
+		errs.add(-1, err)
+	}
 
 	vsPtrValue := reflect.ValueOf(vs)
 	vsType := reflect.TypeOf(vs).Elem()
@@ -41,32 +125,126 @@ func (p *JSONProtocol) UnmarshalKVs(key string, values []string, k interface{},
 	v := reflect.MakeSlice(vsType, len(values), len(values))
 
 	for i, js := range values {
-		e := v.Index(i)
-		err := json.Unmarshal([]byte(js), e.Addr().Interface())
-		if err != nil {
-			// skip, for now
-			continue
-		}
+		p.unmarshalValue(js, v.Index(i), i, &errs)
 	}
 
 	vsPtrValue.Elem().Set(v)
+
+	return errs.err()
 }
 
-// MarshalKV implements the StreamProtocol interface
+// UnmarshalValue implements the ValueUnmarshaler interface
+func (p *JSONProtocol) UnmarshalValue(value string, v interface{}) error {
+	var errs RecordErrors
+	p.unmarshalValue(value, reflect.ValueOf(v).Elem(), 0, &errs)
+	return errs.err()
+}
+
+// unmarshalValue decodes the vi'th value into e, recording any errors in errs
+func (p *JSONProtocol) unmarshalValue(s string, e reflect.Value, vi int, errs *RecordErrors) {
+	if err := unmarshalJSON([]byte(s), e.Addr().Interface()); err != nil {
+		// skip, unless we're being strict
+		errs.add(vi, err)
+	}
+}
+
+// Marshal implements the StreamProtocol interface.  A nil sortKey is written as no sort key.
 func (p *JSONProtocol) Marshal(reduceKey interface{}, sortKey interface{}, value interface{}) *KeyValue {
-	r, _ := json.Marshal(reduceKey)
-	s, _ := json.Marshal(sortKey)
-	v, _ := json.Marshal(value)
+	marshal := json.Marshal
+	if p.Canonical {
+		marshal = canonicalJSON
+	}
+	r, _ := marshalJSON(marshal, reduceKey)
+	var s []byte
+	if sortKey != nil {
+		s, _ = marshalJSON(marshal, sortKey)
+	}
+	v, _ := marshalJSON(marshal, value)
 	return &KeyValue{string(r), string(s), string(v)}
 }
 
+// canonicalJSON marshals v, then round-trips it through a generic value so
+// structs become sorted objects and numbers can be normalized
+func canonicalJSON(v interface{}) ([]byte, error) {
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var t interface{}
+	if err := dec.Decode(&t); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(canonicalNumbers(t)); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// canonicalNumbers rewrites the numbers in a decoded JSON value in their
+// shortest form.  Numbers which can't be rewritten exactly are left as written.
+func canonicalNumbers(t interface{}) interface{} {
+	switch t := t.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return json.Number(strconv.FormatInt(i, 10))
+		}
+		// integers too big for an int64 mustn't be rounded through a float64
+		if u, err := strconv.ParseUint(string(t), 10, 64); err == nil {
+			return json.Number(strconv.FormatUint(u, 10))
+		}
+		if i, ok := new(big.Int).SetString(string(t), 10); ok {
+			return json.Number(i.String())
+		}
+		if f, err := t.Float64(); err == nil {
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+		// out of range for a float64: keep the literal rather than lose it
+		return t
+	case []interface{}:
+		for i := range t {
+			t[i] = canonicalNumbers(t[i])
+		}
+	case map[string]interface{}:
+		for k, v := range t {
+			t[k] = canonicalNumbers(v)
+		}
+	}
+	return t
+}
+
 // TSVProtocol outputs keys as tab-separated lines
 type TSVProtocol struct {
-	// empty -- just a type
+	// Schema, if set, declares the output columns.  Marshal fails the run
+	// on a value which doesn't match it, and returns nil.
+	Schema Schema
 }
 
-// MarshalKV implements the StreamProtocol interface
-func (p *TSVProtocol) MarshalKV(reduceKey interface{}, sortKey interface{}, value interface{}) *KeyValue {
+// Marshal implements the StreamProtocol interface.  A nil sortKey is written as no sort key.
+func (p *TSVProtocol) Marshal(reduceKey interface{}, sortKey interface{}, value interface{}) *KeyValue {
+	if p.Schema != nil {
+		if err := p.Schema.Check(value); err != nil {
+			fail(err)
+			return nil
+		}
+	}
+	vals := strings.Join(marshalFields(value), "\t")
+	r, s := marshalKeys(reduceKey, sortKey)
+	return &KeyValue{r, s, vals}
+}
+
+// marshalFields turns a value into a list of fields: one per struct field or
+// array or slice element, alternating keys and values for maps (sorted by
+// key so the output is stable), or just the value for primitives
+func marshalFields(value interface{}) []string {
 
 	var vs []string
 
@@ -88,57 +266,262 @@ func (p *TSVProtocol) MarshalKV(reduceKey interface{}, sortKey interface{}, valu
 			// arrays/slices must be of primitives
 			vs[i] = primitiveToString(field)
 		}
+	} else if vType.Kind() == reflect.Map {
+		// maps of primitives become alternating key and value fields, sorted by key so the output is stable
+		keys := make([]string, 0, vVal.Len())
+		vals := make(map[string]string, vVal.Len())
+		for _, k := range vVal.MapKeys() {
+			ks := primitiveToString(k)
+			keys = append(keys, ks)
+			vals[ks] = primitiveToString(vVal.MapIndex(k))
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			vs = append(vs, k, vals[k])
+		}
 	}
 
-	vals := strings.Join(vs, "\t")
+	return vs
+}
 
-	reduceKeyVal := reflect.ValueOf(reduceKey)
-	r := primitiveToString(reduceKeyVal)
+// marshalKeys turns primitive keys into strings.  A nil sortKey is no sort key.
+func marshalKeys(reduceKey interface{}, sortKey interface{}) (string, string) {
 
-	sortKeyVal := reflect.ValueOf(reduceKey)
-	s := primitiveToString(sortKeyVal)
+	r := primitiveToString(reflect.ValueOf(reduceKey))
 
-	return &KeyValue{r, s, vals}
+	var s string
+	if sortKey != nil {
+		s = primitiveToString(reflect.ValueOf(sortKey))
+	}
+
+	return r, s
 }
 
 // UnmarshalKVs implements the StreamProtocol interface
-func (p *TSVProtocol) UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) {
+func (p *TSVProtocol) UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) error {
 
-	fmt.Sscan(key, &k)
+	var errs RecordErrors
+
+	if err := scanValue(key, k); err != nil {
+		errs.add(-1, err)
+	}
 
 	vsPtrValue := reflect.ValueOf(vs)
 	vsType := reflect.TypeOf(vs).Elem()
-	vType := vsType.Elem()
 
 	v := reflect.MakeSlice(vsType, len(values), len(values))
 
 	for vi, s := range values {
-		vs := strings.Split(s, "\t")
-
-		// create our new element
-		e := v.Index(vi)
-
-		// figure out what kind we need to unpack our data into
-		if vType.Kind() == reflect.Struct {
-			for i := 0; i < vType.NumField(); i++ {
-				_, err := fmt.Sscan(vs[i], e.Field(i).Addr().Interface())
-				if err != nil {
-					continue // skip
-				}
+		p.unmarshalValue(s, v.Index(vi), vi, &errs)
+	}
+
+	vsPtrValue.Elem().Set(v)
+
+	return errs.err()
+}
+
+// UnmarshalValue implements the ValueUnmarshaler interface
+func (p *TSVProtocol) UnmarshalValue(value string, v interface{}) error {
+	var errs RecordErrors
+	p.unmarshalValue(value, reflect.ValueOf(v).Elem(), 0, &errs)
+	return errs.err()
+}
+
+// unmarshalValue decodes the vi'th value into e, recording any errors in errs
+func (p *TSVProtocol) unmarshalValue(s string, e reflect.Value, vi int, errs *RecordErrors) {
+
+	vs := strings.Split(s, "\t")
+	vType := e.Type()
+
+	// figure out what kind we need to unpack our data into
+	if vType.Kind() == reflect.Struct {
+		for i := 0; i < checkFieldCount(len(vs), vType.NumField(), vi, errs); i++ {
+			err := scanValue(vs[i], e.Field(i).Addr().Interface())
+			if err != nil {
+				errs.add(vi, err)
+				continue // skip
 			}
-		} else if vType.Kind() == reflect.Array {
-			for i := 0; i < vType.Len(); i++ {
-				_, err := fmt.Sscan(vs[i], e.Index(i).Addr().Interface())
-				if err != nil {
-					continue // skip
-				}
+		}
+	} else if vType.Kind() == reflect.Array {
+		for i := 0; i < checkFieldCount(len(vs), vType.Len(), vi, errs); i++ {
+			err := scanValue(vs[i], e.Index(i).Addr().Interface())
+			if err != nil {
+				errs.add(vi, err)
+				continue // skip
 			}
-		} else if isPrimitive(vType.Kind()) {
-			fmt.Sscan(vs[0], e.Addr().Interface())
 		}
+	} else if vType.Kind() == reflect.Map {
+		m := reflect.MakeMap(vType)
+		for i := 0; i+1 < len(vs); i += 2 {
+			mk := reflect.New(vType.Key())
+			mv := reflect.New(vType.Elem())
+			if err := scanValue(vs[i], mk.Interface()); err != nil {
+				errs.add(vi, err)
+				continue // skip
+			}
+			if err := scanValue(vs[i+1], mv.Interface()); err != nil {
+				errs.add(vi, err)
+				continue // skip
+			}
+			m.SetMapIndex(mk.Elem(), mv.Elem())
+		}
+		e.Set(m)
+	} else if isPrimitive(vType.Kind()) {
+		if err := scanValue(vs[0], e.Addr().Interface()); err != nil {
+			errs.add(vi, err)
+		}
+	}
+}
+
+// checkFieldCount reports a record with fewer fields than the value it is
+// decoded into has, and returns how many fields can be decoded
+func checkFieldCount(have int, want int, vi int, errs *RecordErrors) int {
+	if have < want {
+		errs.add(vi, fmt.Errorf("%d fields, want %d", have, want))
+		return have
+	}
+	return want
+}
+
+// CSVProtocol packs values into a single CSV record, quoted per RFC 4180, so
+// fields may contain commas, quotes, tabs and newlines.  Values are
+// marshalled into fields as TSVProtocol does.  Note that a field with a
+// newline makes a record span lines, which line-based input can't read
+// back.
+type CSVProtocol struct {
+	// Delimiter separates the fields; the default is a comma
+	Delimiter rune
+}
+
+func (p *CSVProtocol) delimiter() rune {
+	if p.Delimiter == 0 {
+		return ','
+	}
+	return p.Delimiter
+}
+
+// Marshal implements the StreamProtocol interface.  A nil sortKey is written as no sort key.
+func (p *CSVProtocol) Marshal(reduceKey interface{}, sortKey interface{}, value interface{}) *KeyValue {
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = p.delimiter()
+	w.Write(marshalFields(value))
+	w.Flush()
+
+	r, s := marshalKeys(reduceKey, sortKey)
+	return &KeyValue{r, s, strings.TrimSuffix(buf.String(), "\n")}
+}
+
+// UnmarshalKVs implements the StreamProtocol interface
+func (p *CSVProtocol) UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) error {
+
+	var errs RecordErrors
+
+	if err := scanField(key, reflect.ValueOf(k).Elem()); err != nil {
+		errs.add(-1, err)
+	}
+
+	vsPtrValue := reflect.ValueOf(vs)
+	vsType := reflect.TypeOf(vs).Elem()
+
+	v := reflect.MakeSlice(vsType, len(values), len(values))
+
+	for vi, s := range values {
+		p.unmarshalValue(s, v.Index(vi), vi, &errs)
 	}
 
 	vsPtrValue.Elem().Set(v)
+
+	return errs.err()
+}
+
+// UnmarshalValue implements the ValueUnmarshaler interface
+func (p *CSVProtocol) UnmarshalValue(value string, v interface{}) error {
+	var errs RecordErrors
+	p.unmarshalValue(value, reflect.ValueOf(v).Elem(), 0, &errs)
+	return errs.err()
+}
+
+// unmarshalValue decodes the vi'th value into e, recording any errors in errs
+func (p *CSVProtocol) unmarshalValue(s string, e reflect.Value, vi int, errs *RecordErrors) {
+
+	r := csv.NewReader(strings.NewReader(s))
+	r.Comma = p.delimiter()
+	r.FieldsPerRecord = -1
+	fields, err := r.Read()
+	if err != nil {
+		errs.add(vi, err)
+		return // skip
+	}
+
+	vType := e.Type()
+
+	// figure out what kind we need to unpack our data into
+	switch {
+	case vType.Kind() == reflect.Struct:
+		for i := 0; i < checkFieldCount(len(fields), vType.NumField(), vi, errs); i++ {
+			if err := scanField(fields[i], e.Field(i)); err != nil {
+				errs.add(vi, err)
+			}
+		}
+	case vType.Kind() == reflect.Array:
+		for i := 0; i < checkFieldCount(len(fields), vType.Len(), vi, errs); i++ {
+			if err := scanField(fields[i], e.Index(i)); err != nil {
+				errs.add(vi, err)
+			}
+		}
+	case vType.Kind() == reflect.Slice:
+		e.Set(reflect.MakeSlice(vType, len(fields), len(fields)))
+		for i := range fields {
+			if err := scanField(fields[i], e.Index(i)); err != nil {
+				errs.add(vi, err)
+			}
+		}
+	case vType.Kind() == reflect.Map:
+		m := reflect.MakeMap(vType)
+		for i := 0; i+1 < len(fields); i += 2 {
+			mk := reflect.New(vType.Key()).Elem()
+			mv := reflect.New(vType.Elem()).Elem()
+			if err := scanField(fields[i], mk); err != nil {
+				errs.add(vi, err)
+				continue // skip
+			}
+			if err := scanField(fields[i+1], mv); err != nil {
+				errs.add(vi, err)
+				continue // skip
+			}
+			m.SetMapIndex(mk, mv)
+		}
+		e.Set(m)
+	case isPrimitive(vType.Kind()) && len(fields) > 0:
+		if err := scanField(fields[0], e); err != nil {
+			errs.add(vi, err)
+		}
+	}
+}
+
+// scanField parses a field into v.  Strings are taken whole, as they may contain spaces.
+func scanField(s string, v reflect.Value) error {
+	if v.Kind() == reflect.String {
+		v.SetString(s)
+		return nil
+	}
+	return scanValue(s, v.Addr().Interface())
+}
+
+// SubSeparator separates sub-records packed into a single value by JoinValue and SplitValue.
+// The default is the ASCII unit separator.
+var SubSeparator = "\x1f"
+
+// JoinValue packs several sub-records into a single value, separated by SubSeparator
+func JoinValue(subs ...string) string {
+	return strings.Join(subs, SubSeparator)
+}
+
+// SplitValue unpacks a value created with JoinValue into its sub-records
+func SplitValue(value string) []string {
+	return strings.Split(value, SubSeparator)
 }
 
 func isPrimitive(k reflect.Kind) bool {
@@ -172,10 +555,13 @@ func primitiveToString(v reflect.Value) string {
 		return strconv.FormatUint(v.Uint(), 10)
 
 	case reflect.Float32, reflect.Float64:
+		if t, ok := nonFiniteToken(v.Float()); ok {
+			return t
+		}
 		return strconv.FormatFloat(v.Float(), 'g', 5, 64)
 	case reflect.String:
 		return v.String()
 	}
 
-	return "(unknown type " + string(v.Kind()) + ")"
+	return "(unknown type " + v.Kind().String() + ")"
 }
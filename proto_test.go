@@ -0,0 +1,397 @@
+package dmrgo
+
+// Tests for the stream protocols
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X int
+	Y int
+}
+
+func TestJSONUnmarshalKVsErrors(t *testing.T) {
+
+	before := MalformedRecords()
+
+	var k string
+	var vs []point
+	err := new(JSONProtocol).UnmarshalKVs(`"key"`, []string{`{"X":1,"Y":2}`, `{"X":`}, &k, &vs)
+
+	var rerrs RecordErrors
+	if !errors.As(err, &rerrs) || len(rerrs) != 1 || rerrs[0].Index != 1 {
+		t.Fatalf("UnmarshalKVs error=%v, want one error for value 1", err)
+	}
+	if k != "key" || len(vs) != 2 || vs[0] != (point{1, 2}) {
+		t.Errorf("UnmarshalKVs decoded k=%q vs=%v", k, vs)
+	}
+	if n := MalformedRecords() - before; n != 1 {
+		t.Errorf("MalformedRecords went up by %d, want 1", n)
+	}
+}
+
+func TestTSVUnmarshalValue(t *testing.T) {
+
+	var tests = []struct {
+		value   string
+		v       interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"1\t2", new(point), &point{1, 2}, false},
+		{"1", new(point), &point{1, 0}, true},
+		{"x\t2", new(point), &point{0, 2}, true},
+		{"1\t2\t3", new([3]int), &[3]int{1, 2, 3}, false},
+		{"1\t2", new([3]int), &[3]int{1, 2, 0}, true},
+		{"a\t1\tb\t2", new(map[string]int), &map[string]int{"a": 1, "b": 2}, false},
+		{"7", new(int), func() *int { n := 7; return &n }(), false},
+	}
+
+	for _, tt := range tests {
+		err := new(TSVProtocol).UnmarshalValue(tt.value, tt.v)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("UnmarshalValue(%q) error=%v, want error %v", tt.value, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(tt.v, tt.want) {
+			t.Errorf("UnmarshalValue(%q)=%v, want %v", tt.value, tt.v, tt.want)
+		}
+	}
+}
+
+func TestCSVUnmarshalShortRecord(t *testing.T) {
+	var p point
+	if err := new(CSVProtocol).UnmarshalValue("1", &p); err == nil || p != (point{1, 0}) {
+		t.Errorf("UnmarshalValue(\"1\")=%v, %v, want {1 0} and an error", p, err)
+	}
+}
+
+func TestJoinSplitValue(t *testing.T) {
+
+	var tests = []struct {
+		sep  string
+		subs []string
+		want string
+	}{
+		{"\x1f", []string{"a", "b c", "d\te"}, "a\x1fb c\x1fd\te"},
+		{"\x1f", []string{"", "x", ""}, "\x1fx\x1f"},
+		{"|", []string{"1", "2", "3"}, "1|2|3"},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &SubSeparator, tt.sep)
+
+		v := JoinValue(tt.subs...)
+		if v != tt.want {
+			t.Errorf("JoinValue(%q)=%q, want %q", tt.subs, v, tt.want)
+		}
+
+		// the packed value must survive being written as output and read back in
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		newOutputEmitter(w).Emit("k", "", v)
+		w.Flush()
+		kv, err := readLineKeyValue(bufio.NewReader(strings.NewReader(sb.String())))
+		if err != nil {
+			t.Fatalf("reading %q: %v", sb.String(), err)
+		}
+
+		if got := SplitValue(kv.Value); !reflect.DeepEqual(got, tt.subs) {
+			t.Errorf("SplitValue(%q)=%q, want %q", kv.Value, got, tt.subs)
+		}
+	}
+}
+
+func TestTSVMarshalMap(t *testing.T) {
+
+	var tests = []struct {
+		value interface{}
+		want  string
+	}{
+		{map[string]int{"b": 2, "a": 1, "c": 3}, "a\t1\tb\t2\tc\t3"},
+		{map[int]string{10: "x", 2: "y"}, "10\tx\t2\ty"},
+		{map[string]int{}, ""},
+	}
+
+	for _, tt := range tests {
+		// the same value is written the same way every time
+		for i := 0; i < 5; i++ {
+			var got []KeyValue
+			NewProtoEmitter(recordEmitter(&got), new(TSVProtocol)).EmitKV("k", nil, tt.value)
+			if len(got) != 1 || got[0] != (KeyValue{"k", "", tt.want}) {
+				t.Fatalf("EmitKV(%v) emitted %v, want value %q", tt.value, got, tt.want)
+			}
+		}
+	}
+
+	// and can be read back
+	m := make(map[string]int)
+	if err := new(TSVProtocol).UnmarshalValue(tests[0].want, &m); err != nil || !reflect.DeepEqual(m, tests[0].value) {
+		t.Errorf("UnmarshalValue(%q)=%v, %v, want %v", tests[0].want, m, err, tests[0].value)
+	}
+}
+
+func TestJSONCanonical(t *testing.T) {
+
+	type record struct {
+		Z string
+		A float64
+		M map[string]interface{}
+	}
+
+	var tests = []struct {
+		value interface{}
+		want  string
+	}{
+		{
+			map[string]interface{}{
+				"b": map[string]interface{}{"y": 2.0, "x": []interface{}{1.5, "<a&b>", nil}},
+				"a": 1e21,
+				"c": 0.1,
+			},
+			`{"a":1e+21,"b":{"x":[1.5,"<a&b>",null],"y":2},"c":0.1}`,
+		},
+		{
+			record{Z: "z", A: 100, M: map[string]interface{}{"k": int64(1) << 53}},
+			`{"A":100,"M":{"k":9007199254740992},"Z":"z"}`,
+		},
+		{[]float64{3.0, 2.5e-7}, `[3,2.5e-07]`},
+		{[]interface{}{uint64(18446744073709551615), new(big.Int).Lsh(big.NewInt(1), 70)}, `[18446744073709551615,1180591620717411303424]`},
+		{json.RawMessage(`[1e400,-1E+400]`), `[1e400,-1E+400]`},
+		{"plain", `"plain"`},
+	}
+
+	for _, tt := range tests {
+		kv := (&JSONProtocol{Canonical: true}).Marshal("k", nil, tt.value)
+		if kv.Value != tt.want {
+			t.Errorf("Marshal(%v)=%s, want %s", tt.value, kv.Value, tt.want)
+		}
+	}
+}
+
+func TestStreamProtocolRoundTrip(t *testing.T) {
+
+	var tests = []struct {
+		name  string
+		p     StreamProtocol
+		key   string
+		value point
+	}{
+		{"tsv, zero value", new(TSVProtocol), "origin", point{0, 0}},
+		{"tsv", new(TSVProtocol), "p", point{3, -4}},
+		{"json", new(JSONProtocol), "p", point{3, -4}},
+		{"csv", new(CSVProtocol), "p", point{3, -4}},
+	}
+
+	for _, tt := range tests {
+		kv := tt.p.Marshal(tt.key, nil, tt.value)
+		if kv == nil {
+			t.Errorf("%s: Marshal(%q, %v) rejected the record", tt.name, tt.key, tt.value)
+			continue
+		}
+
+		var k string
+		var vs []point
+		if err := tt.p.UnmarshalKVs(kv.ReduceKey, []string{kv.Value, kv.Value}, &k, &vs); err != nil {
+			t.Errorf("%s: UnmarshalKVs(%q, %q): %v", tt.name, kv.ReduceKey, kv.Value, err)
+			continue
+		}
+		if k != tt.key || !reflect.DeepEqual(vs, []point{tt.value, tt.value}) {
+			t.Errorf("%s: round trip gave %q %v, want %q %v", tt.name, k, vs, tt.key, tt.value)
+		}
+	}
+}
+
+// csvRecord has fields which need quoting in CSV
+type csvRecord struct {
+	Name  string
+	Quote string
+	N     int
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+
+	var tests = []struct {
+		name      string
+		delimiter rune
+		value     interface{}
+		want      string
+	}{
+		{"comma", 0, csvRecord{"Smith, John", "plain", 1}, `"Smith, John",plain,1`},
+		{"quote", 0, csvRecord{"x", `say "hi"`, 2}, `x,"say ""hi""",2`},
+		{"tab", 0, csvRecord{"a\tb", "", 3}, "a\tb,,3"},
+		{"newline", 0, csvRecord{"two\nlines", "x", 4}, "\"two\nlines\",x,4"},
+		{"semicolon", ';', csvRecord{"Smith, John", "a;b", 5}, `Smith, John;"a;b";5`},
+		{"slice", 0, []string{"a,b", `"`, ""}, `"a,b","""",`},
+		{"array", ';', [2]int{7, -8}, "7;-8"},
+		{"primitive", 0, "one, two", `"one, two"`},
+	}
+
+	for _, tt := range tests {
+		p := &CSVProtocol{Delimiter: tt.delimiter}
+
+		kv := p.Marshal("key", nil, tt.value)
+		if kv.Value != tt.want {
+			t.Errorf("%s: Marshal gave %q, want %q", tt.name, kv.Value, tt.want)
+		}
+
+		v := reflect.New(reflect.TypeOf(tt.value))
+		if err := p.UnmarshalValue(kv.Value, v.Interface()); err != nil {
+			t.Errorf("%s: UnmarshalValue(%q): %v", tt.name, kv.Value, err)
+			continue
+		}
+		if got := v.Elem().Interface(); !reflect.DeepEqual(got, tt.value) {
+			t.Errorf("%s: round trip gave %#v, want %#v", tt.name, got, tt.value)
+		}
+	}
+}
+
+func TestProtoEmitterJSON(t *testing.T) {
+
+	var tests = []struct {
+		reduceKey interface{}
+		sortKey   interface{}
+		value     point
+		want      string
+	}{
+		{"origin", nil, point{0, 0}, "%22origin%22\t{\"X\":0,\"Y\":0}\n"},
+		{"p", 2, point{3, -4}, "%22p%22,2\t{\"X\":3,\"Y\":-4}\n"},
+		{7, nil, point{1, 2}, "7\t{\"X\":1,\"Y\":2}\n"},
+	}
+
+	for _, tt := range tests {
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		out := newOutputEmitter(w)
+
+		NewProtoEmitter(out, new(JSONProtocol)).EmitKV(tt.reduceKey, tt.sortKey, tt.value)
+		out.Flush()
+
+		if sb.String() != tt.want {
+			t.Errorf("EmitKV(%v, %v, %v) wrote %q, want %q", tt.reduceKey, tt.sortKey, tt.value, sb.String(), tt.want)
+			continue
+		}
+
+		// the line reads back as the value
+		kv, err := readLineKeyValue(bufio.NewReader(strings.NewReader(sb.String())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var k interface{}
+		var vs []point
+		if err := new(JSONProtocol).UnmarshalKVs(kv.ReduceKey, []string{kv.Value}, &k, &vs); err != nil || len(vs) != 1 || vs[0] != tt.value {
+			t.Errorf("%q read back as %v, %v", sb.String(), vs, err)
+		}
+	}
+}
+
+// floats has fields which may be NaN or infinite
+type floats struct {
+	X Float
+	Y Float
+	N int
+}
+
+// taggedFloats embeds floats among fields which encoding/json treats specially
+type taggedFloats struct {
+	floats
+	B     []byte
+	Empty string `json:",omitempty"`
+	S     int    `json:"s,string"`
+}
+
+func TestNonFiniteRoundTrip(t *testing.T) {
+
+	nan, inf := math.NaN(), math.Inf(1)
+
+	// the protocols are also ValueUnmarshalers
+	protocols := []struct {
+		name string
+		p    interface {
+			StreamProtocol
+			ValueUnmarshaler
+		}
+	}{
+		{"tsv", new(TSVProtocol)},
+		{"json", new(JSONProtocol)},
+		{"canonical json", &JSONProtocol{Canonical: true}},
+		{"csv", new(CSVProtocol)},
+	}
+
+	var tests = []struct {
+		name   string
+		value  interface{}
+		nanTok string
+	}{
+		{"NaN", nan, "NaN"},
+		{"+Inf", inf, "NaN"},
+		{"-Inf", -inf, "NaN"},
+		{"finite", 1.5, "NaN"},
+		{"struct", floats{Float(nan), Float(inf), 3}, "NaN"},
+		{"array", [3]Float{Float(-inf), 2, Float(nan)}, "NaN"},
+		{"empty NaN token", [2]Float{Float(nan), Float(inf)}, ""},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &NaNToken, tt.nanTok)
+
+		for _, pp := range protocols {
+			kv := pp.p.Marshal("k", nil, tt.value)
+			if kv.Value == "" && tt.nanTok != "" {
+				t.Errorf("%s, %s: Marshal(%v) wrote no value", tt.name, pp.name, tt.value)
+				continue
+			}
+
+			v := reflect.New(reflect.TypeOf(tt.value))
+			if err := pp.p.UnmarshalValue(kv.Value, v.Interface()); err != nil {
+				t.Errorf("%s, %s: UnmarshalValue(%q): %v", tt.name, pp.name, kv.Value, err)
+				continue
+			}
+			// NaN != NaN, so compare the printed values
+			if got, want := fmt.Sprint(v.Elem().Interface()), fmt.Sprint(tt.value); got != want {
+				t.Errorf("%s, %s: round trip through %q gave %s, want %s", tt.name, pp.name, kv.Value, got, want)
+			}
+		}
+	}
+}
+
+func TestJSONFloatFields(t *testing.T) {
+
+	value := taggedFloats{floats{Float(math.NaN()), Float(math.Inf(-1)), 3}, []byte("hi"), "", 7}
+
+	var tests = []struct {
+		name string
+		p    *JSONProtocol
+		want string
+	}{
+		{"json", new(JSONProtocol), `{"X":"NaN","Y":"-Inf","N":3,"B":"aGk=","s":"7"}`},
+		{"canonical json", &JSONProtocol{Canonical: true}, `{"B":"aGk=","N":3,"X":"NaN","Y":"-Inf","s":"7"}`},
+	}
+
+	for _, tt := range tests {
+		kv := tt.p.Marshal("k", nil, value)
+		if kv.Value != tt.want {
+			t.Errorf("%s: Marshal wrote %s, want %s", tt.name, kv.Value, tt.want)
+		}
+
+		var got taggedFloats
+		if err := tt.p.UnmarshalValue(kv.Value, &got); err != nil {
+			t.Errorf("%s: UnmarshalValue(%s): %v", tt.name, kv.Value, err)
+			continue
+		}
+		// NaN != NaN, so compare the printed values
+		if g, w := fmt.Sprint(got), fmt.Sprint(value); g != w {
+			t.Errorf("%s: round trip through %s gave %s, want %s", tt.name, kv.Value, g, w)
+		}
+	}
+}
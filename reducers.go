@@ -0,0 +1,172 @@
+package dmrgo
+
+// Reusable reduce functions
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// ReduceFunc has the signature of MapReduceJob.Reduce.  A job's Reduce can
+// delegate to one of the helpers here by calling it with its own arguments.
+type ReduceFunc func(reduceKey string, sortKey string, values <-chan string, emitter Emitter)
+
+// Reservoir returns a reduce function which emits a uniform random sample of
+// (at most) k values for each key, using reservoir sampling so the number of
+// values for a key need not be known in advance.  Pass a seeded rng for
+// reproducible samples; if rng is nil one seeded from the clock is used.
+// Reservoir only uses rng to pick a seed: each key is sampled with a
+// generator of its own, seeded from that and the key, so the reducers for
+// different partitions can run in parallel and the samples don't depend on
+// the order keys are reduced in.
+func Reservoir(k int, rng *rand.Rand) ReduceFunc {
+
+	if k < 0 {
+		k = 0
+	}
+
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	seed := rng.Uint64()
+
+	return func(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+
+		rng := rand.New(&splitMix64{seed ^ hash64(reduceKey)})
+
+		sample := make([]string, 0, k)
+
+		n := 0
+		for v := range values {
+			n++
+			if len(sample) < k {
+				sample = append(sample, v)
+				continue
+			}
+
+			if j := rng.Intn(n); j < k {
+				sample[j] = v
+			}
+		}
+
+		for _, v := range sample {
+			emitter.Emit(reduceKey, sortKey, v)
+		}
+	}
+}
+
+// splitMix64 is a rand.Source which is cheap to seed, so a sampling reducer can have one per key
+type splitMix64 struct {
+	x uint64
+}
+
+func (s *splitMix64) Seed(seed int64) {
+	s.x = uint64(seed)
+}
+
+func (s *splitMix64) Uint64() uint64 {
+	s.x += 0x9e3779b97f4a7c15
+	z := s.x
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
+
+func (s *splitMix64) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// HLLCount returns a reduce function which emits an estimate of the number of
+// distinct values for each key, using a HyperLogLog sketch instead of keeping
+// the values in memory.  The sketch uses 2^precision registers (precision is
+// clamped to [4,16]); the standard error is about 1.04/sqrt(2^precision).
+func HLLCount(precision uint8) ReduceFunc {
+	return func(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+
+		h := newHyperLogLog(precision)
+
+		for v := range values {
+			h.add(v)
+		}
+
+		emitter.Emit(reduceKey, sortKey, strconv.FormatUint(h.estimate(), 10))
+	}
+}
+
+// MinMax returns a reduce function which emits the smallest and largest
+// value for each key, in one pass, as a single "min\tmax" value.  With
+// numeric, values are compared as numbers and those which aren't are skipped
+// (or abort the job in --strict mode); otherwise they are compared as
+// strings.  The values are emitted as they were read.
+func MinMax(numeric bool) ReduceFunc {
+	return func(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+
+		var min, max string
+		var minf, maxf float64
+		seen := false
+
+		for v := range values {
+
+			if !numeric {
+				if !seen || v < min {
+					min = v
+				}
+				if !seen || v > max {
+					max = v
+				}
+				seen = true
+				continue
+			}
+
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				badRecord(err)
+				continue
+			}
+			if !seen || f < minf {
+				min, minf = v, f
+			}
+			if !seen || f > maxf {
+				max, maxf = v, f
+			}
+			seen = true
+		}
+
+		if seen {
+			emitter.Emit(reduceKey, sortKey, min+"\t"+max)
+		}
+	}
+}
+
+// ValueIterator wraps a Reduce values channel to allow one value of lookahead
+type ValueIterator struct {
+	values <-chan string
+
+	next   string
+	peeked bool
+	ok     bool
+}
+
+// NewValueIterator returns an iterator over the values channel passed to Reduce
+func NewValueIterator(values <-chan string) *ValueIterator {
+	return &ValueIterator{values: values}
+}
+
+// Peek returns the next value without consuming it.  ok is false if there are no more values.
+func (it *ValueIterator) Peek() (value string, ok bool) {
+	if !it.peeked {
+		it.next, it.ok = <-it.values
+		it.peeked = true
+	}
+	return it.next, it.ok
+}
+
+// Next consumes and returns the next value.  ok is false if there are no more values.
+func (it *ValueIterator) Next() (value string, ok bool) {
+	value, ok = it.Peek()
+	it.peeked = false
+	return value, ok
+}
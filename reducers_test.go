@@ -0,0 +1,183 @@
+package dmrgo
+
+// Tests for the reusable reduce functions
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// reduceValues runs a reduce function over the values for each key in turn and returns what it emitted
+func reduceValues(reduce ReduceFunc, keys []string, values map[string][]string) []KeyValue {
+	var got []KeyValue
+	emitter := recordEmitter(&got)
+	for _, k := range keys {
+		ch := make(chan string)
+		go func() {
+			for _, v := range values[k] {
+				ch <- v
+			}
+			close(ch)
+		}()
+		reduce(k, "", ch, emitter)
+	}
+	return got
+}
+
+// numbers returns the strings of 0..n-1
+func numbers(n int) []string {
+	vs := make([]string, n)
+	for i := range vs {
+		vs[i] = strconv.Itoa(i)
+	}
+	return vs
+}
+
+func TestReservoir(t *testing.T) {
+
+	values := map[string][]string{"a": numbers(1000), "b": numbers(3), "c": nil}
+
+	var tests = []struct {
+		k    int
+		want map[string]int
+	}{
+		{10, map[string]int{"a": 10, "b": 3, "c": 0}},
+		{0, map[string]int{}},
+		{-1, map[string]int{}},
+	}
+
+	for _, tt := range tests {
+		got := reduceValues(Reservoir(tt.k, rand.New(rand.NewSource(1))), []string{"a", "b", "c"}, values)
+
+		counts := make(map[string]int)
+		for _, kv := range got {
+			counts[kv.ReduceKey]++
+		}
+		for k, n := range tt.want {
+			if counts[k] != n {
+				t.Errorf("k=%d: %d values for %q, want %d", tt.k, counts[k], k, n)
+			}
+		}
+
+		// the same seed gives the same sample, whatever order the keys are reduced in
+		again := reduceValues(Reservoir(tt.k, rand.New(rand.NewSource(1))), []string{"c", "b", "a"}, values)
+		if !reflect.DeepEqual(byKey(again), byKey(got)) {
+			t.Errorf("k=%d: samples differ between runs with the same seed: %v and %v", tt.k, got, again)
+		}
+	}
+
+	// a different seed gives a different sample
+	s1 := reduceValues(Reservoir(10, rand.New(rand.NewSource(1))), []string{"a"}, values)
+	s2 := reduceValues(Reservoir(10, rand.New(rand.NewSource(2))), []string{"a"}, values)
+	if reflect.DeepEqual(s1, s2) {
+		t.Errorf("seeds 1 and 2 sampled the same values: %v", s1)
+	}
+}
+
+func TestReservoirUniform(t *testing.T) {
+
+	// each of 10 values should be sampled about k/10 of the time
+	const runs = 2000
+	values := map[string][]string{"a": numbers(10)}
+	rng := rand.New(rand.NewSource(1))
+
+	counts := make(map[string]int)
+	for i := 0; i < runs; i++ {
+		for _, kv := range reduceValues(Reservoir(3, rng), []string{"a"}, values) {
+			counts[kv.Value]++
+		}
+	}
+
+	for _, v := range values["a"] {
+		if n := counts[v]; n < runs*3/10*8/10 || n > runs*3/10*12/10 {
+			t.Errorf("value %s sampled %d times in %d runs, want about %d", v, n, runs, runs*3/10)
+		}
+	}
+}
+
+// byKey groups the values emitted for each key
+func byKey(kvs []KeyValue) map[string][]string {
+	m := make(map[string][]string)
+	for _, kv := range kvs {
+		m[kv.ReduceKey] = append(m[kv.ReduceKey], kv.Value)
+	}
+	return m
+}
+
+func TestValueIterator(t *testing.T) {
+
+	// each op is 'p' for Peek or 'n' for Next; want is what each returns, "" once the values run out
+	var tests = []struct {
+		values []string
+		ops    string
+		want   []string
+	}{
+		{[]string{"a", "b", "c"}, "nnn", []string{"a", "b", "c"}},
+		{[]string{"a", "b", "c"}, "ppnpnn", []string{"a", "a", "a", "b", "b", "c"}},
+		{[]string{"a", "b"}, "nnpn", []string{"a", "b", "", ""}},
+		{nil, "pn", []string{"", ""}},
+		{[]string{""}, "pnp", []string{"", "", ""}},
+	}
+
+	for _, tt := range tests {
+		ch := make(chan string, len(tt.values))
+		for _, v := range tt.values {
+			ch <- v
+		}
+		close(ch)
+
+		it := NewValueIterator(ch)
+		consumed := 0
+		for i, op := range tt.ops {
+			var v string
+			var ok bool
+			if op == 'p' {
+				v, ok = it.Peek()
+			} else {
+				v, ok = it.Next()
+			}
+			if v != tt.want[i] || ok != (consumed < len(tt.values)) {
+				t.Errorf("%q %s: op %d (%c)=%q, %v, want %q, %v", tt.values, tt.ops, i, op, v, ok, tt.want[i], consumed < len(tt.values))
+			}
+			if op == 'n' {
+				consumed++
+			}
+		}
+	}
+}
+
+func TestMinMax(t *testing.T) {
+
+	var tests = []struct {
+		name      string
+		numeric   bool
+		values    []string
+		want      []KeyValue
+		malformed int64
+	}{
+		{"strings", false, []string{"pear", "apple", "zoo", "banana"}, []KeyValue{{"k", "", "apple\tzoo"}}, 0},
+		{"strings compare bytewise", false, []string{"10", "9", "100"}, []KeyValue{{"k", "", "10\t9"}}, 0},
+		{"one value", false, []string{"x"}, []KeyValue{{"k", "", "x\tx"}}, 0},
+		{"no values", false, nil, nil, 0},
+		{"numbers", true, []string{"10", "9", "100"}, []KeyValue{{"k", "", "9\t100"}}, 0},
+		{"floats, as written", true, []string{"1.50", "-2e3", "0.25"}, []KeyValue{{"k", "", "-2e3\t1.50"}}, 0},
+		{"non-numbers skipped", true, []string{"x", "3", "", "1"}, []KeyValue{{"k", "", "1\t3"}}, 2},
+		{"only non-numbers", true, []string{"x"}, nil, 1},
+	}
+
+	for _, tt := range tests {
+		before := MalformedRecords()
+
+		got := reduceValues(MinMax(tt.numeric), []string{"k"}, map[string][]string{"k": tt.values})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if n := MalformedRecords() - before; n != tt.malformed {
+			t.Errorf("%s: MalformedRecords went up by %d, want %d", tt.name, n, tt.malformed)
+		}
+	}
+}
@@ -5,23 +5,296 @@ package dmrgo
 // License: GPLv3 or, at your option, any later versiono
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Reporter sends counters and status to the Hadoop framework by writing
+// reporter: lines to stderr.  Counter increments are summed and written at
+// most every ReportInterval, so a counter bumped for every record doesn't
+// flood stderr.  In --mapreduce mode counters are summed in memory instead and
+// printed at the end of the run.
+type Reporter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	pending   map[counterKey]int64
+	lastFlush time.Time
+}
+
+// ReportInterval is how often a Reporter writes out buffered counter increments
+var ReportInterval = 5 * time.Second
+
+func newReporter(w io.Writer) *Reporter {
+	return &Reporter{w: w, pending: make(map[counterKey]int64)}
+}
+
+// the process's reporter, used by the package-level functions
+var stdReporter = newReporter(os.Stderr)
+
+// ReporterOf returns the Reporter for an emitter passed to Map, MapFinal or
+// Reduce.  Emitters the runner didn't create share the process's Reporter.
+func ReporterOf(e Emitter) *Reporter {
+	if re, ok := e.(*reportingEmitter); ok {
+		return re.reporter
+	}
+	return stdReporter
+}
+
+// IncrCounter adds 'amount' to the given group/counter
+func (r *Reporter) IncrCounter(group, name string, amount int64) {
+
+	if Metrics != nil {
+		Metrics.Count(group, name, amount)
+	}
+
+	k := counterKey{group, name}
+
+	countersMu.Lock()
+	if localCounters {
+		counters[k] += amount
+		countersMu.Unlock()
+		return
+	}
+	countersMu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[k] += amount
+	if time.Since(r.lastFlush) >= ReportInterval {
+		r.flushLocked()
+	}
+}
+
+// SetStatus updates the Hadoop job status.  It is written immediately.
+func (r *Reporter) SetStatus(msg string) {
+	if Metrics != nil {
+		Metrics.Status(msg)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(r.w, "reporter:status:%s\n", msg)
+}
+
+// heartbeat writes a status line every interval until the returned stop
+// function is called, so Hadoop doesn't kill a task which is busy on a hot
+// key for longer than its timeout.  Status lines are written under the
+// Reporter's lock, so they never interleave with counter lines.  An interval
+// of 0 disables it.
+func (r *Reporter) heartbeat(interval time.Duration, phase string) (stop func()) {
+
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	start := time.Now()
+
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				r.SetStatus(fmt.Sprintf("dmrgo: %s running for %v", phase, time.Since(start).Round(time.Second)))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Flush writes out any buffered counter increments
+func (r *Reporter) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushLocked()
+}
+
+func (r *Reporter) flushLocked() {
+	keys := make([]counterKey, 0, len(r.pending))
+	for k := range r.pending {
+		keys = append(keys, k)
+	}
+	sortCounterKeys(keys)
+	for _, k := range keys {
+		fmt.Fprintf(r.w, "reporter:counter:%s,%s,%d\n", k.group, k.counter, r.pending[k])
+		delete(r.pending, k)
+	}
+	r.lastFlush = time.Now()
+}
+
+// reportingEmitter gives Map and Reduce access to a Reporter through their emitter
+type reportingEmitter struct {
+	Emitter
+	reporter *Reporter
+}
+
+func (e *reportingEmitter) emitKey(reduceKey string) {
+	emitKeyOnly(e.Emitter, reduceKey)
+}
+
 // Statusln updates the Hadoop job status.  The arguments are passed to fmt.Sprintln
 func Statusln(a ...interface{}) {
 	s := fmt.Sprintln(a...)
-	fmt.Fprintf(os.Stderr, "reporter:status:%s", s) // \n is in s
+	stdReporter.SetStatus(strings.TrimSuffix(s, "\n"))
 }
 
 // Statusf updates the Hadoop job status.  The arguments are passed to fmt.Sprintf
 func Statusf(format string, a ...interface{}) {
-	s := fmt.Sprintf(format, a...) // we should check if s contains \n
-	fmt.Fprintf(os.Stderr, "reporter:status:%s\n", s)
+	stdReporter.SetStatus(fmt.Sprintf(format, a...)) // we should check if s contains \n
 }
 
-// IncrCounter updates the given group/counter by 'amount'
+// IncrCounter updates the given group/counter by 'amount' through the
+// process's Reporter.  In --mapreduce mode the counters are summed in memory
+// and printed at the end of the run; this includes increments from Map,
+// Reduce and Combine.
 func IncrCounter(group, counter string, amount int) {
-	fmt.Fprintf(os.Stderr, "reporter:counter:%s,%s,%d\n", group, counter, amount)
+	stdReporter.IncrCounter(group, counter, int64(amount))
+}
+
+// Counter returns the total of the given group/counter in --mapreduce mode
+func Counter(group, counter string) int64 {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	return counters[counterKey{group, counter}]
+}
+
+type counterKey struct {
+	group, counter string
+}
+
+// set when running locally, where there's no framework to sum counters for us
+var localCounters bool
+
+var countersMu sync.Mutex
+var counters = make(map[counterKey]int64)
+var floatCounters = make(map[counterKey]float64)
+
+// IncrFloatCounter adds 'amount' to the given float group/counter.  Hadoop
+// counters are integers, so float counters are only aggregated locally: they
+// are printed at the end of a --mapreduce run and can be read back with
+// FloatCounter.  Under Hadoop streaming they are not reported to the framework.
+func IncrFloatCounter(group, counter string, amount float64) {
+	countersMu.Lock()
+	floatCounters[counterKey{group, counter}] += amount
+	countersMu.Unlock()
+}
+
+// FloatCounter returns the current value of the given float group/counter
+func FloatCounter(group, counter string) float64 {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	return floatCounters[counterKey{group, counter}]
+}
+
+// printCounters writes the locally summed counters, sorted by group and name
+func printCounters(w io.Writer) {
+
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	values := make(map[counterKey]string)
+	for k, v := range counters {
+		values[k] = strconv.FormatInt(v, 10)
+	}
+	for k, v := range floatCounters {
+		values[k] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+
+	keys := make([]counterKey, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sortCounterKeys(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "counter %s,%s: %s\n", k.group, k.counter, values[k])
+	}
+}
+
+// relayStderr returns a pipe to use as a child process's stderr.  Counter
+// and status lines the child writes are passed to the process's Reporter, so
+// in --mapreduce mode they are summed into the run's counters; anything else
+// is copied to our stderr.  The caller closes the pipe once the child has
+// started, and the returned channel is closed when the child's stderr has
+// all been read.
+func relayStderr() (*os.File, <-chan struct{}, error) {
+
+	done := make(chan struct{})
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go func() {
+		defer close(done)
+		defer pr.Close()
+		relayReporterLines(pr, os.Stderr)
+	}()
+
+	return pw, done, nil
+}
+
+// relayReporterLines reads lines from r, handling reporter: lines and copying the rest to w
+func relayReporterLines(r io.Reader, w io.Writer) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !reportLine(stdReporter, line) {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// reportLine passes a Hadoop streaming reporter: line to r.  It returns false if the line isn't one.
+func reportLine(r *Reporter, line string) bool {
+
+	if msg := strings.TrimPrefix(line, "reporter:status:"); msg != line {
+		r.SetStatus(msg)
+		return true
+	}
+
+	c := strings.TrimPrefix(line, "reporter:counter:")
+	if c == line {
+		return false
+	}
+
+	// group,counter,amount -- the counter name may itself contain commas
+	i := strings.IndexByte(c, ',')
+	j := strings.LastIndexByte(c, ',')
+	if i < 0 || j <= i {
+		return false
+	}
+	amount, err := strconv.ParseInt(c[j+1:], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	r.IncrCounter(c[:i], c[i+1:j], amount)
+	return true
+}
+
+// sortCounterKeys sorts counters by group and name
+func sortCounterKeys(keys []counterKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].group != keys[j].group {
+			return keys[i].group < keys[j].group
+		}
+		return keys[i].counter < keys[j].counter
+	})
 }
@@ -0,0 +1,333 @@
+package dmrgo
+
+// Tests for the counters
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIncrFloatCounter(t *testing.T) {
+
+	var tests = []struct {
+		counter    string
+		increments []float64
+		want       float64
+	}{
+		{"latency", []float64{0.25, 0.5, 1.125}, 1.875},
+		{"negative", []float64{1.5, -2}, -0.5},
+		{"tiny", []float64{1e-9, 2e-9}, 3e-9},
+		{"untouched", nil, 0},
+	}
+
+	for _, tt := range tests {
+		before := FloatCounter("TestIncrFloatCounter", tt.counter)
+
+		// increments from concurrent mappers and reducers are summed
+		var wg sync.WaitGroup
+		for _, amount := range tt.increments {
+			wg.Add(1)
+			go func(amount float64) {
+				defer wg.Done()
+				IncrFloatCounter("TestIncrFloatCounter", tt.counter, amount)
+			}(amount)
+		}
+		wg.Wait()
+
+		if got := FloatCounter("TestIncrFloatCounter", tt.counter); math.Abs(got-before-tt.want) > 1e-12 {
+			t.Errorf("FloatCounter(%q) went up by %v, want %v", tt.counter, got-before, tt.want)
+		}
+	}
+
+	// float counters are printed with the integer ones
+	var buf bytes.Buffer
+	printCounters(&buf)
+	if want := "counter TestIncrFloatCounter,latency: "; !strings.Contains(buf.String(), want) {
+		t.Errorf("printCounters wrote %q, want it to contain %q", buf.String(), want)
+	}
+}
+
+// countingCombineJob is a combiningSumJob whose Combine counts its calls and the values it combines
+type countingCombineJob struct {
+	combiningSumJob
+}
+
+func (j *countingCombineJob) Combine(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	IncrCounter("TestCombinerCounters", "calls", 1)
+	counted := make(chan string)
+	go func() {
+		for v := range values {
+			IncrCounter("TestCombinerCounters", "values", 1)
+			counted <- v
+		}
+		close(counted)
+	}()
+	j.combiningSumJob.Combine(reduceKey, sortKey, counted, emitter)
+}
+
+func TestCombinerCounters(t *testing.T) {
+
+	var input strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&input, "k%d\n", i%3)
+	}
+
+	var tests = []struct {
+		combineBuffer int
+		calls         int64
+	}{
+		{10000, 3},
+		{10, 30},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optCombineBuffer, tt.combineBuffer)
+
+		calls := Counter("TestCombinerCounters", "calls")
+		values := Counter("TestCombinerCounters", "values")
+
+		got := runTestJob(t, new(countingCombineJob), input.String())
+		if want := []string{"k0\t34", "k1\t33", "k2\t33"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("combine-buffer %d: got %q, want %q", tt.combineBuffer, got, want)
+		}
+
+		if n := Counter("TestCombinerCounters", "calls") - calls; n != tt.calls {
+			t.Errorf("combine-buffer %d: calls counter went up by %d, want %d", tt.combineBuffer, n, tt.calls)
+		}
+		if n := Counter("TestCombinerCounters", "values") - values; n != 100 {
+			t.Errorf("combine-buffer %d: values counter went up by %d, want 100", tt.combineBuffer, n)
+		}
+	}
+}
+
+func TestReporter(t *testing.T) {
+
+	type incr struct {
+		group, name string
+		amount      int64
+	}
+
+	var tests = []struct {
+		name   string
+		incrs  []incr
+		status string
+		want   string
+	}{
+		{"nothing", nil, "", ""},
+		// the first increment is written at once, the rest wait for Flush
+		{"buffered", []incr{{"g", "records", 1}, {"g", "records", 1}, {"g", "records", 1}},
+			"", "reporter:counter:g,records,1\nreporter:counter:g,records,2\n"},
+		{"summed per counter, sorted", []incr{{"g", "x", 1}, {"h", "a", 5}, {"g", "b", 2}, {"h", "a", -1}},
+			"", "reporter:counter:g,x,1\nreporter:counter:g,b,2\nreporter:counter:h,a,4\n"},
+		{"status is written at once", []incr{{"g", "x", 1}, {"g", "x", 1}},
+			"halfway", "reporter:counter:g,x,1\nreporter:status:halfway\nreporter:counter:g,x,1\n"},
+	}
+
+	setOpt(t, &localCounters, false)
+	setOpt(t, &ReportInterval, time.Hour)
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		r := newReporter(&buf)
+		for _, i := range tt.incrs {
+			r.IncrCounter(i.group, i.name, i.amount)
+		}
+		if tt.status != "" {
+			r.SetStatus(tt.status)
+		}
+		r.Flush()
+
+		if buf.String() != tt.want {
+			t.Errorf("%s: wrote %q, want %q", tt.name, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestReporterOf(t *testing.T) {
+
+	r := newReporter(new(bytes.Buffer))
+
+	var tests = []struct {
+		name    string
+		emitter Emitter
+		want    *Reporter
+	}{
+		{"runner's emitter", &reportingEmitter{new(nullEmitter), r}, r},
+		{"other emitter", new(nullEmitter), stdReporter},
+	}
+
+	for _, tt := range tests {
+		if got := ReporterOf(tt.emitter); got != tt.want {
+			t.Errorf("%s: ReporterOf()=%p, want %p", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRelayReporterLines(t *testing.T) {
+
+	var tests = []struct {
+		name   string
+		input  string
+		counts map[string]int64
+		status string
+		passed string
+	}{
+		{"counters", "reporter:counter:TestRelayReporterLines,a,2\nreporter:counter:TestRelayReporterLines,a,3\n",
+			map[string]int64{"a": 5}, "", ""},
+		{"comma in the counter name", "reporter:counter:TestRelayReporterLines,x,y,7\n",
+			map[string]int64{"x,y": 7}, "", ""},
+		{"status", "reporter:status:sorting\n", nil, "reporter:status:sorting\n", ""},
+		{"other lines are copied", "sort: warning\nreporter:counter:TestRelayReporterLines,b,1\n",
+			map[string]int64{"b": 1}, "", "sort: warning\n"},
+		{"malformed counters are copied", "reporter:counter:TestRelayReporterLines,c,x\nreporter:counter:nocommas\n",
+			map[string]int64{"c": 0}, "", "reporter:counter:TestRelayReporterLines,c,x\nreporter:counter:nocommas\n"},
+	}
+
+	setOpt(t, &localCounters, true)
+
+	for _, tt := range tests {
+		before := make(map[string]int64)
+		for name := range tt.counts {
+			before[name] = Counter("TestRelayReporterLines", name)
+		}
+
+		var status bytes.Buffer
+		setOpt(t, &stdReporter, newReporter(&status))
+
+		var buf bytes.Buffer
+		relayReporterLines(strings.NewReader(tt.input), &buf)
+
+		for name, want := range tt.counts {
+			if got := Counter("TestRelayReporterLines", name) - before[name]; got != want {
+				t.Errorf("%s: counter %q went up by %d, want %d", tt.name, name, got, want)
+			}
+		}
+		if status.String() != tt.status {
+			t.Errorf("%s: status %q, want %q", tt.name, status.String(), tt.status)
+		}
+		if buf.String() != tt.passed {
+			t.Errorf("%s: copied %q, want %q", tt.name, buf.String(), tt.passed)
+		}
+	}
+}
+
+func TestSortChildCounters(t *testing.T) {
+
+	sortPath, err := exec.LookPath("sort")
+	if err != nil {
+		t.Skip("no sort command")
+	}
+
+	// a stub sort which reports a counter and then sorts
+	bin := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\necho reporter:counter:TestSortChildCounters,sorts,1 >&2\nexec %s \"$@\"\n", sortPath)
+	if err := os.WriteFile(filepath.Join(bin, "sort"), []byte(script), 0777); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setOpt(t, &optGoSort, false)
+
+	var tests = []struct {
+		partitions int
+	}{
+		{1},
+		{3},
+	}
+
+	for _, tt := range tests {
+		before := Counter("TestSortChildCounters", "sorts")
+
+		setupTestRun(t, "a\nb\nc\nd\ne\nf\n")
+		setOpt(t, &optNumPartitions, tt.partitions)
+		if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+			t.Fatalf("RunContext: %v", err)
+		}
+
+		if got := Counter("TestSortChildCounters", "sorts") - before; got != int64(tt.partitions) {
+			t.Errorf("%d partitions: sorts counter went up by %d, want %d", tt.partitions, got, tt.partitions)
+		}
+		if got := readOutput(t, testJobID); len(got) != 6 {
+			t.Errorf("%d partitions: output %q", tt.partitions, got)
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestHeartbeat(t *testing.T) {
+
+	var tests = []struct {
+		interval time.Duration
+		beats    bool
+	}{
+		{0, false},
+		{time.Millisecond, true},
+	}
+
+	setOpt(t, &localCounters, false)
+	setOpt(t, &ReportInterval, 0)
+
+	for _, tt := range tests {
+		var buf lockedBuffer
+		r := newReporter(&buf)
+
+		stop := r.heartbeat(tt.interval, "reduce")
+		// counters are written alongside the heartbeat
+		for i := 0; i < 200; i++ {
+			r.IncrCounter("g", "c", 1)
+			if i%20 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		stop()
+		written := buf.String()
+
+		beats := 0
+		for _, line := range strings.SplitAfter(written, "\n") {
+			switch {
+			case line == "":
+			case strings.HasPrefix(line, "reporter:status:dmrgo: reduce running for ") && strings.HasSuffix(line, "\n"):
+				beats++
+			case line != "reporter:counter:g,c,1\n":
+				t.Errorf("interval %v: bad line %q", tt.interval, line)
+			}
+		}
+		if (beats > 0) != tt.beats {
+			t.Errorf("interval %v: %d heartbeats", tt.interval, beats)
+		}
+
+		// nothing more is written once it has stopped
+		time.Sleep(5 * time.Millisecond)
+		if after := buf.String(); after != written {
+			t.Errorf("interval %v: wrote %q after stopping", tt.interval, after[len(written):])
+		}
+	}
+}
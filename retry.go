@@ -0,0 +1,174 @@
+package dmrgo
+
+// Retrying map and reduce calls which fail transiently
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrorMapper is implemented by jobs whose Map can fail.  If a job implements
+// it, TryMap is called for each record instead of Map, and records which fail
+// with a retryable error are retried according to the RetryPolicy.
+type ErrorMapper interface {
+	TryMap(key string, value string, emitter Emitter) error
+}
+
+// ErrorReducer is implemented by jobs whose Reduce can fail.  If a job
+// implements it, TryReduce is called for each key instead of Reduce.  The
+// values for a key are buffered in memory so they can be replayed if the
+// key needs to be retried.
+type ErrorReducer interface {
+	TryReduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) error
+}
+
+// RetryPolicy controls how records which fail with a retryable error are retried
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry; it doubles for each subsequent retry
+	Backoff time.Duration
+}
+
+// Retry is the policy used for ErrorMapper and ErrorReducer jobs.  It is set from --retries and --retry-backoff.
+var Retry RetryPolicy
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// Retryable marks err as transient, so the record that caused it will be retried
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err}
+}
+
+// IsRetryable reports whether err, or any error it wraps, was marked with Retryable
+func IsRetryable(err error) bool {
+	var re *retryableError
+	return errors.As(err, &re)
+}
+
+// do calls f until it succeeds, fails with an error which isn't retryable, or runs out of attempts
+func (p RetryPolicy) do(f func() error) error {
+
+	backoff := p.Backoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || !IsRetryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// bufferEmitter holds on to the records from one attempt so only a successful attempt's output is emitted
+type bufferEmitter struct {
+	kvs     []KeyValue
+	combine []bool
+	names   []string // the named output for each record, or "" for the primary output
+}
+
+func (e *bufferEmitter) Emit(reduceKey string, sortKey string, value string) {
+	e.kvs = append(e.kvs, KeyValue{reduceKey, sortKey, value})
+	e.combine = append(e.combine, false)
+	e.names = append(e.names, "")
+}
+
+func (e *bufferEmitter) Combine(reduceKey string, value string) {
+	e.kvs = append(e.kvs, KeyValue{reduceKey, "", value})
+	e.combine = append(e.combine, true)
+	e.names = append(e.names, "")
+}
+
+// EmitTo buffers a record for a named output, so it is replayed to the same output
+func (e *bufferEmitter) EmitTo(name string, kv *KeyValue) {
+	e.kvs = append(e.kvs, *kv)
+	e.combine = append(e.combine, false)
+	e.names = append(e.names, name)
+}
+
+func (e *bufferEmitter) EmitAll(kvs []*KeyValue) {
+	emitAll(e, kvs)
+}
+
+func (e *bufferEmitter) Flush() {}
+func (e *bufferEmitter) Close() {}
+
+func (e *bufferEmitter) replay(emitter Emitter) {
+	for i, kv := range e.kvs {
+		switch {
+		case e.combine[i]:
+			emitter.Combine(kv.ReduceKey, kv.Value)
+		case e.names[i] != "":
+			if ne, ok := emitter.(NamedEmitter); ok {
+				ne.EmitTo(e.names[i], &kv)
+				continue
+			}
+			emitter.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+		default:
+			emitter.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+		}
+	}
+}
+
+// tryMap runs TryMap for a record under the retry policy
+func tryMap(m ErrorMapper, key string, value string, emitter Emitter) {
+
+	var buf *bufferEmitter
+
+	err := Retry.do(func() error {
+		buf = new(bufferEmitter)
+		return m.TryMap(key, value, buf)
+	})
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dmrgo: map failed, skipping record:", err)
+		badRecord(err)
+		return
+	}
+
+	buf.replay(emitter)
+}
+
+// tryReduce runs TryReduce for a key under the retry policy
+func tryReduce(r ErrorReducer, reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+
+	var vs []string
+	for v := range values {
+		vs = append(vs, v)
+	}
+
+	var buf *bufferEmitter
+
+	err := Retry.do(func() error {
+		buf = new(bufferEmitter)
+		ch := make(chan string, len(vs))
+		for _, v := range vs {
+			ch <- v
+		}
+		close(ch)
+		return r.TryReduce(reduceKey, sortKey, ch, buf)
+	})
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dmrgo: reduce failed, skipping key", reduceKey+":", err)
+		badRecord(err)
+		return
+	}
+
+	buf.replay(emitter)
+}
@@ -0,0 +1,144 @@
+package dmrgo
+
+// Tests for retrying failed records
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+
+	errFlaky := errors.New("flaky")
+
+	var tests = []struct {
+		name        string
+		maxAttempts int
+		fails       int
+		retryable   bool
+		attempts    int
+		wantErr     bool
+	}{
+		{"fails twice then succeeds", 3, 2, true, 3, false},
+		{"out of attempts", 2, 2, true, 2, true},
+		{"not retryable", 3, 2, false, 1, true},
+		{"succeeds first time", 3, 0, true, 1, false},
+		{"no retries", 1, 1, true, 1, true},
+		{"zero attempts means one", 0, 1, true, 1, true},
+	}
+
+	for _, tt := range tests {
+		attempts := 0
+		err := RetryPolicy{MaxAttempts: tt.maxAttempts}.do(func() error {
+			attempts++
+			if attempts > tt.fails {
+				return nil
+			}
+			if tt.retryable {
+				return Retryable(errFlaky)
+			}
+			return errFlaky
+		})
+
+		if attempts != tt.attempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, attempts, tt.attempts)
+		}
+		if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, errFlaky) {
+			t.Errorf("%s: err=%v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+
+	var times []time.Time
+	RetryPolicy{MaxAttempts: 3, Backoff: 20 * time.Millisecond}.do(func() error {
+		times = append(times, time.Now())
+		return Retryable(errors.New("flaky"))
+	})
+
+	// the backoff doubles for each retry
+	if len(times) != 3 {
+		t.Fatalf("%d attempts, want 3", len(times))
+	}
+	if d := times[1].Sub(times[0]); d < 20*time.Millisecond {
+		t.Errorf("first retry after %v, want at least 20ms", d)
+	}
+	if d := times[2].Sub(times[1]); d < 40*time.Millisecond {
+		t.Errorf("second retry after %v, want at least 40ms", d)
+	}
+}
+
+// flakyJob's TryMap and TryReduce fail with a retryable error the first
+// fails times they are called for each record, emitting a record each time
+type flakyJob struct {
+	fails    int
+	attempts map[string]int
+}
+
+func (j *flakyJob) attempt(key string) error {
+	j.attempts[key]++
+	if j.attempts[key] <= j.fails {
+		return Retryable(fmt.Errorf("attempt %d at %q", j.attempts[key], key))
+	}
+	return nil
+}
+
+func (j *flakyJob) Map(key string, value string, emitter Emitter) {}
+
+func (j *flakyJob) TryMap(key string, value string, emitter Emitter) error {
+	emitter.Emit(value, "", "1")
+	return j.attempt("map " + value)
+}
+
+func (j *flakyJob) MapFinal(emitter Emitter) {}
+
+func (j *flakyJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {}
+
+func (j *flakyJob) TryReduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) error {
+	var vs []string
+	for v := range values {
+		vs = append(vs, v)
+	}
+	emitter.Emit(reduceKey, "", strings.Join(vs, ","))
+	return j.attempt("reduce " + reduceKey)
+}
+
+func TestRetryJob(t *testing.T) {
+
+	var tests = []struct {
+		maxAttempts int
+		want        []KeyValue
+		skipped     int64
+	}{
+		{3, []KeyValue{{"a", "", "1,1"}, {"b", "", "1"}}, 0},
+		// with two attempts the first "a" and "b" are skipped, the second "a" is
+		// mapped on its third attempt, and reducing it fails twice
+		{2, nil, 3},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &Retry, RetryPolicy{MaxAttempts: tt.maxAttempts})
+
+		before := MalformedRecords()
+		job := &flakyJob{fails: 2, attempts: make(map[string]int)}
+		got, err := RunLocal(job, strings.NewReader("a\nb\na\n"))
+		if err != nil {
+			t.Fatalf("maxAttempts=%d: RunLocal: %v", tt.maxAttempts, err)
+		}
+
+		// only the successful attempt's records are emitted
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("maxAttempts=%d: got %v, want %v", tt.maxAttempts, got, tt.want)
+		}
+		if n := MalformedRecords() - before; n != tt.skipped {
+			t.Errorf("maxAttempts=%d: %d records skipped, want %d", tt.maxAttempts, n, tt.skipped)
+		}
+	}
+}
@@ -5,15 +5,26 @@ package dmrgo
 // License: GPLv3 or, at your option, any later version
 
 import (
+	"archive/zip"
 	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net/url"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // KeyValue is the primary type for interacting with Hadoop.
@@ -29,44 +40,83 @@ func readLineValue(br *bufio.Reader) (*KeyValue, error) {
 	if err != nil {
 		return nil, err
 	}
-	// this appears to be a punt for handling case where mapper input already has one or more key
+	// input which already has keys is read with readLineKeyValue instead (see --map-input-keyed)
 	return &KeyValue{"", "", s}, err
 }
 
+// readLineKeyValue reads a line of the form "reduceKey[,sortKey]\tvalue", with url-encoded keys.
+// The tab and comma are the field and key separators.
+// A line without a tab is all key.  With --escape-values, the value is unescaped.
 func readLineKeyValue(br *bufio.Reader) (*KeyValue, error) {
 
-	k, err := br.ReadString('\t')
+	line, err := br.ReadString('\n')
 	if err != nil {
 		return nil, err
 	}
-	k = strings.TrimRight(k, "\t")
+	line = strings.TrimRight(line, "\n")
 
-	keys := strings.SplitN(k, ",", 2)
+	k, v := line, ""
+	if i := strings.IndexByte(line, fieldSeparator); i >= 0 {
+		k, v = line[:i], line[i+1:]
+	}
+
+	keys := strings.SplitN(k, string([]byte{keySeparator}), 2)
 
 	var reduceKey string
 	var sortKey string
-	reduceKey, err = url.QueryUnescape(keys[0])
+	reduceKey, err = unescapeKey(keys[0])
 	if err != nil {
 		return nil, err
 	}
 
 	if len(keys) == 2 {
-		sortKey, err = url.QueryUnescape(keys[1])
+		sortKey, err = unescapeKey(keys[1])
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	v, err := br.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
+	return &KeyValue{reduceKey, sortKey, unescapeValue(v)}, nil
+}
 
-	v = strings.TrimRight(v, "\n")
+// ReduceOutputRouter, if set, chooses the output for each record emitted by
+// Reduce in --mapreduce mode.  Records are written to red-out-p<pid>.<name>
+// instead of the file for the partition they were reduced in.
+var ReduceOutputRouter func(reduceKey, sortKey, value string) string
+
+// ReduceInput, if set, reads the records of the sorted input to --reducer in
+// place of "key\tvalue" lines, e.g. for a binary format from a Hadoop
+// streaming job.  It isn't used by --mapreduce, which sorts its own map
+// output as lines.
+var ReduceInput RecordReader
+
+// reduceReader returns the RecordReader for reducer input
+func reduceReader() RecordReader {
+	if ReduceInput != nil {
+		return ReduceInput
+	}
+	return readLineKeyValue
+}
 
-	return &KeyValue{reduceKey, sortKey, v}, nil
+// mapReader returns the RecordReader for map input: with --map-input-keyed
+// lines are "key\tvalue", as written by a previous job's reducers, and
+// otherwise the whole line is the value.
+func mapReader() RecordReader {
+	if optMapInputKeyed {
+		return readLineKeyValue
+	}
+	return readLineValue
 }
 
+// GroupKey, if set, maps a reduce key to the key records are grouped by when
+// reducing.  Consecutive records whose reduce keys map to the same group key
+// are passed to a single Reduce call, with the group key as its reduceKey, in
+// the order they were sorted by their full keys.  For example, emit
+// "user:timestamp" keys and group by "user" to see each user's values in time
+// order.  Map output is partitioned by the group key, so a group is never
+// split between partitions.
+var GroupKey func(reduceKey string) string
+
 // MapReduceJob is the interface expected by the job runner
 type MapReduceJob interface {
 	Map(key string, value string, emitter Emitter)
@@ -77,6 +127,38 @@ type MapReduceJob interface {
 	Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter)
 }
 
+// Combiner is implemented by jobs which can pre-aggregate map output before
+// it is sorted.  Combine has the same contract as Reduce and must emit values
+// which Reduce (and Combine) can consume.  In --mapreduce mode, values passed
+// to Emitter.Combine are buffered and run through the Combiner before being
+// written to the spill files.
+type Combiner interface {
+	Combine(reduceKey string, sortKey string, values <-chan string, emitter Emitter)
+}
+
+// combinerFor returns the job's Combiner, or nil if it doesn't have one
+func combinerFor(mrjob MapReduceJob) Combiner {
+	c, _ := mrjob.(Combiner)
+	return c
+}
+
+// MapSetuper is implemented by jobs which need to prepare for mapping, such
+// as by opening a database handle or loading a lookup table.  MapSetup is
+// called once per map task, before the first call to Map; in --mapreduce mode
+// each input file (or split) is a map task.
+type MapSetuper interface {
+	MapSetup(emitter Emitter)
+}
+
+// ReduceSetuper is implemented by jobs which need to prepare for reducing and
+// clean up after.  ReduceSetup is called once per reduce task process, not
+// per key, before the first call to Reduce, and ReduceTeardown after the last
+// key has been reduced; in --mapreduce mode each partition is a reduce task.
+type ReduceSetuper interface {
+	ReduceSetup(emitter Emitter)
+	ReduceTeardown(emitter Emitter)
+}
+
 // are in we in the map or reduce phase?
 var optDoMap bool
 var optDoReduce bool
@@ -85,7 +167,7 @@ var optDoReduce bool
 var optDoMapReduce bool
 
 // use a secondary sort key
-// var optSecondaryKey bool
+var optSecondaryKey bool
 
 // how many output partitions should we use
 var optNumPartitions int
@@ -96,87 +178,414 @@ var optNumMappers int
 // how many concurrent reducers should we try to use
 var optNumReducers int
 
+// roll map output over to a new spill file after this many bytes
+var optSpillSize int64
+
+// write final output as length-delimited binary records
+var optDelimitedOutput bool
+
+// flush stdout after every record
+var optLineBuffered bool
+
+// compression level for gzip'd files
+var optGzipLevel int
+
+// output only the distinct reduce keys
+var optKeysOnly bool
+
+// what to write after each output record
+var optRecordDelimiter string
+
+// pick the number of mappers and reducers automatically
+var optAutoTune bool
+
+// fail the run unless it outputs exactly this many records
+var optExpectRecords int64
+
+// warn about reduce keys with more than this fraction of the records
+var optSkewThreshold float64
+
+// how many map output values to buffer for the combiner
+var optCombineBuffer int
+
+// abort on the first record that can't be decoded
+var optStrict bool
+
+// skip key parsing and reduce all input lines as a single key
+var optRawReduce bool
+
+// fsync reduce output files before reporting success
+var optFsyncOutput bool
+
+// split input files bigger than this into pieces mapped in parallel
+var optSplitSize int64
+
+// niceness for the sort subprocesses
+var optNice int
+
+// extension for reduce output file names
+var optOutputExt string
+
+// gzip the reduce output files
+var optCompressOutput bool
+
+// extra options for the sort command
+var optSortArgs string
+
+// line written after each key's reduce output
+var optGroupSentinel string
+
+// normalize reduce keys to Unicode NFC
+var optNFCKeys bool
+
+// sort map output in Go instead of with the sort command
+var optGoSort bool
+
+// write each reduce key's output to its own file in this directory
+var optOutputPerKey string
+
+// most per-key output files to keep open at once
+var optMaxOpenFiles int
+
+// names the run's temp and output files; 0 means use the pid
+var optJobID int
+
+// reduce only these partitions, from an earlier run's spill files
+var optPartitionsOnly string
+
+// zero-pad integer sort keys to this many digits in map output
+var optPadSortKeys int
+
+// how keys are encoded in records: url, base64 or none
+var optKeyEncoding string
+
+// write the sorted reduce input to disk instead of piping it to the reducer
+var optSortToDisk bool
+
+// how many sorts to run at once (0 means --reducers)
+var optNumSorts int
+
+// escape newlines and backslashes in values
+var optEscapeValues bool
+
+// leave the spill and sort files behind
+var optKeepTemp bool
+
+// directories for the intermediate and final files of --mapreduce
+var optTmpDir string
+var optOutputDir string
+
+// map input lines have keys
+var optMapInputKeyed bool
+
+// fail if a reduce key is split across groups
+var optCheckGroups bool
+
+// how often to write a status line while mapping or reducing under Hadoop streaming
+var optHeartbeatInterval time.Duration
+
 func init() {
 	flag.BoolVar(&optDoMap, "mapper", false, "run mapper code on stdin")
 	flag.BoolVar(&optDoReduce, "reducer", false, "run reducer on stdin")
-	// flag.BoolVar(&optSecondaryKey, "with-secondary-key", false, "group by primary key, sort by url-encoded secondary key (because we have to separate the two keys with a comma)")
+	flag.BoolVar(&optSecondaryKey, "with-secondary-key", false, "sort each reduce key's records by their sort key (the url-encoded secondary key, after the comma)")
 	flag.IntVar(&optNumPartitions, "partitions", 1, "parition data into sets")
 	flag.BoolVar(&optDoMapReduce, "mapreduce", false, "run full map/reduce")
 	flag.IntVar(&optNumMappers, "mappers", 4, "number of map processes")
 	flag.IntVar(&optNumReducers, "reducers", 4, "number of reducer processes")
+	flag.Int64Var(&optSpillSize, "spill-size", 0, "start a new map spill file after this many bytes per partition (0 = unlimited)")
+	flag.BoolVar(&optDelimitedOutput, "delimited-output", false, "write reduce output values as varint-length-prefixed binary records (e.g. protobuf messages) instead of text lines")
+	flag.BoolVar(&optLineBuffered, "line-buffered", false, "flush output after every record (for piping into a live consumer)")
+	flag.IntVar(&optGzipLevel, "gzip-level", gzip.DefaultCompression, "gzip compression level for compressed files: 1 (fastest) to 9 (smallest), -1 for the default")
+	flag.BoolVar(&optKeysOnly, "keys-only", false, "output only the distinct reduce keys, one per line, ignoring what Reduce emits")
+	flag.StringVar(&optRecordDelimiter, "record-delimiter", `\n`, "delimiter written after each output record; Go escapes such as \\r\\n or \\x00 are interpreted")
+	flag.IntVar(&Retry.MaxAttempts, "retries", 1, "number of attempts for records which fail with a retryable error")
+	flag.DurationVar(&Retry.Backoff, "retry-backoff", 100*time.Millisecond, "delay before the first retry of a failed record, doubling for each retry after")
+	flag.BoolVar(&optAutoTune, "auto-tune", false, "pick the number of mappers and reducers from the CPU count and the speed of mapping the first input")
+	flag.Int64Var(&optExpectRecords, "expect-records", -1, "fail the run unless exactly this many output records are written (-1 to not check)")
+	flag.Float64Var(&optSkewThreshold, "skew-threshold", 0, "warn about reduce keys with more than this fraction (0-1) of a reducer's records (0 to disable)")
+	flag.IntVar(&optCombineBuffer, "combine-buffer", 10000, "number of map output values to buffer before running the combiner")
+	flag.BoolVar(&optStrict, "strict", false, "fail the run on the first malformed record instead of skipping it")
+	flag.BoolVar(&optRawReduce, "raw-reduce", false, "debugging: pass every reducer input line unparsed to a single Reduce call with key \"\"")
+	flag.BoolVar(&optFsyncOutput, "fsync-output", false, "fsync each reduce output file after it is written, before the run reports success")
+	flag.Int64Var(&optSplitSize, "split-size", 0, "split uncompressed input files bigger than this many bytes into pieces, at line boundaries, which are mapped in parallel (0 = don't split)")
+	flag.IntVar(&optNice, "nice", 0, "run the sort subprocesses at this niceness (e.g. 10), so a local job doesn't starve the machine")
+	flag.StringVar(&optOutputExt, "output-ext", "", "extension for reduce output file names, e.g. tsv for red-out-p<pid>.<partition>.tsv")
+	flag.BoolVar(&optCompressOutput, "compress-output", false, "gzip the reduce output files of --mapreduce, naming them red-out-p<pid>.<partition>.gz")
+	flag.StringVar(&optSortArgs, "sort-args", "", "extra space-separated options for the sort command, e.g. \"--parallel=4 -S 1G\"")
+	flag.StringVar(&optGroupSentinel, "group-sentinel", "", "line to write after the reduce output for each key, to mark the end of its group")
+	flag.BoolVar(&optNFCKeys, "nfc-keys", false, "normalize reduce keys to Unicode NFC before partitioning and grouping, so equivalent keys in different forms are reduced together")
+	flag.BoolVar(&optGoSort, "go-sort", os.Getenv("DMRGO_GO_SORT") != "", "sort map output in memory in Go rather than with the sort command, for the same results on every platform (default from $DMRGO_GO_SORT)")
+	flag.StringVar(&optOutputPerKey, "output-per-key", "", "write the reduce output for each key to <dir>/<key>.txt, with the key url-encoded")
+	flag.IntVar(&optMaxOpenFiles, "max-open-files", 64, "most --output-per-key files to keep open at once; the least recently used is closed to open another")
+	flag.IntVar(&optJobID, "job-id", 0, "number used in the names of temp and output files instead of the pid, e.g. to re-run partitions of an earlier job")
+	flag.StringVar(&optPartitionsOnly, "partitions-only", "", "comma-separated partitions to reduce, skipping the map phase and reusing the spill files of the run given by -job-id")
+	flag.IntVar(&optPadSortKeys, "pad-sort-keys", 0, "zero-pad integer sort keys to this many digits in map output, so they sort numerically, and strip the padding for Reduce (0 = don't pad)")
+	flag.StringVar(&optKeyEncoding, "key-encoding", "url", "how keys are encoded in map output and reduce input and output: url (percent-encoding), base64 (compact for binary keys, but keys no longer sort in their natural order) or none (keys must not contain separators or newlines)")
+	flag.BoolVar(&optSortToDisk, "sort-to-disk", false, "write each partition's sorted map output to tmp-red-in-p<pid>.<partition> and reduce from there, instead of piping sort into the reducer (for debugging, e.g. with --keep-temp)")
+	flag.IntVar(&optNumSorts, "sorts", 0, "how many partitions to sort at once (0 = --reducers)")
+	flag.BoolVar(&optEscapeValues, "escape-values", false, "write newlines in values as \\n and backslashes as \\\\, and decode them when reading key/value lines, so values may contain newlines")
+	flag.BoolVar(&optKeepTemp, "keep-temp", false, "don't remove the spill and sort files of --mapreduce, for debugging")
+	flag.StringVar(&optTmpDir, "tmp-dir", ".", "directory for the spill and sort files of --mapreduce, created if needed")
+	flag.StringVar(&optOutputDir, "output-dir", ".", "directory for the reduce output files of --mapreduce, created if needed")
+	flag.BoolVar(&optMapInputKeyed, "map-input-keyed", false, "map input lines are \"key\\tvalue\", as written by a reducer, and Map is passed the key")
+	flag.BoolVar(&optCheckGroups, "check-groups", false, "fail if a reduce key appears in more than one group, as when the input wasn't sorted as the reducer expects (holds every key in memory)")
+	flag.DurationVar(&optHeartbeatInterval, "heartbeat-interval", 60*time.Second, "with --mapper or --reducer, how often to report status so Hadoop doesn't time out a busy task (0 = never)")
+	flag.Usage = usage
 }
 
-func mapreduce(mrjob MapReduceJob) {
+const usageText = `Usage: %[1]s [options] [input files]
 
-	attr := new(os.ProcAttr)
-	attr.Files = []*os.File{nil, nil, nil}
+A dmrgo job runs in one of three modes:
 
-	pid := os.Getpid()
+  --mapper     run the Map phase over stdin, writing key/value lines to stdout
+  --reducer    run the Reduce phase over sorted key/value lines on stdin
+  --mapreduce  run the whole job locally: map the input files (or stdin) in
+               parallel, partition and sort the map output, and reduce each
+               partition into red-out-p<pid>.<partition> in --output-dir.
+               An input file of "-" is stdin.
+
+--mapper and --reducer are the halves of a Hadoop streaming job and cannot be
+given together; use --mapreduce to run both locally.
+
+Examples:
+
+  # test the job locally with a shell pipeline
+  cat input.txt | %[1]s --mapper | sort | %[1]s --reducer
+
+  # run the job locally over several files with 8 partitions
+  %[1]s --mapreduce --partitions 8 --mappers 4 --reducers 4 part1.txt part2.txt
+
+  # run the job under Hadoop streaming
+  hadoop jar hadoop-streaming.jar -mapper "%[1]s --mapper" -reducer "%[1]s --reducer" -input in -output out
+
+Options:
+`
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), usageText, filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
+
+// RunContext runs mrjob locally, as --mapreduce does, with the options and
+// input files given on the command line (so flag.Parse must have been
+// called), and returns the number of records the reducers wrote.  If ctx is
+// cancelled or its deadline passes, the run stops at the next input file,
+// partition or block of reduce input, removes its temp files and returns
+// ctx.Err().  Output already written is left in place.  With
+// --expect-records, a run which writes a different number of records fails.
+func RunContext(ctx context.Context, mrjob MapReduceJob) (int64, error) {
+	if err := Validate(mrjob); err != nil {
+		return 0, err
+	}
+	resetFailure()
+	stats, err := mapreduce(ctx, mrjob)
+	if err != nil {
+		return 0, err
+	}
+	return stats.OutputRecords, checkRecordCount(stats.OutputRecords)
+}
+
+func mapreduce(ctx context.Context, mrjob MapReduceJob) (*RunStats, error) {
+
+	pid := jobID()
+
+	reducePartitions, err := parsePartitions(optPartitionsOnly, optNumPartitions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range []string{optTmpDir, optOutputDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+	}
 
 	wg := new(sync.WaitGroup)
 
+	stats := &RunStats{Partitions: make([]PartitionStats, optNumPartitions)}
+
+	numReducers := optNumReducers
+
+	countersMu.Lock()
+	localCounters = true
+	countersMu.Unlock()
+
 	mapperInputFiles := flag.Args()
 
 	// no input files -- read from stdin
 	if len(mapperInputFiles) == 0 {
-		mEmit := newPartitionEmitter(uint(optNumPartitions), fmt.Sprintf("tmp-map-out-p%d-f0", pid))
-		mapper(mrjob, os.Stdin, mEmit)
-		mapperFinal(mrjob, mEmit)
-		mEmit.Flush()
-		mEmit.Close()
-		mapperInputFiles = []string{"(stdin)"}
+		mapperInputFiles = []string{"-"}
+	}
+
+	if optPartitionsOnly != "" {
+		// re-running partitions: the map output is already in the spill files
 	} else {
-		// we have multiple input files -- run up to 'mappers' of them in parallel
+		// run up to 'mappers' of the input files in parallel.  "-" is stdin.
 
 		// the type of our channel -- limit scope 'cause we don't need it anywhere else
 		type mapperFile struct {
 			index int
 			fname string
+			open  func() (io.ReadCloser, error)
+			read  RecordReader
+		}
+
+		var inputs []*mapperFile
+
+		// zip archives are expanded so each member gets its own mapper
+		for _, arg := range mapperInputFiles {
+
+			fname, read := parseInputSpec(arg)
+
+			if fname == "-" {
+				inputs = append(inputs, &mapperFile{len(inputs), "(stdin)", openStdin, read})
+				continue
+			}
+
+			if !strings.HasSuffix(strings.ToLower(fname), ".zip") {
+				fi, err := os.Stat(fname)
+				regular := err == nil && fi.Mode().IsRegular()
+
+				// empty files have no records, so don't bother mapping them
+				if regular && fi.Size() == 0 {
+					continue
+				}
+
+				// big files are split so they can be mapped in parallel
+				if _, compressed := Decompressors[strings.ToLower(filepath.Ext(fname))]; regular && !compressed && optSplitSize > 0 && fi.Size() > optSplitSize {
+					for start := int64(0); start < fi.Size(); start += optSplitSize {
+						start, end := start, start+optSplitSize
+						if end > fi.Size() {
+							end = fi.Size()
+						}
+						name := fmt.Sprintf("%s[%d:%d]", fname, start, end)
+						inputs = append(inputs, &mapperFile{len(inputs), name, func() (io.ReadCloser, error) { return openSplit(fname, start, end) }, read})
+					}
+					continue
+				}
+
+				inputs = append(inputs, &mapperFile{len(inputs), fname, func() (io.ReadCloser, error) { return openInput(fname) }, read})
+				continue
+			}
+
+			zr, err := zip.OpenReader(fname)
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+
+			for _, zf := range zr.File {
+				if zf.FileInfo().IsDir() || zf.UncompressedSize64 == 0 {
+					continue
+				}
+				inputs = append(inputs, &mapperFile{len(inputs), fname + ":" + zf.Name, zf.Open, read})
+			}
+		}
+
+		mapInput := func(input *mapperFile) {
+			// an input we can't read fails the run rather than being left out of it
+			f, err := input.open()
+			if err != nil {
+				fail(fmt.Errorf("opening %s: %v", input.fname, err))
+				return
+			}
+			defer f.Close()
+
+			mEmit := newPartitionEmitter(uint(optNumPartitions), spillTemplate(pid, input.index), combinerFor(mrjob), partitionerFor(mrjob))
+			defer mEmit.Close()
+			mapper(mrjob, &countingReader{f, &stats.InputBytes}, input.read, mEmit, stdReporter)
+		}
+
+		numMappers := optNumMappers
+		work := inputs
+
+		// calibrate by mapping the first input on its own
+		if optAutoTune && len(work) > 0 {
+			t0 := time.Now()
+			mapInput(work[0])
+			cpuBound := cpuBoundFraction(time.Since(t0), work[0].open)
+			work = work[1:]
+			numMappers, numReducers = autoTune(runtime.NumCPU(), len(work), optNumPartitions, cpuBound)
+			fmt.Fprintf(os.Stderr, "auto-tune: %d mappers, %d reducers\n", numMappers, numReducers)
+		}
+
+		// no point starting more mappers than we have inputs
+		if numMappers > len(work) {
+			numMappers = len(work)
+		}
+		if numMappers < 1 {
+			numMappers = 1
 		}
 
 		mapperWork := make(chan *mapperFile)
 
 		// launch the goroutines
-		for i := 0; i < optNumMappers; i++ {
+		for i := 0; i < numMappers; i++ {
 			wg.Add(1)
 			go func(inputs chan *mapperFile) {
+				defer wg.Done()
 
 				for input := range inputs {
-
-					f, err := os.Open(input.fname)
-					if err != nil {
-						fmt.Fprintln(os.Stderr, "err opening ", f, ": ", err)
-						return
+					if stopped(ctx) != nil {
+						continue
 					}
-
-					mEmit := newPartitionEmitter(uint(optNumPartitions), fmt.Sprintf("tmp-map-out-p%d-f%d", pid, input.index))
-					mapper(mrjob, f, mEmit)
-					mEmit.Flush()
-					mEmit.Close()
-					f.Close()
+					mapInput(input)
 				}
-				wg.Done()
 			}(mapperWork)
 		}
 
 		// and send the work
-		for i, fname := range mapperInputFiles {
-			mapperWork <- &mapperFile{i, fname}
+		for _, input := range work {
+			mapperWork <- input
 		}
 		close(mapperWork)
 
 		wg.Wait()
 
-		// then launch mapperFinal
-		mEmit := newPartitionEmitter(uint(optNumPartitions), fmt.Sprintf("tmp-map-out-p%d-f%d", pid, len(mapperInputFiles)))
-		mapperFinal(mrjob, mEmit)
-		mEmit.Flush()
-		mEmit.Close()
+		if err := stopped(ctx); err != nil {
+			removeTempFiles(pid)
+			return nil, err
+		}
+
+		// then launch mapperFinal.  The inputs are numbered 0..len(inputs)-1,
+		// so len(inputs) can't collide with any of their spill files.
+		func() {
+			mEmit := newPartitionEmitter(uint(optNumPartitions), spillTemplate(pid, len(inputs)), combinerFor(mrjob), partitionerFor(mrjob))
+			defer mEmit.Close()
+			mapperFinal(mrjob, mEmit, stdReporter)
+		}()
+
+		if err := failed(); err != nil {
+			removeTempFiles(pid)
+			return nil, err
+		}
+	}
+
+	// an output shared by all the reducers, instead of a file per partition
+	var router sharedOutput
+	if ReduceOutputRouter != nil {
+		router = newRouteEmitter(ReduceOutputRouter, filepath.Join(optOutputDir, fmt.Sprintf("red-out-p%d", pid)))
+	} else if optOutputPerKey != "" {
+		router, err = newKeyFileEmitter(optOutputPerKey, optMaxOpenFiles)
+		if err != nil {
+			removeTempFiles(pid)
+			return nil, err
+		}
 	}
 
 	partitions := make(chan int)
 
-	for i := 0; i < optNumReducers; i++ {
+	numSorts := optNumSorts
+	if numSorts == 0 {
+		numSorts = numReducers
+	}
+	sorts := make(chan struct{}, numSorts)
+
+	// the first partition to fail stops the rest
+	var reduceErrMu sync.Mutex
+	var reduceErr error
+
+	for i := 0; i < numReducers; i++ {
 
 		wg.Add(1)
 
@@ -184,142 +593,711 @@ func mapreduce(mrjob MapReduceJob) {
 
 			for partition := range work {
 
-				fns, _ := filepath.Glob(fmt.Sprintf("tmp-map-out-p%d-f*.%04d", pid, partition))
-
-				redin := fmt.Sprintf("tmp-red-in-p%d.%04d", pid, partition)
-
-				cmdline := []string{"sort", "-o", redin}
-				cmdline = append(cmdline, fns...)
+				reduceErrMu.Lock()
+				skip := reduceErr != nil
+				reduceErrMu.Unlock()
 
-				// sort
-				p, err := os.StartProcess("/usr/bin/sort", cmdline, attr)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "err running sort: ", err)
+				if skip || stopped(ctx) != nil {
+					continue
 				}
-				p.Wait()
-
-				// reduce
-				f, _ := os.Open(redin)
-				rout, _ := os.Create(fmt.Sprintf("red-out-p%d.%04d", pid, partition))
-				rEmit := newPrintEmitter(bufio.NewWriter(rout))
-				reducer(mrjob, f, rEmit)
-				for _, fn := range fns {
-					os.Remove(fn)
+
+				if err := reducePartition(ctx, mrjob, pid, partition, router, stats, sorts); err != nil {
+					reduceErrMu.Lock()
+					if reduceErr == nil {
+						reduceErr = fmt.Errorf("partition %d: %v", partition, err)
+					}
+					reduceErrMu.Unlock()
 				}
-				os.Remove(redin)
-				rEmit.Flush()
-				rout.Close()
 			}
 			wg.Done()
 		}(partitions)
 	}
 
-	for i := 0; i < optNumPartitions; i++ {
+	for _, i := range reducePartitions {
 		partitions <- i
 	}
 	close(partitions)
 
 	wg.Wait()
 
-	if optNumPartitions == 1 {
-		fmt.Printf("output is in: red-out-p%d.0000\n", pid)
+	// a stopped run's sorts fail as their reducers stop reading, so report why it stopped
+	err = stopped(ctx)
+	if err == nil {
+		err = reduceErr
+	}
+	if err != nil {
+		if router != nil {
+			router.Close()
+		}
+		removeTempFiles(pid)
+		return nil, err
+	}
+
+	if router != nil {
+		router.Close()
+		fnames := router.fileNames()
+		stats.OutputBytes = spillSize(fnames)
+		sort.Strings(fnames)
+		fmt.Printf("output is in: %s\n", strings.Join(fnames, " "))
+	} else if optPartitionsOnly != "" {
+		var fnames []string
+		for _, partition := range reducePartitions {
+			fnames = append(fnames, outputFileName(pid, partition))
+		}
+		fmt.Printf("output is in: %s\n", strings.Join(fnames, " "))
+	} else if optNumPartitions == 1 {
+		fmt.Printf("output is in: %s\n", outputFileName(pid, 0))
 	} else {
-		fmt.Printf("output is in: red-out-p%d.0000 - red-out-p%d.%04d\n", pid, pid, optNumPartitions-1)
+		fmt.Printf("output is in: %s - %s\n", outputFileName(pid, 0), outputFileName(pid, optNumPartitions-1))
+	}
+
+	var named []string
+	for _, p := range stats.Partitions {
+		named = append(named, p.NamedOutputs...)
+	}
+	if len(named) > 0 {
+		sort.Strings(named)
+		fmt.Printf("named outputs are in: %s\n", strings.Join(named, " "))
+	}
+
+	fmt.Printf("bytes: %d read, %d spilled, %d written\n", stats.InputBytes, stats.SpillBytes(), stats.OutputBytes)
+
+	printCounters(os.Stdout)
+
+	setLastRunStats(stats)
+
+	return stats, nil
+}
+
+// reducePartition sorts the map output for a partition and reduces it, into
+// the partition's output file or the router if there is one.  The sort output
+// is piped straight into the reducer, or with --sort-to-disk written to a
+// file first.  At most cap(sorts) sorts run at once.  The partition's spill
+// and sort files are removed whether or not it succeeds, unless --keep-temp
+// is set.
+func reducePartition(ctx context.Context, mrjob MapReduceJob, pid int, partition int, router sharedOutput, stats *RunStats, sorts chan struct{}) error {
+
+	fns, _ := filepath.Glob(spillGlob(pid, partition))
+
+	pstats := &stats.Partitions[partition]
+	pstats.Partition = partition
+	pstats.SpillFiles = len(fns)
+	pstats.SpillBytes = spillSize(fns)
+
+	redin := reduceInputName(pid, partition)
+
+	// a failed run may have left its sort output behind
+	if optPartitionsOnly != "" {
+		os.Remove(redin)
+	}
+
+	defer func() {
+		if optKeepTemp {
+			return
+		}
+		for _, fn := range fns {
+			os.Remove(fn)
+		}
+		os.Remove(redin)
+	}()
+
+	if !optSortToDisk {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+
+		sortErr := make(chan error, 1)
+		sorts <- struct{}{}
+		go func() {
+			err := sortPartition(fns, pw, pstats)
+			pw.Close()
+			<-sorts
+			sortErr <- err
+		}()
+
+		err = reduceOutput(ctx, mrjob, &contextReader{ctx, pr}, pid, partition, router, stats)
+
+		// if the reducer stopped early, closing the pipe stops the sort
+		pr.Close()
+		if serr := <-sortErr; serr != nil && err == nil {
+			err = fmt.Errorf("sort failed: %v", serr)
+			// the output was reduced from only part of the input
+			if router == nil {
+				os.Remove(outputFileName(pid, partition))
+			}
+			for _, fn := range pstats.NamedOutputs {
+				os.Remove(fn)
+			}
+		}
+
+		return err
+	}
+
+	// sort writes to its stdout, so the temp file can be created by TempFileFunc
+	sorted, err := TempFileFunc(redin)
+	if err != nil {
+		return err
 	}
+
+	sorts <- struct{}{}
+	err = sortPartition(fns, sorted, pstats)
+	<-sorts
+	sorted.Close()
+	if err != nil {
+		return fmt.Errorf("sort failed: %v", err)
+	}
+
+	f, err := os.Open(redin)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return reduceOutput(ctx, mrjob, &contextReader{ctx, f}, pid, partition, router, stats)
+}
+
+// reduceOutput reduces the sorted input r for a partition, into the
+// partition's output file or the router if there is one
+func reduceOutput(ctx context.Context, mrjob MapReduceJob, r io.Reader, pid int, partition int, router sharedOutput, stats *RunStats) error {
+
+	if router != nil {
+		named := newNamedOutputEmitter(&recordCountEmitter{router, &stats.OutputRecords}, pid, partition, stats)
+		reducer(mrjob, r, contextRecordReader(ctx, readLineKeyValue), named, stdReporter)
+		return named.closeNamed()
+	}
+
+	rout, err := createOutputFile(outputFileName(pid, partition))
+	if err != nil {
+		return err
+	}
+	cw := &countingWriter{w: rout}
+	var w io.Writer = cw
+	var gz *gzip.Writer
+	if optCompressOutput {
+		gz = newGzipWriter(cw)
+		w = gz
+	}
+	rEmit := newOutputEmitter(bufio.NewWriter(w))
+	named := newNamedOutputEmitter(&recordCountEmitter{rEmit, &stats.OutputRecords}, pid, partition, stats)
+	reducer(mrjob, r, contextRecordReader(ctx, readLineKeyValue), named, stdReporter)
+	nerr := named.closeNamed()
+	rEmit.Close()
+	// the gzip trailer must be written before the file is closed
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			rout.Close()
+			return err
+		}
+	}
+	if err := closeOutputFile(rout); err != nil {
+		return err
+	}
+	atomic.AddInt64(&stats.OutputBytes, cw.n)
+
+	return nerr
+}
+
+// outputFileName returns the name of the reduce output file for a partition, in --output-dir
+func outputFileName(pid int, partition int) string {
+	fname := filepath.Join(optOutputDir, fmt.Sprintf("red-out-p%d.%04d%s", pid, partition, outputExt()))
+	if optCompressOutput {
+		fname += ".gz"
+	}
+	return fname
+}
+
+// outputExt returns the --output-ext for output file names, with its leading dot
+func outputExt() string {
+	if optOutputExt == "" || strings.HasPrefix(optOutputExt, ".") {
+		return optOutputExt
+	}
+	return "." + optOutputExt
+}
+
+// contextReader reads from r until ctx is done or the run has failed, and then reports end of file
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
 }
 
-// Main runs the map reduce job passed in
+func (c *contextReader) Read(p []byte) (int, error) {
+	if stopped(c.ctx) != nil {
+		return 0, io.EOF
+	}
+	return c.r.Read(p)
+}
+
+// contextRecordReader reads records with read until ctx is done or the run
+// has failed, and then reports end of file.  It checks before every record,
+// as the reducer's buffer may already hold the rest of the partition.
+func contextRecordReader(ctx context.Context, read RecordReader) RecordReader {
+	return func(br *bufio.Reader) (*KeyValue, error) {
+		if stopped(ctx) != nil {
+			return nil, io.EOF
+		}
+		return read(br)
+	}
+}
+
+// removeTempFiles removes the spill, sort and ValueBuffer files of the run
+// pid, after it is aborted, unless --keep-temp is set
+func removeTempFiles(pid int) {
+	if optKeepTemp {
+		return
+	}
+	for _, pattern := range []string{filepath.Join(optTmpDir, fmt.Sprintf("tmp-map-out-p%d-f*", pid)), reduceInputGlob(pid), filepath.Join(optTmpDir, fmt.Sprintf("tmp-values-p%d-*", pid))} {
+		fns, _ := filepath.Glob(pattern)
+		for _, fn := range fns {
+			os.Remove(fn)
+		}
+	}
+}
+
+// stdoutWriter writes output to stdout.  If the reader has gone away, as
+// when the output is piped to head, there's no point in carrying on, so it
+// stops the run with errBrokenPipe.
+type stdoutWriter struct{}
+
+// errBrokenPipe is the error a run stops with when the reader of its output
+// has gone away.  It isn't a failure of the job, so Main exits with success.
+var errBrokenPipe = errors.New("output pipe closed by its reader")
+
+// newStdoutWriter returns a stdoutWriter.  SIGPIPE is caught so that writing
+// to a closed pipe fails with EPIPE instead of killing the process.
+func newStdoutWriter() stdoutWriter {
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+	return stdoutWriter{}
+}
+
+func (stdoutWriter) Write(p []byte) (int, error) {
+	n, err := os.Stdout.Write(p)
+	if errors.Is(err, syscall.EPIPE) {
+		fail(errBrokenPipe)
+		return n, errBrokenPipe
+	}
+	return n, err
+}
+
+// openStdin opens stdin as a mapper input.  It can only be read once, so
+// giving "-" more than once maps it only the first time.
+func openStdin() (io.ReadCloser, error) {
+	return ioutil.NopCloser(os.Stdin), nil
+}
+
+// parsePartitions parses a --partitions-only list such as "2,5".  An empty list means all n partitions.
+func parsePartitions(list string, n int) ([]int, error) {
+
+	if list == "" {
+		all := make([]int, n)
+		for i := range all {
+			all[i] = i
+		}
+		return all, nil
+	}
+
+	var partitions []int
+	seen := make(map[int]bool)
+	for _, field := range strings.Split(list, ",") {
+		p, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || p < 0 || p >= n {
+			return nil, fmt.Errorf("bad partition %q in --partitions-only: must be 0 to %d", field, n-1)
+		}
+		if !seen[p] {
+			seen[p] = true
+			partitions = append(partitions, p)
+		}
+	}
+	return partitions, nil
+}
+
+// TempFileFunc creates the intermediate files of a --mapreduce run: the map
+// spill files and the sorted reduce input, and the spill files of
+// ValueBuffers.  Replace it to control how they are created, e.g. in a
+// sandbox with restricted file creation; the files must be opened for
+// reading and writing.  The default creates the named file, failing if it
+// already exists.
+var TempFileFunc = createExclusive
+
+func createExclusive(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+// jobID is the number in the names of the run's temp and output files: the
+// --job-id if one was given, or the pid
+func jobID() int {
+	if optJobID != 0 {
+		return optJobID
+	}
+	return os.Getpid()
+}
+
+// spillTemplate is the base name for the spill files of the index'th map
+// task.  Each emitter must be given a distinct index; within an emitter the
+// spill files are distinguished by partition and roll-over number.
+func spillTemplate(pid int, index int) string {
+	return filepath.Join(optTmpDir, fmt.Sprintf("tmp-map-out-p%d-f%d", pid, index))
+}
+
+// spillGlob matches all the map spill files for a partition, including rolled-over ones
+func spillGlob(pid int, partition int) string {
+	return filepath.Join(optTmpDir, fmt.Sprintf("tmp-map-out-p%d-f*.%04d", pid, partition))
+}
+
+// valueFileName returns the name of the n'th ValueBuffer spill file of the run pid
+func valueFileName(pid int, n int64) string {
+	return filepath.Join(optTmpDir, fmt.Sprintf("tmp-values-p%d-%d", pid, n))
+}
+
+// reduceInputName returns the name of the sorted reduce input file for a partition
+func reduceInputName(pid int, partition int) string {
+	return filepath.Join(optTmpDir, fmt.Sprintf("tmp-red-in-p%d.%04d", pid, partition))
+}
+
+// reduceInputGlob matches the sorted reduce input files of every partition
+func reduceInputGlob(pid int) string {
+	return filepath.Join(optTmpDir, fmt.Sprintf("tmp-red-in-p%d.*", pid))
+}
+
+// Main runs the map reduce job passed in.  If the job fails, it prints the
+// error to stderr and exits.  A run stopped because the reader of its output
+// went away, as with head, isn't a failure.
 func Main(mrjob MapReduceJob) {
+	if _, err := Run(mrjob); err != nil && !errors.Is(err, errBrokenPipe) {
+		fatal(err)
+	}
+}
+
+// Run runs the map reduce job passed in, in the mode chosen by the command
+// line flags, and returns the number of records it wrote and any error in
+// the job's setup or the run, for programs which want to handle them
+// themselves.  A run which fails part way through, e.g. because it can't
+// create a file, stops at the next record and returns the error once it has
+// removed its temp files.
+func Run(mrjob MapReduceJob) (int64, error) {
 
 	if optDoMapReduce {
-		mapreduce(mrjob)
-		return
+		return RunContext(context.Background(), mrjob)
 	}
 
+	if err := Validate(mrjob); err != nil {
+		return 0, err
+	}
+
+	resetFailure()
+
 	if optDoMap && optDoReduce {
-		fmt.Println("can either map or reduce, not both. (Did  you mean --mapreduce ?)")
-		os.Exit(1)
+		return 0, errors.New("cannot set both --mapper and --reducer (did you mean --mapreduce?)")
 	}
 
 	if !optDoMap && !optDoReduce {
-		fmt.Println("neither map nor reduce nor secondary key reduce called")
-		os.Exit(1)
+		return 0, errors.New("no phase selected: give one of --mapper, --reducer or --mapreduce")
 	}
 
-	stdout := bufio.NewWriter(os.Stdout)
+	stdout := bufio.NewWriter(newStdoutWriter())
 
-	emitter := newPrintEmitter(stdout)
+	var emitter Emitter = newMapOutputEmitter(stdout)
+	if optDoReduce {
+		emitter = newOutputEmitter(stdout)
+		if optOutputPerKey != "" {
+			kf, err := newKeyFileEmitter(optOutputPerKey, optMaxOpenFiles)
+			if err != nil {
+				return 0, err
+			}
+			emitter = kf
+		}
+	}
+	if optLineBuffered {
+		emitter = &lineFlushEmitter{emitter}
+	}
+
+	var records int64
+	emitter = &recordCountEmitter{emitter, &records}
 
 	if optDoMap {
-		mapper(mrjob, os.Stdin, emitter)
+		stop := stdReporter.heartbeat(optHeartbeatInterval, "map")
+		mapper(mrjob, os.Stdin, mapReader(), emitter, stdReporter)
 		// handle any finalization from the mapper
-		mapperFinal(mrjob, emitter)
+		mapperFinal(mrjob, emitter, stdReporter)
+		stop()
 	}
 
 	if optDoReduce {
-		reducer(mrjob, os.Stdin, emitter)
+		stop := stdReporter.heartbeat(optHeartbeatInterval, "reduce")
+		reducer(mrjob, os.Stdin, reduceReader(), emitter, stdReporter)
+		stop()
 	}
 
-	emitter.Flush()
+	emitter.Close()
+	stdReporter.Flush()
+
+	if err := failed(); err != nil {
+		return records, err
+	}
+
+	return records, checkRecordCount(records)
 }
 
-// run the mapping phase, calling the map routine on key/value pairs from the Reader
-// The users' Map routine will write any key/value pairs generated to the Emitter
-func mapper(mrjob MapReduceJob, r io.Reader, emitter Emitter) {
+// checkRecordCount fails the run if --expect-records was given and the job wrote a different number of records
+func checkRecordCount(n int64) error {
+	if optExpectRecords >= 0 && n != optExpectRecords {
+		return fmt.Errorf("expected %d output records, got %d", optExpectRecords, n)
+	}
+	return nil
+}
+
+// ErrMalformedRecord is returned, wrapped, by a --strict run which meets a record it can't decode
+var ErrMalformedRecord = errors.New("malformed record")
+
+// badRecord is called when a record can't be decoded.
+// In --strict mode it fails the run, otherwise the record is skipped.
+func badRecord(err error) {
+	atomic.AddInt64(&malformedRecords, 1)
+	if optStrict {
+		fail(fmt.Errorf("%w: %v", ErrMalformedRecord, err))
+	}
+}
+
+// the error which stopped the run, from code which has no way to return it,
+// such as a protocol called from Map.  The runner checks for it between
+// records, and returns it once it has cleaned up.
+var failureMu sync.Mutex
+var failure error
+
+// fail stops the run with err, unless it has already been stopped
+func fail(err error) {
+	failureMu.Lock()
+	if failure == nil {
+		failure = err
+	}
+	failureMu.Unlock()
+}
+
+// failed returns the error the run was stopped with, or nil
+func failed() error {
+	failureMu.Lock()
+	defer failureMu.Unlock()
+	return failure
+}
+
+// resetFailure clears the error of an earlier run, before starting a new one
+func resetFailure() {
+	failureMu.Lock()
+	failure = nil
+	failureMu.Unlock()
+}
+
+// stopped returns why a --mapreduce run should stop: ctx is done or the run has failed
+func stopped(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return failed()
+}
+
+var malformedRecords int64
+
+// MalformedRecords returns the number of records so far which couldn't be
+// decoded and were skipped, whether reading input or in a protocol's
+// UnmarshalKVs
+func MalformedRecords() int64 {
+	return atomic.LoadInt64(&malformedRecords)
+}
+
+// fatal reports an error which leaves the job unable to continue and exits
+func fatal(err error) {
+	stdReporter.Flush()
+	fmt.Fprintln(os.Stderr, "dmrgo:", err)
+	os.Exit(1)
+}
+
+// run the mapping phase, calling the map routine on key/value pairs read from the Reader by read.
+// The users' Map routine will write any key/value pairs generated to the Emitter,
+// which gives it access to the Reporter.
+func mapper(mrjob MapReduceJob, r io.Reader, read RecordReader, emitter Emitter, reporter *Reporter) {
 
 	br := bufio.NewReader(r)
+	emitter = &reportingEmitter{emitter, reporter}
 
-	for {
-		kv, err := readLineValue(br)
+	if s, ok := mrjob.(MapSetuper); ok {
+		s.MapSetup(emitter)
+	}
+
+	for failed() == nil {
+		kv, err := read(br)
 		if err != nil {
+			if err != io.EOF {
+				badRecord(err)
+			}
 			break
 		}
 
-		mrjob.Map("", kv.Value, emitter)
+		if m, ok := mrjob.(ErrorMapper); ok {
+			tryMap(m, kv.ReduceKey, kv.Value, emitter)
+			continue
+		}
+
+		mrjob.Map(kv.ReduceKey, kv.Value, emitter)
 	}
 }
 
 // run the cleanup phase for the mapper
-func mapperFinal(mrjob MapReduceJob, emitter Emitter) {
-	mrjob.MapFinal(emitter)
+func mapperFinal(mrjob MapReduceJob, emitter Emitter, reporter *Reporter) {
+	mrjob.MapFinal(&reportingEmitter{emitter, reporter})
 }
 
-// run the reduce phase, calling the reduce routine on key/[]value read the Reader.
+// run the reduce phase, calling the reduce routine on key/[]value read from the Reader by read.
 // We aggregate the values that have been mapped with the same key, then call the users' Reduce function.
 // The users' Reduce routine will output any key/value pairs via the Emitter.
-func reducer(mrjob MapReduceJob, r io.Reader, emitter Emitter) {
+func reducer(mrjob MapReduceJob, r io.Reader, read RecordReader, emitter Emitter, reporter *Reporter) {
 
 	br := bufio.NewReader(r)
 
+	if optRawReduce {
+		rawEmitter := &reportingEmitter{emitter, reporter}
+		if s, ok := mrjob.(ReduceSetuper); ok {
+			s.ReduceSetup(rawEmitter)
+			defer s.ReduceTeardown(rawEmitter)
+		}
+		rawReducer(mrjob, br, rawEmitter)
+		return
+	}
+
 	var currentReduceKey string
 	var values chan string
 
 	isFirstRun := true
-	var done chan bool
+	var done chan struct{}
 
-	for {
+	// in --keys-only mode we write the keys ourselves and throw away what Reduce emits
+	reduceEmitter := emitter
+	if optKeysOnly {
+		reduceEmitter = new(nullEmitter)
+	}
+	reduceEmitter = &reportingEmitter{reduceEmitter, reporter}
+
+	if s, ok := mrjob.(ReduceSetuper); ok {
+		s.ReduceSetup(reduceEmitter)
+		defer s.ReduceTeardown(reduceEmitter)
+	}
 
-		mkv, err := readLineKeyValue(br)
+	var skew *skewTracker
+	if optSkewThreshold > 0 {
+		skew = newSkewTracker(optSkewThreshold)
+	}
+	var groupRecords int64
+
+	// with --check-groups, the keys which have been reduced
+	var seenGroups map[string]bool
+	if optCheckGroups {
+		seenGroups = make(map[string]bool)
+	}
+
+	for failed() == nil {
+
+		mkv, err := read(br)
 		if err != nil {
+			if err != io.EOF {
+				badRecord(err)
+			}
 			break
 		}
 
-		if currentReduceKey != mkv.ReduceKey || isFirstRun {
+		mkv.ReduceKey = normalizeKey(mkv.ReduceKey)
+		mkv.SortKey = unpadSortKey(mkv.SortKey)
+		groupKey := mkv.ReduceKey
+		if GroupKey != nil {
+			groupKey = GroupKey(mkv.ReduceKey)
+		}
+
+		if currentReduceKey != groupKey || isFirstRun {
+			if seenGroups != nil {
+				if seenGroups[groupKey] {
+					fail(fmt.Errorf("reduce key %q appears in more than one group: the reduce input isn't sorted as expected (sort with LC_ALL=C)", groupKey))
+					break
+				}
+				seenGroups[groupKey] = true
+			}
 			if !isFirstRun {
 				close(values)
 				<-done
+				if skew != nil {
+					skew.endGroup(currentReduceKey, groupRecords)
+				}
+				if optGroupSentinel != "" {
+					emitSentinel(emitter, optGroupSentinel)
+				}
 			}
 			isFirstRun = false
+			groupRecords = 0
 			values = make(chan string, 64)
-			done = make(chan bool)
-			go func() {
-				mrjob.Reduce(mkv.ReduceKey, mkv.SortKey, values, emitter)
-				done <- true
-				close(done)
-			}()
-			currentReduceKey = mkv.ReduceKey
-		}
-		values <- mkv.Value
+			done = make(chan struct{})
+			go func(done chan struct{}) {
+				defer close(done)
+				if r, ok := mrjob.(ErrorReducer); ok {
+					tryReduce(r, groupKey, mkv.SortKey, values, reduceEmitter)
+					return
+				}
+				if r, ok := mrjob.(TypedReducer); ok {
+					typedReduce(r, groupKey, mkv.SortKey, values, reduceEmitter)
+					return
+				}
+				mrjob.Reduce(groupKey, mkv.SortKey, values, reduceEmitter)
+			}(done)
+			currentReduceKey = groupKey
+			if optKeysOnly {
+				emitKeyOnly(emitter, groupKey)
+			}
+		}
+
+		groupRecords++
+
+		// if Reduce has already returned, nobody is reading the values
+		select {
+		case values <- mkv.Value:
+		case <-done:
+		}
+	}
+
+	if !isFirstRun {
+		close(values)
+		<-done
+		if skew != nil {
+			skew.endGroup(currentReduceKey, groupRecords)
+		}
+		if optGroupSentinel != "" {
+			emitSentinel(emitter, optGroupSentinel)
+		}
+	}
+
+	if skew != nil {
+		skew.report(os.Stderr)
+	}
+}
+
+// run the reduce phase without parsing keys: every input line is passed
+// as-is to a single Reduce call with an empty key.  Useful for inspecting
+// misformatted reducer input.
+func rawReducer(mrjob MapReduceJob, br *bufio.Reader, emitter Emitter) {
+
+	values := make(chan string, 64)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		mrjob.Reduce("", "", values, emitter)
+	}()
+
+	for {
+		kv, err := readLineValue(br)
+		if err != nil {
+			break
+		}
+
+		select {
+		case values <- kv.Value:
+		case <-done:
+		}
 	}
 
 	close(values)
@@ -0,0 +1,1834 @@
+package dmrgo
+
+// Tests for the job runner
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setOpt sets an option for the rest of the test
+func setOpt[T any](t testing.TB, opt *T, v T) {
+	t.Helper()
+	old := *opt
+	*opt = v
+	t.Cleanup(func() { *opt = old })
+}
+
+// testJobID is the --job-id of the runs started by runTestJob, so the test knows its file names
+const testJobID = 4242
+
+// setupTestRun points the temp and output files of a --mapreduce run at a
+// fresh directory, writes input there and makes it the run's input file.
+// It returns the directory.
+func setupTestRun(t *testing.T, input string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	setOpt(t, &optTmpDir, dir)
+	setOpt(t, &optOutputDir, dir)
+	setOpt(t, &optJobID, testJobID)
+	setOpt(t, &optNumPartitions, 1)
+
+	fname := filepath.Join(dir, "input.txt")
+	if err := os.WriteFile(fname, []byte(input), 0666); err != nil {
+		t.Fatal(err)
+	}
+	setArgs(t, fname)
+
+	return dir
+}
+
+// setArgs sets the command line arguments -- the input files -- for the rest of the test
+func setArgs(t testing.TB, args ...string) {
+	t.Helper()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.CommandLine.Parse(nil) })
+}
+
+// runTestJob runs mrjob with RunContext over input and returns the lines of its output, partition by partition
+func runTestJob(t *testing.T, mrjob MapReduceJob, input string) []string {
+	t.Helper()
+
+	setupTestRun(t, input)
+
+	if _, err := RunContext(context.Background(), mrjob); err != nil {
+		t.Fatalf("RunContext: %v", err)
+	}
+
+	return readOutput(t, testJobID)
+}
+
+// readOutput returns the lines of the reduce output files of the run pid
+func readOutput(t testing.TB, pid int) []string {
+	t.Helper()
+
+	var lines []string
+	for p := 0; p < optNumPartitions; p++ {
+		b, err := os.ReadFile(outputFileName(pid, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 0 {
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")...)
+		}
+	}
+	return lines
+}
+
+// tempFiles returns the spill and sort files left in dir
+func tempFiles(t testing.TB, dir string) []string {
+	t.Helper()
+	fns, err := filepath.Glob(filepath.Join(dir, "tmp-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(fns)
+	return fns
+}
+
+// globSpills returns the map spill files of a partition of the run pid
+func globSpills(t testing.TB, pid int, partition int) []string {
+	t.Helper()
+	fns, err := filepath.Glob(spillGlob(pid, partition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(fns)
+	return fns
+}
+
+// sortKeyJob's input lines are "reduceKey sortKey"; Reduce emits the sort keys for each reduce key in the order they arrive
+type sortKeyJob struct{}
+
+func (*sortKeyJob) Map(key string, value string, emitter Emitter) {
+	f := strings.Fields(value)
+	emitter.Emit(f[0], f[1], f[1])
+}
+
+func (*sortKeyJob) MapFinal(emitter Emitter) {}
+
+func (*sortKeyJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	var vs []string
+	for v := range values {
+		vs = append(vs, v)
+	}
+	emitter.Emit(reduceKey, "", strings.Join(vs, " "))
+}
+
+func TestSecondarySort(t *testing.T) {
+
+	// "a!" is written "a%21", which sorts between "a" and "a,1" unless the sort splits at the comma
+	input := "b 3\na 2\nb 1\na! 1\na 3\nb 2\na 1\n"
+
+	var tests = []struct {
+		goSort    bool
+		secondary bool
+	}{
+		{false, true},
+		{true, true},
+		{false, false},
+		{true, false},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optGoSort, tt.goSort)
+		setOpt(t, &optSecondaryKey, tt.secondary)
+
+		got := runTestJob(t, new(sortKeyJob), input)
+
+		want := []string{"a\t1 2 3", "a%21\t1", "b\t1 2 3"}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("goSort=%v secondary=%v: got %q, want %q", tt.goSort, tt.secondary, got, want)
+		}
+	}
+}
+
+func TestSortKeyInMapperOutput(t *testing.T) {
+
+	var tests = []struct {
+		reduceKey, sortKey string
+		want               string
+	}{
+		{"a", "", "a\tv\n"},
+		{"a", "s", "a,s\tv\n"},
+		{"a b", "x,y", "a+b,x%2Cy\tv\n"},
+	}
+
+	for _, secondary := range []bool{false, true} {
+		setOpt(t, &optSecondaryKey, secondary)
+		for _, tt := range tests {
+			var sb strings.Builder
+			w := bufio.NewWriter(&sb)
+			e := newMapOutputEmitter(w)
+			e.Emit(tt.reduceKey, tt.sortKey, "v")
+			e.Flush()
+			if sb.String() != tt.want {
+				t.Errorf("secondary=%v Emit(%q, %q)=%q, want %q", secondary, tt.reduceKey, tt.sortKey, sb.String(), tt.want)
+			}
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+
+	var tests = []struct {
+		name      string
+		mapper    bool
+		reducer   bool
+		mapreduce bool
+		want      string
+	}{
+		{"both phases", true, true, false, "cannot set both --mapper and --reducer"},
+		{"no phase", false, false, false, "no phase selected"},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optDoMap, tt.mapper)
+		setOpt(t, &optDoReduce, tt.reducer)
+		setOpt(t, &optDoMapReduce, tt.mapreduce)
+
+		_, err := Run(new(sortKeyJob))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Run()=%v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRunContextInputErrors(t *testing.T) {
+
+	var tests = []struct {
+		name           string
+		args           func(dir string) []string
+		partitionsOnly string
+	}{
+		{"missing input", func(dir string) []string {
+			return []string{filepath.Join(dir, "input.txt"), filepath.Join(dir, "missing.txt")}
+		}, ""},
+		{"missing zip", func(dir string) []string { return []string{filepath.Join(dir, "missing.zip")} }, ""},
+		{"bad partitions", func(dir string) []string { return []string{filepath.Join(dir, "input.txt")} }, "7"},
+	}
+
+	for _, tt := range tests {
+		dir := setupTestRun(t, "a 1\n")
+		setArgs(t, tt.args(dir)...)
+		setOpt(t, &optPartitionsOnly, tt.partitionsOnly)
+
+		if _, err := RunContext(context.Background(), new(sortKeyJob)); err == nil {
+			t.Errorf("%s: RunContext succeeded", tt.name)
+		}
+		if fns := tempFiles(t, dir); len(fns) != 0 {
+			t.Errorf("%s: temp files left behind: %q", tt.name, fns)
+		}
+	}
+}
+
+// badPartitionJob's partitioner sends every key to a partition which doesn't exist
+type badPartitionJob struct {
+	sortKeyJob
+}
+
+func (*badPartitionJob) Partition(reduceKey string, numPartitions uint) uint {
+	return numPartitions
+}
+
+func TestRunContextFailureCleanup(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		job      MapReduceJob
+		setup    func(t *testing.T)
+		keepTemp bool
+	}{
+		{"sort fails", new(sortKeyJob), func(t *testing.T) {
+			setOpt(t, &optGoSort, false)
+			setOpt(t, &optSortArgs, "--no-such-option")
+		}, false},
+		{"sort fails, keeping temp files", new(sortKeyJob), func(t *testing.T) {
+			setOpt(t, &optGoSort, false)
+			setOpt(t, &optSortArgs, "--no-such-option")
+		}, true},
+		{"spill file can't be created", new(sortKeyJob), func(t *testing.T) {
+			setOpt(t, &optSpillSize, 1)
+			n := 0
+			setOpt(t, &TempFileFunc, func(name string) (*os.File, error) {
+				if n++; n > 1 {
+					return nil, os.ErrPermission
+				}
+				return createExclusive(name)
+			})
+		}, false},
+		{"bad partitioner", new(badPartitionJob), func(t *testing.T) {}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupTestRun(t, "a 1\nb 2\na 3\n")
+			setOpt(t, &optKeepTemp, tt.keepTemp)
+			tt.setup(t)
+
+			if _, err := RunContext(context.Background(), tt.job); err == nil {
+				t.Fatal("RunContext succeeded")
+			}
+
+			fns := tempFiles(t, dir)
+			if tt.keepTemp && len(fns) == 0 {
+				t.Error("temp files removed with --keep-temp")
+			}
+			if !tt.keepTemp && len(fns) != 0 {
+				t.Errorf("temp files left behind: %q", fns)
+			}
+		})
+	}
+}
+
+// captureStdout redirects os.Stdout to a file for the rest of the test, and returns a function reading what was written
+func captureStdout(t *testing.T) func() string {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	setOpt(t, &os.Stdout, f)
+	return func() string {
+		b, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+}
+
+func TestTmpAndOutputDirs(t *testing.T) {
+
+	var tests = []struct {
+		name        string
+		tmp, output string
+	}{
+		{"same dir", "files", "files"},
+		{"separate dirs", "scratch/tmp", "results/out"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestRun(t, "a\nb\na\nc\n")
+			base := t.TempDir()
+			tmp, output := filepath.Join(base, tt.tmp), filepath.Join(base, tt.output)
+			setOpt(t, &optTmpDir, tmp)
+			setOpt(t, &optOutputDir, output)
+			setOpt(t, &optNumPartitions, 2)
+			setOpt(t, &optKeepTemp, true)
+			stdout := captureStdout(t)
+
+			if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+				t.Fatalf("RunContext: %v", err)
+			}
+
+			if fns := tempFiles(t, tmp); len(fns) == 0 {
+				t.Errorf("no temp files in --tmp-dir %s", tmp)
+			}
+			if tmp != output {
+				if fns := tempFiles(t, output); len(fns) != 0 {
+					t.Errorf("temp files in --output-dir: %q", fns)
+				}
+			}
+
+			outs, err := filepath.Glob(filepath.Join(output, "red-out-*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{filepath.Join(output, "red-out-p4242.0000"), filepath.Join(output, "red-out-p4242.0001")}
+			if !reflect.DeepEqual(outs, want) {
+				t.Errorf("output files %q, want %q", outs, want)
+			}
+
+			msg := fmt.Sprintf("output is in: %s - %s\n", want[0], want[1])
+			if got := stdout(); !strings.Contains(got, msg) {
+				t.Errorf("stdout %q doesn't contain %q", got, msg)
+			}
+		})
+	}
+}
+
+func TestCheckGroups(t *testing.T) {
+
+	setOpt(t, &optCheckGroups, true)
+	defer resetFailure()
+
+	var tests = []struct {
+		input string
+		fails bool
+	}{
+		{"a\t1\na\t2\nb\t3\n", false},
+		{"a\t1\nb\t2\na\t3\n", true},
+	}
+
+	for _, tt := range tests {
+		resetFailure()
+		reducer(new(sortKeyJob), strings.NewReader(tt.input), readLineKeyValue, new(nullEmitter), stdReporter)
+		if err := failed(); (err != nil) != tt.fails {
+			t.Errorf("reducing %q: failed()=%v, want failure %v", tt.input, err, tt.fails)
+		}
+	}
+}
+
+func TestCheckGroupsUnsorted(t *testing.T) {
+
+	// a stub sort which doesn't sort, as if it collated differently, splitting the groups
+	bin := t.TempDir()
+	script := "#!/bin/sh\nfor a in \"$@\"; do if [ -f \"$a\" ]; then cat \"$a\"; fi; done\n"
+	if err := os.WriteFile(filepath.Join(bin, "sort"), []byte(script), 0777); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setOpt(t, &optGoSort, false)
+	defer resetFailure()
+
+	var tests = []struct {
+		checkGroups bool
+		want        []string
+	}{
+		// the split key is silently reduced twice
+		{false, []string{"a\t1", "b\t1", "a\t1"}},
+		{true, nil},
+	}
+
+	for _, tt := range tests {
+		setupTestRun(t, "a\nb\na\n")
+		setOpt(t, &optCheckGroups, tt.checkGroups)
+
+		_, err := RunContext(context.Background(), new(countJob))
+		if tt.checkGroups {
+			if err == nil || !strings.Contains(err.Error(), "more than one group") {
+				t.Errorf("checkGroups=%v: RunContext error %v, want a split group", tt.checkGroups, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("checkGroups=%v: RunContext: %v", tt.checkGroups, err)
+		}
+		if got := readOutput(t, testJobID); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("checkGroups=%v: got %q, want %q", tt.checkGroups, got, tt.want)
+		}
+	}
+}
+
+// mapArgsJob records the keys and values passed to Map
+type mapArgsJob struct {
+	nullJob
+	got []KeyValue
+}
+
+func (j *mapArgsJob) Map(key string, value string, emitter Emitter) {
+	j.got = append(j.got, KeyValue{key, "", value})
+}
+
+func TestMapInputKeyed(t *testing.T) {
+
+	const input = "a\t1\nb+c\t2\t3\nd\n"
+
+	var tests = []struct {
+		keyed bool
+		want  []KeyValue
+	}{
+		{false, []KeyValue{{"", "", "a\t1"}, {"", "", "b+c\t2\t3"}, {"", "", "d"}}},
+		{true, []KeyValue{{"a", "", "1"}, {"b c", "", "2\t3"}, {"d", "", ""}}},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optMapInputKeyed, tt.keyed)
+
+		job := new(mapArgsJob)
+		mapper(job, strings.NewReader(input), mapReader(), new(nullEmitter), stdReporter)
+		if !reflect.DeepEqual(job.got, tt.want) {
+			t.Errorf("keyed=%v: Map got %q, want %q", tt.keyed, job.got, tt.want)
+		}
+	}
+}
+
+// recordEmitter returns an Emitter which appends the records emitted to kvs
+func recordEmitter(kvs *[]KeyValue) Emitter {
+	return NewFuncEmitter(func(kv *KeyValue) { *kvs = append(*kvs, *kv) })
+}
+
+// joinJob's Map emits each line's value with the line as the key.  Reduce
+// emits each key's values joined with "|", and counts the calls.
+type joinJob struct {
+	calls int64
+}
+
+func (*joinJob) Map(key string, value string, emitter Emitter) {
+	emitter.Emit(value, "", value)
+}
+
+func (*joinJob) MapFinal(emitter Emitter) {}
+
+func (j *joinJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	atomic.AddInt64(&j.calls, 1)
+	var vs []string
+	for v := range values {
+		vs = append(vs, v)
+	}
+	emitter.Emit(reduceKey, sortKey, strings.Join(vs, "|"))
+}
+
+func TestRawReduce(t *testing.T) {
+
+	var tests = []struct {
+		raw   bool
+		calls int64
+		want  []KeyValue
+	}{
+		{false, 2, []KeyValue{{"a", "", "1|2"}, {"b", "", "3"}}},
+		{true, 1, []KeyValue{{"", "", "a\t1|a\t2|b\t3"}}},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optRawReduce, tt.raw)
+
+		job := new(joinJob)
+		var got []KeyValue
+		reducer(job, strings.NewReader("a\t1\na\t2\nb\t3\n"), readLineKeyValue, recordEmitter(&got), stdReporter)
+
+		if job.calls != tt.calls {
+			t.Errorf("raw=%v: %d Reduce calls, want %d", tt.raw, job.calls, tt.calls)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("raw=%v: got %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+
+	var buf bytes.Buffer
+	flag.CommandLine.SetOutput(&buf)
+	defer flag.CommandLine.SetOutput(nil)
+
+	flag.Usage()
+	prog := filepath.Base(os.Args[0])
+
+	var tests = []string{
+		"Usage: " + prog + " [options] [input files]",
+		"cannot be\ngiven together",
+		"cat input.txt | " + prog + " --mapper | sort | " + prog + " --reducer",
+		prog + " --mapreduce --partitions 8",
+		`-mapper "` + prog + ` --mapper" -reducer "` + prog + ` --reducer"`,
+		"Options:",
+		"-mapreduce",
+		"-spill-size",
+	}
+
+	for _, want := range tests {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("usage doesn't contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+// writeZip writes a zip archive of the named members to fname
+func writeZip(t testing.TB, fname string, members map[string]string) {
+	t.Helper()
+
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, contents := range members {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZipInput(t *testing.T) {
+
+	var tests = []struct {
+		name    string
+		members map[string]string
+		mappers int
+		want    []string
+	}{
+		{"two members", map[string]string{"a.txt": "x\ny\n", "b.txt": "x\nz\n"}, 2, []string{"x\t2", "y\t1", "z\t1"}},
+		{"directory and empty member", map[string]string{"dir/": "", "dir/a.txt": "x\n", "empty.txt": ""}, 1, []string{"x\t1"}},
+	}
+
+	for _, tt := range tests {
+		dir := setupTestRun(t, "")
+		setOpt(t, &optKeepTemp, true)
+
+		fname := filepath.Join(dir, "input.zip")
+		writeZip(t, fname, tt.members)
+		setArgs(t, fname)
+
+		if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+			t.Fatalf("%s: RunContext: %v", tt.name, err)
+		}
+
+		got := readOutput(t, testJobID)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+
+		// each member is mapped on its own, into its own spill file
+		if spills := globSpills(t, testJobID, 0); len(spills) != tt.mappers {
+			t.Errorf("%s: spill files %q, want %d", tt.name, spills, tt.mappers)
+		}
+	}
+}
+
+// pointJob's input is JSON Lines of points; it counts the points mapped and sums their X by Y
+type pointJob struct {
+	mapped  int
+	jsonMap func(key string, value string, emitter Emitter)
+}
+
+func newPointJob() *pointJob {
+	j := new(pointJob)
+	j.jsonMap = JSONLinesMap(func(p point, emitter Emitter) {
+		j.mapped++
+		emitter.Emit(strconv.Itoa(p.Y), "", strconv.Itoa(p.X))
+	})
+	return j
+}
+
+func (j *pointJob) Map(key string, value string, emitter Emitter) {
+	j.jsonMap(key, value, emitter)
+}
+
+func (*pointJob) MapFinal(emitter Emitter) {}
+
+func (*pointJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	sum := 0
+	for v := range values {
+		n, _ := strconv.Atoi(v)
+		sum += n
+	}
+	emitter.Emit(reduceKey, "", strconv.Itoa(sum))
+}
+
+func TestStrict(t *testing.T) {
+
+	input := `{"X":1,"Y":1}
+{"X":
+{"X":2,"Y":1}
+{"X":3,"Y":2}
+`
+
+	var tests = []struct {
+		strict bool
+		mapped int
+		want   []string
+	}{
+		{false, 3, []string{"1\t3", "2\t3"}},
+		{true, 1, nil},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optStrict, tt.strict)
+
+		setupTestRun(t, input)
+		job := newPointJob()
+		_, err := RunContext(context.Background(), job)
+
+		if tt.strict != errors.Is(err, ErrMalformedRecord) {
+			t.Errorf("strict=%v: RunContext()=%v, want ErrMalformedRecord %v", tt.strict, err, tt.strict)
+		}
+		// --strict stops at the first bad line
+		if job.mapped != tt.mapped {
+			t.Errorf("strict=%v: mapped %d records, want %d", tt.strict, job.mapped, tt.mapped)
+		}
+		if err == nil {
+			if got := readOutput(t, testJobID); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("strict=%v: got %q, want %q", tt.strict, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestGroupKey(t *testing.T) {
+
+	setOpt(t, &GroupKey, func(reduceKey string) string {
+		return strings.SplitN(reduceKey, ":", 2)[0]
+	})
+
+	input := "u2:03\nu1:02\nu3:01\nu1:03\nu2:01\nu1:01\nu2:02\n"
+
+	var tests = []struct {
+		partitions int
+		goSort     bool
+	}{
+		{1, false},
+		{4, false},
+		{4, true},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optGoSort, tt.goSort)
+		setupTestRun(t, input)
+		setOpt(t, &optNumPartitions, tt.partitions)
+
+		job := new(joinJob)
+		if _, err := RunContext(context.Background(), job); err != nil {
+			t.Fatalf("RunContext: %v", err)
+		}
+
+		// one Reduce call per user, seeing its keys in timestamp order
+		got := readOutput(t, testJobID)
+		sort.Strings(got)
+		want := []string{"u1\tu1:01|u1:02|u1:03", "u2\tu2:01|u2:02|u2:03", "u3\tu3:01"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d partitions, goSort=%v: got %q, want %q", tt.partitions, tt.goSort, got, want)
+		}
+	}
+}
+
+// firstValueJob's Reduce emits the first value for each key and returns without reading the rest
+type firstValueJob struct {
+	joinJob
+}
+
+func (*firstValueJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	emitter.Emit(reduceKey, "", <-values)
+}
+
+func TestReduceReturnsEarly(t *testing.T) {
+
+	// many more values than the channel buffers
+	var input strings.Builder
+	for _, k := range []string{"a", "b"} {
+		for i := 0; i < 1000; i++ {
+			fmt.Fprintf(&input, "%s\t%d\n", k, i)
+		}
+	}
+
+	var tests = []struct {
+		raw  bool
+		want []KeyValue
+	}{
+		{false, []KeyValue{{"a", "", "0"}, {"b", "", "0"}}},
+		{true, []KeyValue{{"", "", "a\t0"}}},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optRawReduce, tt.raw)
+
+		var got []KeyValue
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			reducer(new(firstValueJob), strings.NewReader(input.String()), readLineKeyValue, recordEmitter(&got), stdReporter)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("raw=%v: reducer blocked after Reduce returned", tt.raw)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("raw=%v: got %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestLineBuffered(t *testing.T) {
+
+	var tests = []struct {
+		name    string
+		mapper  bool
+		reducer bool
+		input   string
+		want    string
+	}{
+		{"mapper", true, false, "x\n", "x\tx\n"},
+		// a group is reduced once the next key arrives
+		{"reducer", false, true, "a\t1\na\t2\nb\t3\n", "a\t1|2\n"},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optDoMap, tt.mapper)
+		setOpt(t, &optDoReduce, tt.reducer)
+		setOpt(t, &optLineBuffered, true)
+		setArgs(t)
+
+		inr, inw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		outr, outw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		setOpt(t, &os.Stdin, inr)
+		setOpt(t, &os.Stdout, outw)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := Run(new(joinJob))
+			done <- err
+		}()
+
+		// the record must come out while the input is still open
+		inw.WriteString(tt.input)
+		lines := make(chan string, 1)
+		go func() {
+			line, _ := bufio.NewReader(outr).ReadString('\n')
+			lines <- line
+		}()
+
+		select {
+		case line := <-lines:
+			if line != tt.want {
+				t.Errorf("%s: read %q, want %q", tt.name, line, tt.want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("%s: no output while the input is open", tt.name)
+		}
+
+		inw.Close()
+		if err := <-done; err != nil {
+			t.Errorf("%s: Run: %v", tt.name, err)
+		}
+		outw.Close()
+		outr.Close()
+		inr.Close()
+	}
+}
+
+// finalJob is a countJob whose MapFinal also emits a record, and which
+// records the most goroutines running during a Map call
+type finalJob struct {
+	countJob
+	goroutines int64
+}
+
+func (j *finalJob) Map(key string, value string, emitter Emitter) {
+	for n := int64(runtime.NumGoroutine()); ; {
+		max := atomic.LoadInt64(&j.goroutines)
+		if n <= max || atomic.CompareAndSwapInt64(&j.goroutines, max, n) {
+			break
+		}
+	}
+	j.countJob.Map(key, value, emitter)
+}
+
+func (*finalJob) MapFinal(emitter Emitter) {
+	emitter.Emit("final", "", "1")
+}
+
+func TestMoreMappersThanInputs(t *testing.T) {
+
+	var tests = []struct {
+		mappers int
+		files   int
+	}{
+		{64, 3},
+		{64, 1},
+		{2, 5},
+	}
+
+	for _, tt := range tests {
+		dir := setupTestRun(t, "")
+		setOpt(t, &optNumMappers, tt.mappers)
+		setOpt(t, &optKeepTemp, true)
+
+		var args []string
+		for i := 0; i < tt.files; i++ {
+			fname := filepath.Join(dir, fmt.Sprintf("in%d.txt", i))
+			if err := os.WriteFile(fname, []byte("x\n"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			args = append(args, fname)
+		}
+		setArgs(t, args...)
+
+		job := new(finalJob)
+		before := runtime.NumGoroutine()
+		if _, err := RunContext(context.Background(), job); err != nil {
+			t.Fatalf("%d mappers, %d files: RunContext: %v", tt.mappers, tt.files, err)
+		}
+
+		want := []string{"final\t1", fmt.Sprintf("x\t%d", tt.files)}
+		if got := readOutput(t, testJobID); !reflect.DeepEqual(got, want) {
+			t.Errorf("%d mappers, %d files: got %q, want %q", tt.mappers, tt.files, got, want)
+		}
+
+		// a spill file for each input, and one for MapFinal
+		if spills := globSpills(t, testJobID, 0); len(spills) != tt.files+1 {
+			t.Errorf("%d mappers, %d files: spill files %q, want %d", tt.mappers, tt.files, spills, tt.files+1)
+		}
+
+		// the mappers which would have no input aren't started
+		if extra := int(job.goroutines) - before; extra >= tt.mappers && tt.mappers > tt.files {
+			t.Errorf("%d mappers, %d files: %d more goroutines while mapping", tt.mappers, tt.files, extra)
+		}
+	}
+}
+
+func TestSpillNamesDistinct(t *testing.T) {
+
+	// stdin, a file split in three, a zip member and MapFinal each spill separately
+	dir := setupTestRun(t, "x\nx\nx\n")
+	setOpt(t, &optSplitSize, 2)
+	setOpt(t, &optKeepTemp, true)
+
+	stdin, err := os.Open(filepath.Join(dir, "input.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	setOpt(t, &os.Stdin, stdin)
+
+	zname := filepath.Join(dir, "input.zip")
+	writeZip(t, zname, map[string]string{"a.txt": "x\n"})
+	setArgs(t, "-", filepath.Join(dir, "input.txt"), zname)
+
+	if _, err := RunContext(context.Background(), new(finalJob)); err != nil {
+		t.Fatalf("RunContext: %v", err)
+	}
+
+	if got, want := readOutput(t, testJobID), []string{"final\t1", "x\t7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if spills := globSpills(t, testJobID, 0); len(spills) != 6 {
+		t.Errorf("spill files %q, want 6", spills)
+	}
+}
+
+func TestSpillNotOverwritten(t *testing.T) {
+
+	setupTestRun(t, "x\n")
+	setOpt(t, &optKeepTemp, true)
+
+	// a spill file left by another run with the same pid
+	fname := spillTemplate(testJobID, 0) + ".0000"
+	if err := os.WriteFile(fname, []byte("other\t1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RunContext(context.Background(), new(countJob)); err == nil {
+		t.Error("RunContext succeeded, overwriting a spill file")
+	}
+
+	b, err := os.ReadFile(fname)
+	if err != nil || string(b) != "other\t1\n" {
+		t.Errorf("existing spill file is now %q, %v", b, err)
+	}
+}
+
+// eachValueJob's Reduce emits every value it is given, and a record of its own
+type eachValueJob struct {
+	keyValueJob
+}
+
+func (*eachValueJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	for v := range values {
+		emitter.Emit(reduceKey, "", v)
+	}
+	emitter.Emit("extra", "", "x")
+}
+
+func TestKeysOnly(t *testing.T) {
+
+	var tests = []struct {
+		keysOnly bool
+		want     []string
+	}{
+		{true, []string{"a", "b+c", "d"}},
+		{false, []string{"a\t1", "a\t2", "a\t3", "extra\tx", "b+c\t4", "b+c\t5", "extra\tx", "d\t6", "extra\tx"}},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optKeysOnly, tt.keysOnly)
+		setOpt(t, &optMapInputKeyed, true)
+
+		got := runTestJob(t, new(eachValueJob), "b+c\t5\na\t1\nd\t6\na\t2\nb+c\t4\na\t3\n")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("keysOnly=%v: got %q, want %q", tt.keysOnly, got, tt.want)
+		}
+	}
+}
+
+// openFDs returns the number of open file descriptors, or skips the test where they can't be counted
+func openFDs(t testing.TB) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("can't count open files:", err)
+	}
+	return len(fds)
+}
+
+func TestFailedMappersCloseFiles(t *testing.T) {
+
+	var tests = []struct {
+		name  string
+		input string
+	}{
+		{"first record bad", "{\"X\":\n"},
+		{"bad record after spilling", "{\"X\":1,\"Y\":1}\n{\"X\":2,\"Y\":2}\n{\"X\":\n"},
+	}
+
+	for _, tt := range tests {
+		dir := setupTestRun(t, "")
+		setOpt(t, &optNumPartitions, 8)
+		setOpt(t, &optStrict, true)
+
+		var args []string
+		for i := 0; i < 4; i++ {
+			fname := filepath.Join(dir, fmt.Sprintf("in%d.json", i))
+			if err := os.WriteFile(fname, []byte(tt.input), 0666); err != nil {
+				t.Fatal(err)
+			}
+			args = append(args, fname)
+		}
+		setArgs(t, args...)
+
+		before := openFDs(t)
+		if _, err := RunContext(context.Background(), newPointJob()); err == nil {
+			t.Fatalf("%s: RunContext succeeded", tt.name)
+		}
+		if after := openFDs(t); after != before {
+			t.Errorf("%s: %d files open before the run, %d after", tt.name, before, after)
+		}
+	}
+}
+
+func TestTempFileFunc(t *testing.T) {
+
+	var tests = []struct {
+		partitions int
+		sortToDisk bool
+	}{
+		{1, false},
+		{3, false},
+		{3, true},
+	}
+
+	for _, tt := range tests {
+		dir := setupTestRun(t, "a\nb\nc\nd\ne\n")
+		setOpt(t, &optNumPartitions, tt.partitions)
+		setOpt(t, &optSortToDisk, tt.sortToDisk)
+		setOpt(t, &optKeepTemp, true)
+
+		var mu sync.Mutex
+		var created []string
+		setOpt(t, &TempFileFunc, func(name string) (*os.File, error) {
+			mu.Lock()
+			created = append(created, name)
+			mu.Unlock()
+			return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		})
+
+		if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+			t.Fatalf("RunContext: %v", err)
+		}
+
+		// every intermediate file was created by TempFileFunc
+		sort.Strings(created)
+		if fns := tempFiles(t, dir); !reflect.DeepEqual(created, fns) {
+			t.Errorf("%d partitions, sortToDisk=%v: TempFileFunc created %q, temp files %q", tt.partitions, tt.sortToDisk, created, fns)
+		}
+		if len(created) == 0 {
+			t.Errorf("%d partitions, sortToDisk=%v: TempFileFunc not called", tt.partitions, tt.sortToDisk)
+		}
+	}
+}
+
+func TestExpectRecords(t *testing.T) {
+
+	var tests = []struct {
+		name    string
+		reducer bool
+		expect  int64
+		want    int64
+		wantErr bool
+	}{
+		{"mapreduce, not checked", false, -1, 3, false},
+		{"mapreduce, as expected", false, 3, 3, false},
+		{"mapreduce, too few", false, 4, 3, true},
+		{"mapreduce, expecting none", false, 0, 3, true},
+		{"reducer, as expected", true, 3, 3, false},
+		{"reducer, too many", true, 2, 3, true},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optExpectRecords, tt.expect)
+
+		var n int64
+		var err error
+		if tt.reducer {
+			// --reducer reads sorted map output from stdin
+			dir := setupTestRun(t, "a\t1\nb\t1\nb\t1\nc\t1\n")
+			setOpt(t, &optDoReduce, true)
+			setArgs(t)
+			in, ferr := os.Open(filepath.Join(dir, "input.txt"))
+			if ferr != nil {
+				t.Fatal(ferr)
+			}
+			out, ferr := os.Create(filepath.Join(dir, "output.txt"))
+			if ferr != nil {
+				t.Fatal(ferr)
+			}
+			setOpt(t, &os.Stdin, in)
+			setOpt(t, &os.Stdout, out)
+			n, err = Run(new(countJob))
+			in.Close()
+			out.Close()
+		} else {
+			setupTestRun(t, "a\nb\nb\nc\n")
+			n, err = RunContext(context.Background(), new(countJob))
+		}
+
+		if n != tt.want {
+			t.Errorf("%s: %d output records, want %d", tt.name, n, tt.want)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err=%v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// commentJob is a countJob which skips lines starting with "#"
+type commentJob struct {
+	countJob
+}
+
+func (j *commentJob) Map(key string, value string, emitter Emitter) {
+	if !strings.HasPrefix(value, "#") {
+		j.countJob.Map(key, value, emitter)
+	}
+}
+
+func TestEmptyInputs(t *testing.T) {
+
+	inputs := []string{"", "x\ny\n", "", "# no records\n", "x\n"}
+
+	dir := setupTestRun(t, "")
+	setOpt(t, &optNumPartitions, 3)
+	setOpt(t, &optKeepTemp, true)
+
+	var args []string
+	for i, in := range inputs {
+		fname := filepath.Join(dir, fmt.Sprintf("in%d.txt", i))
+		if err := os.WriteFile(fname, []byte(in), 0666); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, fname)
+	}
+	setArgs(t, args...)
+
+	if _, err := RunContext(context.Background(), new(commentJob)); err != nil {
+		t.Fatalf("RunContext: %v", err)
+	}
+
+	got := readOutput(t, testJobID)
+	sort.Strings(got)
+	if want := []string{"x\t2", "y\t1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	var spills []string
+	for p := 0; p < optNumPartitions; p++ {
+		spills = append(spills, globSpills(t, testJobID, p)...)
+	}
+	if len(spills) == 0 {
+		t.Fatal("no spill files")
+	}
+	for _, fn := range spills {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() == 0 {
+			t.Errorf("empty spill file %s", filepath.Base(fn))
+		}
+	}
+}
+
+func TestDecodedKeySeparators(t *testing.T) {
+
+	// keys a mapper escaped twice decode to contain separators
+	var tests = []struct {
+		line string
+		key  string
+	}{
+		{"a%09b\t1\n", "a\tb"},
+		{"a%0Ab\t1\n", "a\nb"},
+		{"a%2Cb\t1\n", "a,b"},
+		{"a%2525\t1\n", "a%25"},
+	}
+
+	for _, tt := range tests {
+		var sb strings.Builder
+		w := bufio.NewWriter(&sb)
+		var keys []string
+		reducer(new(joinJob), strings.NewReader(tt.line), readLineKeyValue, NewFuncEmitter(func(kv *KeyValue) {
+			keys = append(keys, kv.ReduceKey)
+			newOutputEmitter(w).Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+		}), stdReporter)
+		w.Flush()
+
+		if len(keys) != 1 || keys[0] != tt.key {
+			t.Errorf("%q: reduced keys %q, want %q", tt.line, keys, tt.key)
+		}
+
+		// the re-emitted record is still one line, which reads back as the same key
+		if sb.String() != tt.line {
+			t.Errorf("%q: re-emitted as %q", tt.line, sb.String())
+		}
+		kv, err := readLineKeyValue(bufio.NewReader(strings.NewReader(sb.String())))
+		if err != nil || kv.ReduceKey != tt.key || kv.Value != "1" {
+			t.Errorf("%q: read back %+v, %v", tt.line, kv, err)
+		}
+	}
+}
+
+func TestParsePartitions(t *testing.T) {
+
+	var tests = []struct {
+		list string
+		n    int
+		want []int
+		ok   bool
+	}{
+		{"", 3, []int{0, 1, 2}, true},
+		{"2", 8, []int{2}, true},
+		{"2,5", 8, []int{2, 5}, true},
+		{" 5 , 2,5", 8, []int{5, 2}, true},
+		{"8", 8, nil, false},
+		{"-1", 8, nil, false},
+		{"2,", 8, nil, false},
+		{"two", 8, nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePartitions(tt.list, tt.n)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePartitions(%q, %d)=%v, %v, want %v", tt.list, tt.n, got, err, tt.want)
+		}
+	}
+}
+
+func TestPartitionsOnly(t *testing.T) {
+
+	const partitions = 4
+
+	var tests = []struct {
+		name string
+		only string
+		want []int
+	}{
+		{"one", "2", []int{2}},
+		{"two", "1,3", []int{1, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestRun(t, "a\nb\nc\nd\ne\nf\ng\nh\na\nb\n")
+			setOpt(t, &optNumPartitions, partitions)
+
+			// a first run which keeps its spill files, then lost its output
+			setOpt(t, &optKeepTemp, true)
+			if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+				t.Fatalf("first run: %v", err)
+			}
+			full := make([][]byte, partitions)
+			for p := range full {
+				fname := outputFileName(testJobID, p)
+				b, err := os.ReadFile(fname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				full[p] = b
+				os.Remove(fname)
+			}
+
+			setOpt(t, &optKeepTemp, false)
+			setOpt(t, &optPartitionsOnly, tt.only)
+			setArgs(t)
+			if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+				t.Fatalf("re-run: %v", err)
+			}
+
+			for p := 0; p < partitions; p++ {
+				b, err := os.ReadFile(outputFileName(testJobID, p))
+				wanted := slices.Contains(tt.want, p)
+				switch {
+				case !wanted && err == nil:
+					t.Errorf("partition %d was reduced", p)
+				case wanted && err != nil:
+					t.Errorf("partition %d: %v", p, err)
+				case wanted && (len(b) == 0 || !bytes.Equal(b, full[p])):
+					t.Errorf("partition %d: output %q, want %q", p, b, full[p])
+				}
+			}
+
+			// the re-run removed only the spill files of its own partitions
+			for p := 0; p < partitions; p++ {
+				if fns := globSpills(t, testJobID, p); (len(fns) == 0) != slices.Contains(tt.want, p) {
+					t.Errorf("partition %d: spill files %q", p, fns)
+				}
+			}
+		})
+	}
+}
+
+func TestStdinArgument(t *testing.T) {
+
+	var tests = []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"no arguments", nil, []string{"s\t2"}},
+		{"stdin only", []string{"-"}, []string{"s\t2"}},
+		{"file and stdin", []string{"input.txt", "-"}, []string{"f\t1", "s\t2"}},
+		{"stdin between files", []string{"input.txt", "-", "input.txt"}, []string{"f\t2", "s\t2"}},
+		{"stdin twice", []string{"-", "input.txt", "-"}, []string{"f\t1", "s\t2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupTestRun(t, "f\n")
+
+			sname := filepath.Join(dir, "stdin.txt")
+			if err := os.WriteFile(sname, []byte("s\ns\n"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			stdin, err := os.Open(sname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stdin.Close()
+			setOpt(t, &os.Stdin, stdin)
+
+			var args []string
+			for _, arg := range tt.args {
+				if arg != "-" {
+					arg = filepath.Join(dir, arg)
+				}
+				args = append(args, arg)
+			}
+			setArgs(t, args...)
+
+			if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+				t.Fatalf("RunContext: %v", err)
+			}
+			if got := readOutput(t, testJobID); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// slowJob counts its input, sleeping for each record mapped and each key reduced
+type slowJob struct {
+	countJob
+	mapDelay    time.Duration
+	reduceDelay time.Duration
+	mapped      int64
+	reduced     int64
+}
+
+func (j *slowJob) Map(key string, value string, emitter Emitter) {
+	time.Sleep(j.mapDelay)
+	atomic.AddInt64(&j.mapped, 1)
+	j.countJob.Map(key, value, emitter)
+}
+
+func (j *slowJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	time.Sleep(j.reduceDelay)
+	atomic.AddInt64(&j.reduced, 1)
+	j.countJob.Reduce(reduceKey, sortKey, values, emitter)
+}
+
+func TestRunContextDeadline(t *testing.T) {
+
+	const keys = 100
+
+	var tests = []struct {
+		name     string
+		timeout  time.Duration
+		job      *slowJob
+		files    int
+		mapped   bool
+		reducing bool
+	}{
+		{"already expired", -time.Second, &slowJob{}, 1, false, false},
+		{"between mapper files", 50 * time.Millisecond, &slowJob{mapDelay: 2 * time.Millisecond}, keys, false, false},
+		{"within the reduce loop", 50 * time.Millisecond, &slowJob{reduceDelay: 5 * time.Millisecond}, 1, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupTestRun(t, "")
+			setOpt(t, &optNumMappers, 1)
+			setOpt(t, &optNumPartitions, 2)
+
+			var input strings.Builder
+			for i := 0; i < keys; i++ {
+				fmt.Fprintf(&input, "k%03d\n", i)
+			}
+			var args []string
+			lines := strings.SplitAfter(input.String(), "\n")
+			per := keys / tt.files
+			for i := 0; i < tt.files; i++ {
+				fname := filepath.Join(dir, fmt.Sprintf("input%03d.txt", i))
+				if err := os.WriteFile(fname, []byte(strings.Join(lines[i*per:(i+1)*per], "")), 0666); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, fname)
+			}
+			setArgs(t, args...)
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			_, err := RunContext(ctx, tt.job)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("RunContext()=%v, want %v", err, context.DeadlineExceeded)
+			}
+
+			if mapped := atomic.LoadInt64(&tt.job.mapped); (mapped == keys) != tt.mapped {
+				t.Errorf("mapped %d of %d records", mapped, keys)
+			}
+			if reduced := atomic.LoadInt64(&tt.job.reduced); (reduced > 0) != tt.reducing || reduced == keys {
+				t.Errorf("reduced %d of %d keys", reduced, keys)
+			}
+			if fns := tempFiles(t, dir); len(fns) != 0 {
+				t.Errorf("temp files left behind: %q", fns)
+			}
+		})
+	}
+}
+
+// readBinaryKeyValue reads records of a varint-length-prefixed reduce key, sort key and value
+func readBinaryKeyValue(br *bufio.Reader) (*KeyValue, error) {
+	var fields [3]string
+	for i := range fields {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF && i == 0 {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		fields[i] = string(b)
+	}
+	return &KeyValue{fields[0], fields[1], fields[2]}, nil
+}
+
+// writeBinaryKeyValues encodes records for readBinaryKeyValue
+func writeBinaryKeyValues(kvs []KeyValue) []byte {
+	var buf []byte
+	for _, kv := range kvs {
+		for _, f := range []string{kv.ReduceKey, kv.SortKey, kv.Value} {
+			buf = binary.AppendUvarint(buf, uint64(len(f)))
+			buf = append(buf, f...)
+		}
+	}
+	return buf
+}
+
+func TestReduceRecordReader(t *testing.T) {
+
+	var tests = []struct {
+		name      string
+		records   []KeyValue
+		truncate  int
+		want      []KeyValue
+		malformed int64
+	}{
+		{"empty", nil, 0, nil, 0},
+		{"grouped", []KeyValue{{"a", "", "1"}, {"a", "", "2"}, {"b", "", "3"}},
+			0, []KeyValue{{"a", "", "1|2"}, {"b", "", "3"}}, 0},
+		// fields may contain the bytes which frame lines
+		{"binary keys and values", []KeyValue{{"a\tb", "s", "x\ny"}, {"a\tb", "s", "\x00"}, {"c\n", "", ""}},
+			0, []KeyValue{{"a\tb", "", "\x00|x\ny"}, {"c\n", "", ""}}, 0},
+		{"truncated", []KeyValue{{"a", "", "1"}, {"b", "", "2"}},
+			1, []KeyValue{{"a", "", "1"}}, 1},
+	}
+
+	for _, tt := range tests {
+		before := MalformedRecords()
+
+		b := writeBinaryKeyValues(tt.records)
+		b = b[:len(b)-tt.truncate]
+
+		var got []KeyValue
+		reducer(new(keyValueJob), bytes.NewReader(b), readBinaryKeyValue, recordEmitter(&got), stdReporter)
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if n := MalformedRecords() - before; n != tt.malformed {
+			t.Errorf("%s: MalformedRecords went up by %d, want %d", tt.name, n, tt.malformed)
+		}
+	}
+}
+
+func TestReduceInput(t *testing.T) {
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "input.bin")
+	if err := os.WriteFile(in, writeBinaryKeyValues([]KeyValue{{"a", "", "2"}, {"a", "", "1"}, {"b c", "", "3"}}), 0666); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	stdout, err := os.Create(filepath.Join(dir, "output.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+
+	setOpt(t, &os.Stdin, stdin)
+	setOpt(t, &os.Stdout, stdout)
+	setOpt(t, &optDoReduce, true)
+	setOpt(t, &ReduceInput, readBinaryKeyValue)
+
+	if _, err := Run(new(keyValueJob)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	b, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a\t1|2\nb+c\t3\n"; string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
+
+func TestOutputExt(t *testing.T) {
+
+	var tests = []struct {
+		ext      string
+		compress bool
+		want     []string
+	}{
+		{"", false, []string{"red-out-p4242.0000", "red-out-p4242.0001"}},
+		{"tsv", false, []string{"red-out-p4242.0000.tsv", "red-out-p4242.0001.tsv"}},
+		{".json", false, []string{"red-out-p4242.0000.json", "red-out-p4242.0001.json"}},
+		{"tsv", true, []string{"red-out-p4242.0000.tsv.gz", "red-out-p4242.0001.tsv.gz"}},
+	}
+
+	for _, tt := range tests {
+		dir := setupTestRun(t, "a\nb\nc\nd\n")
+		setOpt(t, &optNumPartitions, 2)
+		setOpt(t, &optOutputExt, tt.ext)
+		setOpt(t, &optCompressOutput, tt.compress)
+
+		if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+			t.Fatalf("--output-ext=%q: RunContext: %v", tt.ext, err)
+		}
+
+		fns, err := filepath.Glob(filepath.Join(dir, "red-out-*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, fn := range fns {
+			got = append(got, filepath.Base(fn))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("--output-ext=%q compress=%v: output files %q, want %q", tt.ext, tt.compress, got, tt.want)
+		}
+	}
+}
+
+// lifecycleJob is a countJob which counts its setup and teardown calls, and
+// checks they come before the first and after the last Map or Reduce
+type lifecycleJob struct {
+	countJob
+
+	mu              sync.Mutex
+	mapSetups       int
+	reduceSetups    int
+	reduceTeardowns int
+	reducing        int // reduce tasks set up and not yet torn down
+	errs            []string
+}
+
+func (j *lifecycleJob) MapSetup(emitter Emitter) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.mapSetups++
+}
+
+func (j *lifecycleJob) Map(key string, value string, emitter Emitter) {
+	j.mu.Lock()
+	if j.mapSetups == 0 {
+		j.errs = append(j.errs, "Map before MapSetup")
+	}
+	j.mu.Unlock()
+	j.countJob.Map(key, value, emitter)
+}
+
+func (j *lifecycleJob) ReduceSetup(emitter Emitter) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.reduceSetups++
+	j.reducing++
+}
+
+func (j *lifecycleJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	j.mu.Lock()
+	if j.reducing == 0 {
+		j.errs = append(j.errs, "Reduce outside ReduceSetup and ReduceTeardown")
+	}
+	j.mu.Unlock()
+	j.countJob.Reduce(reduceKey, sortKey, values, emitter)
+}
+
+func (j *lifecycleJob) ReduceTeardown(emitter Emitter) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.reduceTeardowns++
+	j.reducing--
+	// teardown can still emit
+	emitter.Emit("teardown", "", "1")
+}
+
+func TestLifecycleHooks(t *testing.T) {
+
+	var tests = []struct {
+		name         string
+		files        int
+		partitions   int
+		local        bool
+		mapSetups    int
+		reduceSetups int
+	}{
+		{"RunLocal", 1, 1, true, 1, 1},
+		{"one file, one partition", 1, 1, false, 1, 1},
+		{"files and partitions", 3, 2, false, 3, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := new(lifecycleJob)
+			const input = "a\nb\na\nc\n"
+
+			var got []string
+			if tt.local {
+				kvs, err := RunLocal(job, strings.NewReader(input))
+				if err != nil {
+					t.Fatalf("RunLocal: %v", err)
+				}
+				for _, kv := range kvs {
+					got = append(got, kv.ReduceKey+"\t"+kv.Value)
+				}
+			} else {
+				dir := setupTestRun(t, "")
+				setOpt(t, &optNumPartitions, tt.partitions)
+				var args []string
+				for i := 0; i < tt.files; i++ {
+					fname := filepath.Join(dir, fmt.Sprintf("input%d.txt", i))
+					if err := os.WriteFile(fname, []byte(input), 0666); err != nil {
+						t.Fatal(err)
+					}
+					args = append(args, fname)
+				}
+				setArgs(t, args...)
+				if _, err := RunContext(context.Background(), job); err != nil {
+					t.Fatalf("RunContext: %v", err)
+				}
+				got = readOutput(t, testJobID)
+			}
+
+			if job.mapSetups != tt.mapSetups {
+				t.Errorf("MapSetup called %d times, want %d", job.mapSetups, tt.mapSetups)
+			}
+			if job.reduceSetups != tt.reduceSetups || job.reduceTeardowns != tt.reduceSetups {
+				t.Errorf("ReduceSetup called %d times and ReduceTeardown %d, want %d", job.reduceSetups, job.reduceTeardowns, tt.reduceSetups)
+			}
+			if len(job.errs) != 0 {
+				t.Errorf("out of order calls: %q", job.errs)
+			}
+
+			// each reduce task's teardown record is in its output
+			teardowns := 0
+			for _, line := range got {
+				if line == "teardown\t1" {
+					teardowns++
+				}
+			}
+			if teardowns != tt.reduceSetups {
+				t.Errorf("output %q has %d teardown records, want %d", got, teardowns, tt.reduceSetups)
+			}
+		})
+	}
+}
+
+// brokenPipeEnv, if set in the environment, makes TestBrokenPipe run a
+// --mapper or --reducer over stdin, as the process whose output is cut off.
+// "main-" before the phase runs it with Main rather than Run.
+const brokenPipeEnv = "DMRGO_TEST_BROKEN_PIPE"
+
+func TestBrokenPipe(t *testing.T) {
+
+	if phase := os.Getenv(brokenPipeEnv); phase != "" {
+		withMain := strings.HasPrefix(phase, "main-")
+		phase = strings.TrimPrefix(phase, "main-")
+		optDoMap = phase == "map"
+		optDoReduce = phase == "reduce"
+		if withMain {
+			// Main returns, rather than exiting with an error
+			Main(new(countJob))
+			os.Exit(0)
+		}
+		if _, err := Run(new(countJob)); !errors.Is(err, errBrokenPipe) {
+			fmt.Fprintln(os.Stderr, "Run returned:", err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	var input strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&input, "k%06d\t1\n", i)
+	}
+
+	var tests = []struct {
+		phase string
+		lines int
+	}{
+		{"map", 0},
+		{"map", 1},
+		{"reduce", 0},
+		{"reduce", 10},
+		{"main-map", 1},
+		{"main-reduce", 10},
+	}
+
+	for _, tt := range tests {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestBrokenPipe$")
+		cmd.Env = append(os.Environ(), brokenPipeEnv+"="+tt.phase)
+		cmd.Stdin = strings.NewReader(input.String())
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		// read a few lines, then go away like head
+		br := bufio.NewReader(stdout)
+		for i := 0; i < tt.lines; i++ {
+			if _, err := br.ReadString('\n'); err != nil {
+				t.Errorf("%s: reading line %d: %v", tt.phase, i, err)
+				break
+			}
+		}
+		stdout.Close()
+
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("%s, closed after %d lines: %v, stderr %q", tt.phase, tt.lines, err, stderr.String())
+		}
+		if strings.Contains(stderr.String(), "broken pipe") {
+			t.Errorf("%s, closed after %d lines: stderr %q", tt.phase, tt.lines, stderr.String())
+		}
+	}
+}
+
+func TestSortToDisk(t *testing.T) {
+
+	var input strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&input, "k%d %d\n", i%37, i%11)
+	}
+
+	var tests = []struct {
+		partitions int
+		reducers   int
+		sorts      int
+		goSort     bool
+	}{
+		{1, 1, 0, false},
+		{4, 2, 1, false},
+		{4, 4, 2, false},
+		{4, 2, 0, true},
+	}
+
+	for _, tt := range tests {
+		var outputs [2][]string
+		for i, toDisk := range []bool{false, true} {
+			setupTestRun(t, input.String())
+			setOpt(t, &optNumPartitions, tt.partitions)
+			setOpt(t, &optNumReducers, tt.reducers)
+			setOpt(t, &optNumSorts, tt.sorts)
+			setOpt(t, &optGoSort, tt.goSort)
+			setOpt(t, &optSecondaryKey, true)
+			setOpt(t, &optSortToDisk, toDisk)
+			setOpt(t, &optKeepTemp, true)
+
+			if _, err := RunContext(context.Background(), new(sortKeyJob)); err != nil {
+				t.Fatalf("%+v, sortToDisk=%v: RunContext: %v", tt, toDisk, err)
+			}
+			outputs[i] = readOutput(t, testJobID)
+
+			// only --sort-to-disk writes the sorted reduce input
+			sorted, err := filepath.Glob(reduceInputGlob(testJobID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if toDisk && len(sorted) != tt.partitions || !toDisk && len(sorted) != 0 {
+				t.Errorf("%+v, sortToDisk=%v: sorted reduce input files %q", tt, toDisk, sorted)
+			}
+		}
+
+		if len(outputs[0]) == 0 || !reflect.DeepEqual(outputs[0], outputs[1]) {
+			t.Errorf("%+v: piped output %q, on-disk output %q", tt, outputs[0], outputs[1])
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package dmrgo
+
+// Splitting hot keys over several reducers
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"strconv"
+	"strings"
+)
+
+// saltMarker brackets the salt a salting emitter puts in front of a key.  A
+// NUL byte doesn't turn up in real keys, so a salted key can't be confused
+// with an unsalted one such as "issue#12".
+const saltMarker = "\x00"
+
+// saltingEmitter spreads each key's records over several salted keys
+type saltingEmitter struct {
+	Emitter
+	n    int
+	next int
+}
+
+// NewSaltingEmitter returns an Emitter for Map which spreads the records for
+// each reduce key over n salted keys in turn.  The salt, 0 to n-1, is put in
+// front of the key between NUL bytes, and the key itself is left intact.  A hot
+// key's records are then partitioned over up to n reducers instead of one.
+// This only works for associative reductions: each reducer produces a
+// partial aggregate per salted key, and a second job built with
+// NewDesaltJob combines the partials for each original key.
+func NewSaltingEmitter(e Emitter, n int) Emitter {
+	if n < 1 {
+		n = 1
+	}
+	return &saltingEmitter{Emitter: e, n: n}
+}
+
+func (e *saltingEmitter) salt(key string) string {
+	s := saltMarker + strconv.Itoa(e.next) + saltMarker + key
+	e.next = (e.next + 1) % e.n
+	return s
+}
+
+func (e *saltingEmitter) Emit(reduceKey string, sortKey string, value string) {
+	e.Emitter.Emit(e.salt(reduceKey), sortKey, value)
+}
+
+func (e *saltingEmitter) Combine(reduceKey string, value string) {
+	e.Emitter.Combine(e.salt(reduceKey), value)
+}
+
+func (e *saltingEmitter) EmitAll(kvs []*KeyValue) {
+	emitAll(e, kvs)
+}
+
+// Unsalt returns the original key from a key salted by a salting emitter.
+// Keys without a salt are returned unchanged.
+func Unsalt(key string) string {
+	if !strings.HasPrefix(key, saltMarker) {
+		return key
+	}
+	salt := key[len(saltMarker):]
+	i := strings.Index(salt, saltMarker)
+	if i < 0 {
+		return key
+	}
+	if _, err := strconv.Atoi(salt[:i]); err != nil {
+		return key
+	}
+	return salt[i+len(saltMarker):]
+}
+
+// desaltJob is the final-combine pass over salted partial aggregates
+type desaltJob struct {
+	job MapReduceJob
+}
+
+// NewDesaltJob returns the second pass of a salted job.  Its input is the
+// output of the first pass, read with the "tsv" input format (e.g.
+// "red-out-p1234.0000:tsv").  Map strips the salt from each key and
+// re-emits the partial aggregate, and Reduce is job's Reduce, which combines
+// the partials for each original key.
+func NewDesaltJob(job MapReduceJob) MapReduceJob {
+	return &desaltJob{job}
+}
+
+func (d *desaltJob) Map(key string, value string, emitter Emitter) {
+	emitter.Emit(Unsalt(key), "", value)
+}
+
+func (d *desaltJob) MapFinal(emitter Emitter) {}
+
+func (d *desaltJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	d.job.Reduce(reduceKey, sortKey, values, emitter)
+}
@@ -0,0 +1,143 @@
+package dmrgo
+
+// Tests for key salting
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnsalt(t *testing.T) {
+
+	var tests = []struct {
+		key  string
+		want string
+	}{
+		{"", ""},
+		{"issue", "issue"},
+		{"issue#12", "issue#12"},
+		{"\x003\x00issue#12", "issue#12"},
+		{"\x000\x00", ""},
+		{"\x0012\x00a\x00b", "a\x00b"},
+		{"\x00x\x00issue", "\x00x\x00issue"},
+		{"\x003issue", "\x003issue"},
+	}
+
+	for _, tt := range tests {
+		if got := Unsalt(tt.key); got != tt.want {
+			t.Errorf("Unsalt(%q)=%q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestSaltingEmitterRoundTrip(t *testing.T) {
+
+	var got []KeyValue
+	e := NewSaltingEmitter(NewFuncEmitter(func(kv *KeyValue) { got = append(got, *kv) }), 3)
+
+	keys := []string{"a", "a", "a", "a", "issue#12", ""}
+	for _, k := range keys {
+		e.Emit(k, "", "v")
+	}
+
+	salts := make(map[string]bool)
+	for i, kv := range got {
+		if u := Unsalt(kv.ReduceKey); u != keys[i] {
+			t.Errorf("Unsalt(%q)=%q, want %q", kv.ReduceKey, u, keys[i])
+		}
+		salts[kv.ReduceKey] = true
+	}
+	// "a" is spread over all three salts
+	for i := 0; i < 3; i++ {
+		if k := "\x00" + strconv.Itoa(i) + "\x00a"; !salts[k] {
+			t.Errorf("no records for salted key %q", k)
+		}
+	}
+}
+
+// skewedSumJob sums the values for each key, with almost all the records on one key
+type skewedSumJob struct {
+	salted Emitter
+	n      int
+}
+
+func (j *skewedSumJob) Map(key string, value string, emitter Emitter) {
+	if j.n > 0 {
+		if j.salted == nil {
+			j.salted = NewSaltingEmitter(emitter, j.n)
+		}
+		emitter = j.salted
+	}
+	emitter.Emit(value, "", "1")
+}
+
+func (j *skewedSumJob) MapFinal(emitter Emitter) {}
+
+func (j *skewedSumJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	sum := 0
+	for v := range values {
+		n, _ := strconv.Atoi(v)
+		sum += n
+	}
+	emitter.Emit(reduceKey, "", strconv.Itoa(sum))
+}
+
+func TestSaltedSkewedSum(t *testing.T) {
+
+	const partitions = 4
+
+	var input strings.Builder
+	for i := 0; i < 1000; i++ {
+		input.WriteString("hot\n")
+	}
+	input.WriteString("cold1\ncold2\n")
+
+	partials, err := RunLocal(&skewedSumJob{n: partitions}, strings.NewReader(input.String()))
+	if err != nil {
+		t.Fatalf("first pass: %v", err)
+	}
+
+	// the hot key's records should be spread evenly over the partitions
+	load := make([]int, partitions)
+	for _, kv := range partials {
+		n, _ := strconv.Atoi(kv.Value)
+		load[PartitionFor(kv.ReduceKey, partitions)] += n
+	}
+	for p, n := range load {
+		if n > 1002/partitions+2 {
+			t.Errorf("partition %d has %d of 1002 records: %v", p, n, load)
+		}
+	}
+
+	// the second pass reads the first pass's output as tsv
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	out := newPrintEmitter(w)
+	for _, kv := range partials {
+		out.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+	}
+	out.Flush()
+
+	defer func(keyed bool) { optMapInputKeyed = keyed }(optMapInputKeyed)
+	optMapInputKeyed = true
+
+	totals, err := RunLocal(NewDesaltJob(&skewedSumJob{}), &buf)
+	if err != nil {
+		t.Fatalf("second pass: %v", err)
+	}
+
+	want := []KeyValue{{"cold1", "", "1"}, {"cold2", "", "1"}, {"hot", "", "1000"}}
+	if len(totals) != len(want) {
+		t.Fatalf("got %v, want %v", totals, want)
+	}
+	for i := range want {
+		if totals[i] != want[i] {
+			t.Errorf("totals[%d]=%v, want %v", i, totals[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package dmrgo
+
+// Declared column types for TSV output
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ColumnType is the type of a column of TSV output
+type ColumnType int
+
+// The column types of a Schema
+const (
+	StringColumn ColumnType = iota
+	IntColumn               // any signed integer type
+	UintColumn              // any unsigned integer type
+	FloatColumn             // float32 or float64
+	BoolColumn
+)
+
+var columnTypeNames = []string{"string", "int", "uint", "float", "bool"}
+
+func (t ColumnType) String() string {
+	if t < 0 || int(t) >= len(columnTypeNames) {
+		return fmt.Sprintf("ColumnType(%d)", int(t))
+	}
+	return columnTypeNames[t]
+}
+
+// columnTypeOf returns the column type a primitive kind is written as
+func columnTypeOf(k reflect.Kind) (ColumnType, bool) {
+	switch k {
+	case reflect.String:
+		return StringColumn, true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return IntColumn, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return UintColumn, true
+	case reflect.Float32, reflect.Float64:
+		return FloatColumn, true
+	case reflect.Bool:
+		return BoolColumn, true
+	}
+	return 0, false
+}
+
+// Schema declares the types of the columns of a job's TSV output values, in
+// order.  Set it as a TSVProtocol's Schema to have every marshalled value
+// checked against it.
+type Schema []ColumnType
+
+// ParseSchema parses a comma-separated list of column type names, e.g. "string,int,float"
+func ParseSchema(s string) (Schema, error) {
+
+	var schema Schema
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		i := 0
+		for i < len(columnTypeNames) && columnTypeNames[i] != name {
+			i++
+		}
+		if i == len(columnTypeNames) {
+			return nil, fmt.Errorf("unknown column type %q", name)
+		}
+		schema = append(schema, ColumnType(i))
+	}
+
+	return schema, nil
+}
+
+// Check returns an error if value doesn't have the schema's columns.  The
+// columns of a value are as TSVProtocol marshals it: its struct fields, array
+// or slice elements, alternating map keys and values, or the value itself.
+func (s Schema) Check(value interface{}) error {
+
+	kinds := fieldKinds(reflect.ValueOf(value))
+
+	if len(kinds) != len(s) {
+		return fmt.Errorf("schema mismatch: %T has %d columns, schema has %d", value, len(kinds), len(s))
+	}
+
+	for i, k := range kinds {
+		t, ok := columnTypeOf(k)
+		if !ok {
+			return fmt.Errorf("schema mismatch: column %d of %T is a %s, not a primitive", i, value, k)
+		}
+		if t != s[i] {
+			return fmt.Errorf("schema mismatch: column %d of %T is a %s, schema says %s", i, value, t, s[i])
+		}
+	}
+
+	return nil
+}
+
+// fieldKinds returns the kinds of the fields marshalFields makes from v
+func fieldKinds(v reflect.Value) []reflect.Kind {
+
+	var kinds []reflect.Kind
+
+	switch {
+	case !v.IsValid():
+		// a nil value has no columns
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			kinds = append(kinds, v.Field(i).Kind())
+		}
+	case isPrimitive(v.Kind()):
+		kinds = append(kinds, v.Kind())
+	case v.Kind() == reflect.Array || v.Kind() == reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			kinds = append(kinds, v.Index(i).Kind())
+		}
+	case v.Kind() == reflect.Map:
+		// all the keys, and all the values, are the same kind, so their order doesn't matter
+		for _, k := range v.MapKeys() {
+			kinds = append(kinds, k.Kind(), v.MapIndex(k).Kind())
+		}
+	}
+
+	return kinds
+}
@@ -0,0 +1,113 @@
+package dmrgo
+
+// Tests for declared column types
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSchema(t *testing.T) {
+
+	var tests = []struct {
+		s    string
+		want Schema
+		err  bool
+	}{
+		{"string", Schema{StringColumn}, false},
+		{"string,int,uint,float,bool", Schema{StringColumn, IntColumn, UintColumn, FloatColumn, BoolColumn}, false},
+		{" int , float ", Schema{IntColumn, FloatColumn}, false},
+		{"int,double", nil, true},
+		{"", nil, true},
+		{"int,", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSchema(tt.s)
+		if (err != nil) != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSchema(%q)=%v, %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+// lineItem is a row of output with a string, an int and a float column
+type lineItem struct {
+	Item  string
+	Qty   int
+	Price float64
+}
+
+func TestSchemaCheck(t *testing.T) {
+
+	schema := Schema{StringColumn, IntColumn, FloatColumn}
+
+	var tests = []struct {
+		schema Schema
+		value  interface{}
+		want   string
+	}{
+		{schema, lineItem{"tea", 2, 1.5}, ""},
+		{schema, [3]int{1, 2, 3}, "column 0 of [3]int is a int, schema says string"},
+		{schema, struct {
+			Item  string
+			Qty   string
+			Price float64
+		}{"tea", "2", 1.5}, "column 1"},
+		{schema, lineItem{}, ""},
+		{schema, []string{"a", "b"}, "has 2 columns, schema has 3"},
+		{Schema{IntColumn}, 7, ""},
+		{Schema{IntColumn}, int8(7), ""},
+		{Schema{IntColumn}, uint(7), "is a uint, schema says int"},
+		{Schema{FloatColumn}, float32(1), ""},
+		{Schema{BoolColumn}, true, ""},
+		{Schema{StringColumn, IntColumn}, map[string]int{"a": 1}, ""},
+		{Schema{StringColumn, IntColumn}, map[string]int{"a": 1, "b": 2}, "has 4 columns"},
+		{Schema{StringColumn}, []interface{}{[]int{1}}, "not a primitive"},
+		{Schema{}, nil, ""},
+	}
+
+	for _, tt := range tests {
+		err := tt.schema.Check(tt.value)
+		if tt.want == "" && err != nil {
+			t.Errorf("%v.Check(%#v)=%v, want nil", tt.schema, tt.value, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%v.Check(%#v)=%v, want an error containing %q", tt.schema, tt.value, err, tt.want)
+		}
+	}
+}
+
+func TestSchemaMarshal(t *testing.T) {
+
+	p := &TSVProtocol{Schema: Schema{StringColumn, IntColumn, FloatColumn}}
+
+	var tests = []struct {
+		value    interface{}
+		want     []KeyValue
+		rejected bool
+	}{
+		{lineItem{"tea", 2, 1.5}, []KeyValue{{"k", "", "tea\t2\t1.5"}}, false},
+		{[]interface{}{"tea", "2", 1.5}, nil, true},
+		{lineItem{}, []KeyValue{{"k", "", "\t0\t0"}}, false},
+		{7, nil, true},
+	}
+
+	t.Cleanup(resetFailure)
+
+	for _, tt := range tests {
+		resetFailure()
+
+		var got []KeyValue
+		NewProtoEmitter(recordEmitter(&got), p).EmitKV("k", nil, tt.value)
+
+		if (failed() != nil) != tt.rejected {
+			t.Errorf("EmitKV(%#v): run failed=%v, want %v", tt.value, failed(), tt.rejected)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("EmitKV(%#v) emitted %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package dmrgo
+
+// Sorting map output for the reducers
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// sortKeyArgs returns the sort options to order map output for the
+// reducers, in byte order.  Records are sorted on the reduce key so each
+// key's records are together, and with --with-secondary-key then on the sort
+// key.  Each key is compared as a whole field, so a key is never split by
+// another which has it as a prefix.
+func sortKeyArgs() []string {
+	// spill files are "reduceKey,sortKey\tvalue", with the comma even if there is no sort key
+	args := []string{"-t", string([]byte{keySeparator}), "-k1,1"}
+	if optSecondaryKey {
+		args = append(args, "-k2")
+	}
+	return args
+}
+
+// sortCommandArgs returns the arguments for the sort command to sort the files fns, including any --sort-args
+func sortCommandArgs(fns []string) []string {
+	args := sortKeyArgs()
+	args = append(args, strings.Fields(optSortArgs)...)
+	return append(args, fns...)
+}
+
+// sortPartition sorts the spill files for a partition into out.  It runs
+// the sort command if there is one on the PATH, at the --nice niceness, and
+// otherwise (or with --go-sort) sorts in memory in Go.
+func sortPartition(fns []string, out *os.File, pstats *PartitionStats) error {
+
+	path, err := exec.LookPath("sort")
+	if err != nil || optGoSort {
+		return goSort(fns, out)
+	}
+
+	stderr, relayed, err := relayStderr()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(path, sortCommandArgs(fns)...)
+	cmd.Stdout = out
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+
+	err = cmd.Start()
+	stderr.Close()
+	if err == nil && optNice != 0 {
+		// the sort has only just started, so next to none of its work is at the old priority
+		if err := setNice(cmd.Process.Pid, optNice); err != nil {
+			fmt.Fprintln(os.Stderr, "dmrgo: can't set sort niceness:", err)
+		}
+	}
+	if err == nil {
+		err = cmd.Wait()
+	}
+	<-relayed
+
+	if ps := cmd.ProcessState; ps != nil {
+		pstats.SortUserTime = ps.UserTime()
+		pstats.SortSystemTime = ps.SystemTime()
+		pstats.SortSysUsage = ps.SysUsage()
+	}
+
+	return err
+}
+
+// goSort sorts the lines of the files fns into w in the same order as
+// "LC_ALL=C sort" with sortKeyArgs.  The lines are all held in memory.
+func goSort(fns []string, w io.Writer) error {
+
+	var lines []string
+
+	for _, fn := range fns {
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		br := bufio.NewReader(f)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				lines = append(lines, strings.TrimSuffix(line, "\n"))
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+		f.Close()
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		return lessLine(lines[i], lines[j])
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, line := range lines {
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// lessLine compares two lines of map output as sort does with sortKeyArgs:
+// by the key fields, then bytewise by the whole line
+func lessLine(a, b string) bool {
+
+	sep := string([]byte{keySeparator})
+
+	ka, ra := splitSortKey(a, sep)
+	kb, rb := splitSortKey(b, sep)
+	if ka != kb {
+		return ka < kb
+	}
+
+	// -k2 runs to the end of the line
+	if optSecondaryKey && ra != rb {
+		return ra < rb
+	}
+
+	return a < b
+}
+
+// splitSortKey splits a line at the first sep into the first field and the rest
+func splitSortKey(line, sep string) (string, string) {
+	if i := strings.Index(line, sep); i >= 0 {
+		return line[:i], line[i+1:]
+	}
+	return line, ""
+}
@@ -0,0 +1,184 @@
+package dmrgo
+
+// Tests for sorting map output
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLessLine(t *testing.T) {
+
+	var tests = []struct {
+		a, b      string
+		secondary bool
+		want      bool
+	}{
+		// '+' sorts before the separator, so whole lines would put "a+b" first
+		{"a,\t1", "a+b,\t1", false, true},
+		{"a+b,\t1", "a,\t1", false, false},
+		{"a,\t2", "a,\t1", false, false},
+		{"a,\t1", "a,\t2", false, true},
+		{"a,2\tx", "a,10\ty", true, false},
+		{"a,10\ty", "a,2\tx", true, true},
+		{"a,1\ty", "a,1\tx", true, false},
+		{"b,\t1", "ab,\t1", false, false},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optSecondaryKey, tt.secondary)
+		if got := lessLine(tt.a, tt.b); got != tt.want {
+			t.Errorf("lessLine(%q, %q) secondary=%v = %v, want %v", tt.a, tt.b, tt.secondary, got, tt.want)
+		}
+	}
+}
+
+func TestSortOnKeyField(t *testing.T) {
+
+	// "a b" is escaped to "a+b" and '+' sorts before the separator, so
+	// sorting the whole lines would put it before "a"
+	const input = "a b\na\nab\na b\n"
+	want := []string{"a\t1", "a+b\t2", "ab\t1"}
+
+	var tests = []struct {
+		name   string
+		goSort bool
+	}{
+		{"sort command", false},
+		{"go sort", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := exec.LookPath("sort"); err != nil && !tt.goSort {
+				t.Skip("no sort command")
+			}
+			setOpt(t, &optGoSort, tt.goSort)
+
+			if got := runTestJob(t, new(countJob), input); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestGoSortMatchesSort(t *testing.T) {
+
+	if _, err := exec.LookPath("sort"); err != nil {
+		t.Skip("no sort command")
+	}
+
+	var tests = []struct {
+		name      string
+		spills    []string
+		secondary bool
+	}{
+		{"one file", []string{"b,\t1\na,\t2\nc,\t0\n"}, false},
+		{"merged files", []string{"b,\t1\na,\t2\n", "a,\t1\nB,\t3\n", ""}, false},
+		{"escaped keys", []string{"a%C3%A9,\t1\na+b,\t1\na,\t1\nab,\t1\n"}, false},
+		{"high bytes", []string{"\xc3\xa9,\t1\nz,\t1\n\xe2\x82\xac,\t1\n"}, false},
+		{"secondary key", []string{"a,2\tx\na,10\ty\nb,1\tz\na,1\tw\n"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			setOpt(t, &optSecondaryKey, tt.secondary)
+			setOpt(t, &optSortArgs, "")
+
+			var fns []string
+			for i, spill := range tt.spills {
+				fn := filepath.Join(dir, fmt.Sprintf("spill%d", i))
+				if err := os.WriteFile(fn, []byte(spill), 0666); err != nil {
+					t.Fatal(err)
+				}
+				fns = append(fns, fn)
+			}
+
+			sorted := func(goSort bool, path string) string {
+				setOpt(t, &optGoSort, goSort)
+				t.Setenv("PATH", path)
+				out, err := os.CreateTemp(dir, "sorted")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer out.Close()
+				if err := sortPartition(fns, out, new(PartitionStats)); err != nil {
+					t.Fatalf("sortPartition: %v", err)
+				}
+				b, err := os.ReadFile(out.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(b)
+			}
+
+			path := os.Getenv("PATH")
+			want := sorted(false, path)
+			if got := sorted(true, path); got != want {
+				t.Errorf("--go-sort gave %q, sort gave %q", got, want)
+			}
+			// with no sort on the PATH it falls back to sorting in Go
+			if got := sorted(false, ""); got != want {
+				t.Errorf("without sort on the PATH got %q, sort gave %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSortArgs(t *testing.T) {
+
+	var tests = []struct {
+		sortArgs  string
+		secondary bool
+		want      []string
+	}{
+		{"", false, []string{"-t", ",", "-k1,1", "f1", "f2"}},
+		{"", true, []string{"-t", ",", "-k1,1", "-k2", "f1", "f2"}},
+		{"--parallel=4", false, []string{"-t", ",", "-k1,1", "--parallel=4", "f1", "f2"}},
+		{"  --parallel=4   --compress-program=gzip -S 1G ", false,
+			[]string{"-t", ",", "-k1,1", "--parallel=4", "--compress-program=gzip", "-S", "1G", "f1", "f2"}},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optSortArgs, tt.sortArgs)
+		setOpt(t, &optSecondaryKey, tt.secondary)
+		if got := sortCommandArgs([]string{"f1", "f2"}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("--sort-args=%q: got %q, want %q", tt.sortArgs, got, tt.want)
+		}
+	}
+
+	// the arguments reach the sort command
+	sortPath, err := exec.LookPath("sort")
+	if err != nil {
+		t.Skip("no sort command")
+	}
+	bin := t.TempDir()
+	argsFile := filepath.Join(bin, "args")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\nexec %s \"$@\"\n", argsFile, sortPath)
+	if err := os.WriteFile(filepath.Join(bin, "sort"), []byte(script), 0777); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setOpt(t, &optGoSort, false)
+	setOpt(t, &optSecondaryKey, false)
+	setOpt(t, &optSortArgs, "--parallel=2 -S 1M")
+
+	if got := runTestJob(t, new(countJob), "b\na\nb\n"); !reflect.DeepEqual(got, []string{"a\t1", "b\t2"}) {
+		t.Errorf("output %q", got)
+	}
+	b, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := string(b); !strings.HasPrefix(args, "-t , -k1,1 --parallel=2 -S 1M ") {
+		t.Errorf("sort ran with %q", args)
+	}
+}
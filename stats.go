@@ -0,0 +1,150 @@
+package dmrgo
+
+// Statistics collected during a local map/reduce run
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// PartitionStats holds the numbers collected while sorting and reducing a single partition
+type PartitionStats struct {
+	Partition int
+
+	// map output spilled to disk for this partition
+	SpillFiles int
+	SpillBytes int64
+
+	// resource usage of the sort subprocess
+	SortUserTime   time.Duration
+	SortSystemTime time.Duration
+
+	// SortSysUsage is the system-dependent resource usage of the sort
+	// subprocess as returned by os.ProcessState.SysUsage().  On Unix it is a
+	// *syscall.Rusage, which includes the peak memory (Maxrss).
+	SortSysUsage interface{}
+
+	// NamedOutputs are the files of the named outputs the partition's
+	// reducer wrote to, in the order they were created
+	NamedOutputs []string
+}
+
+// RunStats holds the statistics of a local map/reduce run
+type RunStats struct {
+	Partitions []PartitionStats
+
+	// OutputRecords is the number of records written by the reducers
+	OutputRecords int64
+
+	// InputBytes is the number of bytes read by the mappers, after decompression
+	InputBytes int64
+
+	// OutputBytes is the number of bytes written by the reducers
+	OutputBytes int64
+}
+
+// SpillBytes returns the total number of bytes spilled by the mappers across all partitions
+func (s *RunStats) SpillBytes() int64 {
+	var total int64
+	for _, p := range s.Partitions {
+		total += p.SpillBytes
+	}
+	return total
+}
+
+// PeakSpillBytes returns the size of the largest partition spill
+func (s *RunStats) PeakSpillBytes() int64 {
+	var peak int64
+	for _, p := range s.Partitions {
+		if p.SpillBytes > peak {
+			peak = p.SpillBytes
+		}
+	}
+	return peak
+}
+
+var lastStatsMu sync.Mutex
+var lastStats *RunStats
+
+// LastRunStats returns the statistics of the most recent --mapreduce run, or nil if there hasn't been one
+func LastRunStats() *RunStats {
+	lastStatsMu.Lock()
+	defer lastStatsMu.Unlock()
+	return lastStats
+}
+
+func setLastRunStats(s *RunStats) {
+	lastStatsMu.Lock()
+	lastStats = s
+	lastStatsMu.Unlock()
+}
+
+// add up the sizes of a set of files
+func spillSize(fns []string) int64 {
+	var total int64
+	for _, fn := range fns {
+		if fi, err := os.Stat(fn); err == nil {
+			total += fi.Size()
+		}
+	}
+	return total
+}
+
+// skewTracker finds reduce keys which have more than a given fraction of the records
+type skewTracker struct {
+	threshold float64
+	total     int64
+
+	// Any key over the threshold at the end was also over it when its group
+	// ended, since the total only grows, so those are the only keys we keep.
+	candidates []skewedKey
+}
+
+type skewedKey struct {
+	key   string
+	count int64
+}
+
+func newSkewTracker(threshold float64) *skewTracker {
+	return &skewTracker{threshold: threshold}
+}
+
+func (t *skewTracker) endGroup(key string, count int64) {
+
+	t.total += count
+
+	if float64(count) <= t.threshold*float64(t.total) {
+		return
+	}
+
+	t.candidates = append(t.candidates, skewedKey{key, count})
+
+	// at most 1/threshold keys can still be over it, so prune once we have a lot more than that
+	if float64(len(t.candidates)) > 2/t.threshold {
+		t.candidates = t.skewed()
+	}
+}
+
+// skewed returns the candidates which are over the threshold of the current total
+func (t *skewTracker) skewed() []skewedKey {
+	var keys []skewedKey
+	for _, c := range t.candidates {
+		if float64(c.count) > t.threshold*float64(t.total) {
+			keys = append(keys, c)
+		}
+	}
+	return keys
+}
+
+// report warns about each skewed key and counts them in the "dmrgo","skewed keys" counter
+func (t *skewTracker) report(w io.Writer) {
+	for _, c := range t.skewed() {
+		fmt.Fprintf(w, "dmrgo: skewed reduce key %q has %d of %d records (%.1f%%)\n", c.key, c.count, t.total, 100*float64(c.count)/float64(t.total))
+		IncrCounter("dmrgo", "skewed keys", 1)
+	}
+}
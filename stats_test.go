@@ -0,0 +1,215 @@
+package dmrgo
+
+// Tests for the run statistics
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSpillStats(t *testing.T) {
+
+	var tests = []struct {
+		partitions int
+		input      string
+	}{
+		{1, "a\nb\nc\n"},
+		{3, "a\nb\nc\nd\ne\nf\ng\n"},
+	}
+
+	for _, tt := range tests {
+		setupTestRun(t, tt.input)
+		setOpt(t, &optNumPartitions, tt.partitions)
+		setOpt(t, &optKeepTemp, true)
+
+		if _, err := RunContext(context.Background(), new(joinJob)); err != nil {
+			t.Fatalf("RunContext: %v", err)
+		}
+
+		stats := LastRunStats()
+
+		if len(stats.Partitions) != tt.partitions {
+			t.Fatalf("%d partitions: got stats for %d", tt.partitions, len(stats.Partitions))
+		}
+
+		var total int64
+		for p, pstats := range stats.Partitions {
+			spills := globSpills(t, testJobID, p)
+			if pstats.SpillFiles != len(spills) {
+				t.Errorf("partition %d: SpillFiles=%d, want %d", p, pstats.SpillFiles, len(spills))
+			}
+			if want := spillSize(spills); pstats.SpillBytes != want {
+				t.Errorf("partition %d: SpillBytes=%d, want %d", p, pstats.SpillBytes, want)
+			}
+			total += pstats.SpillBytes
+		}
+
+		if total == 0 {
+			t.Errorf("%d partitions: no spill bytes reported", tt.partitions)
+		}
+		if got := stats.SpillBytes(); got != total {
+			t.Errorf("%d partitions: SpillBytes()=%d, want %d", tt.partitions, got, total)
+		}
+	}
+}
+
+func TestSkewTracker(t *testing.T) {
+
+	type group struct {
+		key   string
+		count int64
+	}
+
+	var tests = []struct {
+		threshold float64
+		groups    []group
+		want      []string
+	}{
+		{0.5, []group{{"a", 1}, {"hot", 90}, {"b", 9}}, []string{"hot"}},
+		// over the threshold when its group ended, but not by the end
+		{0.5, []group{{"a", 10}, {"b", 1}, {"c", 20}}, []string{"c"}},
+		{0.5, []group{{"a", 10}, {"b", 10}}, nil},
+		{0.3, []group{{"a", 40}, {"b", 40}, {"c", 20}}, []string{"a", "b"}},
+		{0.01, nil, nil},
+	}
+
+	for _, tt := range tests {
+		st := newSkewTracker(tt.threshold)
+		for _, g := range tt.groups {
+			st.endGroup(g.key, g.count)
+		}
+
+		var got []string
+		for _, c := range st.skewed() {
+			got = append(got, c.key)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("threshold %v, groups %v: skewed %q, want %q", tt.threshold, tt.groups, got, tt.want)
+		}
+	}
+
+	// many small keys are pruned as they drop under the threshold
+	st := newSkewTracker(0.1)
+	for i := 0; i < 10000; i++ {
+		st.endGroup(strconv.Itoa(i), 1)
+	}
+	if len(st.candidates) > 21 {
+		t.Errorf("%d candidates kept, want at most 21", len(st.candidates))
+	}
+}
+
+func TestSkewWarning(t *testing.T) {
+
+	var input strings.Builder
+	for i := 0; i < 90; i++ {
+		input.WriteString("hot\n")
+	}
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&input, "cold%d\n", i)
+	}
+
+	var tests = []struct {
+		threshold float64
+		warnings  int64
+	}{
+		{0, 0},
+		{0.5, 1},
+		{0.95, 0},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optSkewThreshold, tt.threshold)
+
+		before := Counter("dmrgo", "skewed keys")
+		runTestJob(t, new(countJob), input.String())
+		if n := Counter("dmrgo", "skewed keys") - before; n != tt.warnings {
+			t.Errorf("threshold %v: %d skewed keys, want %d", tt.threshold, n, tt.warnings)
+		}
+	}
+
+	// the warning names the key and its share
+	st := newSkewTracker(0.5)
+	st.endGroup("hot", 90)
+	st.endGroup("cold", 10)
+	var buf bytes.Buffer
+	st.report(&buf)
+	if want := "dmrgo: skewed reduce key \"hot\" has 90 of 100 records (90.0%)\n"; buf.String() != want {
+		t.Errorf("report wrote %q, want %q", buf.String(), want)
+	}
+}
+
+func TestByteStats(t *testing.T) {
+
+	var tests = []struct {
+		name       string
+		inputs     []string
+		gzip       bool
+		partitions int
+		output     string
+	}{
+		{"one file", []string{"a\nb\na\n"}, false, 1, "a\t2\nb\t1\n"},
+		{"two files", []string{"a\nb\n", "a\nccc\n"}, false, 1, "a\t2\nb\t1\nccc\t1\n"},
+		{"partitions", []string{"a\nb\na\nccc\n"}, false, 3, "a\t2\nb\t1\nccc\t1\n"},
+		{"gzip, counted after decompression", []string{"a\nb\na\n"}, true, 1, "a\t2\nb\t1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupTestRun(t, "")
+			setOpt(t, &optNumPartitions, tt.partitions)
+			setOpt(t, &optKeepTemp, true)
+
+			var args []string
+			var inputBytes int64
+			for i, input := range tt.inputs {
+				fname := filepath.Join(dir, fmt.Sprintf("input%d.txt", i))
+				b := []byte(input)
+				if tt.gzip {
+					fname += ".gz"
+					var buf bytes.Buffer
+					gz := gzip.NewWriter(&buf)
+					gz.Write(b)
+					gz.Close()
+					b = buf.Bytes()
+				}
+				if err := os.WriteFile(fname, b, 0666); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, fname)
+				inputBytes += int64(len(input))
+			}
+			setArgs(t, args...)
+
+			if _, err := RunContext(context.Background(), new(countJob)); err != nil {
+				t.Fatalf("RunContext: %v", err)
+			}
+			stats := LastRunStats()
+
+			if stats.InputBytes != inputBytes {
+				t.Errorf("InputBytes=%d, want %d", stats.InputBytes, inputBytes)
+			}
+
+			var spilled int64
+			for p := 0; p < tt.partitions; p++ {
+				spilled += spillSize(globSpills(t, testJobID, p))
+			}
+			if spilled == 0 || stats.SpillBytes() != spilled {
+				t.Errorf("SpillBytes()=%d, want %d", stats.SpillBytes(), spilled)
+			}
+
+			if want := int64(len(tt.output)); stats.OutputBytes != want {
+				t.Errorf("OutputBytes=%d, want %d", stats.OutputBytes, want)
+			}
+		})
+	}
+}
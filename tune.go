@@ -0,0 +1,71 @@
+package dmrgo
+
+// Picking mapper and reducer counts for --auto-tune
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// autoTune picks the number of mappers and reducers to run.  cpuBound is the
+// fraction of the calibration mapper's time spent in Map rather than reading
+// its input: CPU-bound jobs get a mapper per CPU, I/O-bound ones fewer so
+// they don't just contend for the disk.  Counts are never more than the work
+// available.
+func autoTune(numCPU, numInputs, numPartitions int, cpuBound float64) (mappers, reducers int) {
+
+	if numCPU < 1 {
+		numCPU = 1
+	}
+
+	cpuBound = math.Max(0, math.Min(1, cpuBound))
+
+	mappers = int(math.Ceil(float64(numCPU) * cpuBound))
+	if mappers < 2 {
+		mappers = 2
+	}
+	if mappers > numCPU {
+		mappers = numCPU
+	}
+	if mappers > numInputs {
+		mappers = numInputs
+	}
+	if mappers < 1 {
+		mappers = 1
+	}
+
+	reducers = numCPU
+	if reducers > numPartitions {
+		reducers = numPartitions
+	}
+	if reducers < 1 {
+		reducers = 1
+	}
+
+	return mappers, reducers
+}
+
+// cpuBoundFraction estimates how much of mapping an input was spent in Map,
+// by comparing the time it took to map with the time it takes just to read it
+func cpuBoundFraction(mapTime time.Duration, open func() (io.ReadCloser, error)) float64 {
+
+	f, err := open()
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+
+	t0 := time.Now()
+	io.Copy(ioutil.Discard, f)
+	readTime := time.Since(t0)
+
+	if mapTime <= 0 {
+		return 0
+	}
+
+	return 1 - float64(readTime)/float64(mapTime)
+}
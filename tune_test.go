@@ -0,0 +1,82 @@
+package dmrgo
+
+// Tests for picking mapper and reducer counts
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoTune(t *testing.T) {
+
+	var tests = []struct {
+		numCPU, numInputs, numPartitions int
+		cpuBound                         float64
+		mappers, reducers                int
+	}{
+		{8, 100, 16, 1, 8, 8},
+		{8, 100, 16, 0.5, 4, 8},
+		{8, 100, 16, 0, 2, 8},
+		{8, 3, 16, 1, 3, 8},
+		{8, 100, 2, 1, 8, 2},
+		{1, 100, 16, 1, 1, 1},
+		{0, 100, 16, 1, 1, 1},
+		{8, 0, 0, 1, 1, 1},
+		{8, 100, 16, 2, 8, 8},
+		{8, 100, 16, -1, 2, 8},
+	}
+
+	for _, tt := range tests {
+		m, r := autoTune(tt.numCPU, tt.numInputs, tt.numPartitions, tt.cpuBound)
+		if m != tt.mappers || r != tt.reducers {
+			t.Errorf("autoTune(%d, %d, %d, %v)=%d, %d, want %d, %d", tt.numCPU, tt.numInputs, tt.numPartitions, tt.cpuBound, m, r, tt.mappers, tt.reducers)
+		}
+	}
+
+	// whatever the inputs, the counts are sane
+	for numCPU := 1; numCPU <= 64; numCPU *= 2 {
+		for _, cpuBound := range []float64{0, 0.1, 0.5, 0.9, 1} {
+			for _, n := range []int{1, 5, 1000} {
+				m, r := autoTune(numCPU, n, n, cpuBound)
+				if m < 1 || m > numCPU || m > n {
+					t.Errorf("autoTune(%d, %d, %d, %v): %d mappers", numCPU, n, n, cpuBound, m)
+				}
+				if r < 1 || r > numCPU || r > n {
+					t.Errorf("autoTune(%d, %d, %d, %v): %d reducers", numCPU, n, n, cpuBound, r)
+				}
+			}
+		}
+	}
+}
+
+func TestCPUBoundFraction(t *testing.T) {
+
+	open := func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("some input\n")), nil
+	}
+	failOpen := func() (io.ReadCloser, error) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var tests = []struct {
+		name     string
+		mapTime  time.Duration
+		open     func() (io.ReadCloser, error)
+		min, max float64
+	}{
+		// reading a short string takes next to no time compared with an hour of mapping
+		{"slow map", time.Hour, open, 0.99, 1},
+		{"no map time", 0, open, 0, 0},
+		{"can't reopen", time.Second, failOpen, 1, 1},
+	}
+
+	for _, tt := range tests {
+		if f := cpuBoundFraction(tt.mapTime, tt.open); f < tt.min || f > tt.max {
+			t.Errorf("%s: cpuBoundFraction=%v, want in [%v, %v]", tt.name, f, tt.min, tt.max)
+		}
+	}
+}
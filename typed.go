@@ -0,0 +1,61 @@
+package dmrgo
+
+// Reducing values decoded by a StreamProtocol
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// TypedReducer is implemented by jobs whose reduce takes decoded values
+// rather than strings.  If a job implements it, TypedReduce is called for
+// each key instead of Reduce, with each value decoded by the protocol into a
+// new value of the zero value's type.  The protocol must implement
+// ValueUnmarshaler, as the built-in protocols do.  Values which can't be
+// decoded are skipped (or fail the run in --strict mode).
+type TypedReducer interface {
+	// ReduceValues returns the protocol the values were marshalled with and a zero value of their type
+	ReduceValues() (protocol StreamProtocol, zero interface{})
+
+	TypedReduce(reduceKey string, sortKey string, values <-chan interface{}, emitter Emitter)
+}
+
+// typedValueUnmarshaler returns the ValueUnmarshaler and value type of a TypedReducer
+func typedValueUnmarshaler(r TypedReducer) (ValueUnmarshaler, reflect.Type, error) {
+
+	p, zero := r.ReduceValues()
+
+	u, ok := p.(ValueUnmarshaler)
+	if !ok {
+		return nil, nil, fmt.Errorf("protocol %T can't unmarshal single values", p)
+	}
+
+	if zero == nil {
+		return nil, nil, fmt.Errorf("no value type for the typed reduce")
+	}
+
+	return u, reflect.TypeOf(zero), nil
+}
+
+// typedReduce decodes the values for a key and streams them to TypedReduce
+func typedReduce(r TypedReducer, reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+
+	u, vType, err := typedValueUnmarshaler(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	// the protocol reports the values it can't decode
+	decode := func(s string) (interface{}, error) {
+		v := reflect.New(vType)
+		err := u.UnmarshalValue(s, v.Interface())
+		return v.Elem().Interface(), err
+	}
+
+	decodeValues(values, decode, func(typed <-chan interface{}) {
+		r.TypedReduce(reduceKey, sortKey, typed, emitter)
+	})
+}
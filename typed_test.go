@@ -0,0 +1,87 @@
+package dmrgo
+
+// Tests for TypedReducer
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type sale struct {
+	Item  string
+	Price int
+}
+
+// salesJob totals the prices of the sales for each shop.  Its input lines are "shop item price".
+type salesJob struct{}
+
+func (*salesJob) Map(key string, value string, emitter Emitter) {
+	f := strings.Fields(value)
+	price, _ := strconv.Atoi(f[2])
+	kv := new(JSONProtocol).Marshal(f[0], nil, sale{f[1], price})
+	emitter.Emit(kv.ReduceKey, kv.SortKey, kv.Value)
+}
+
+func (*salesJob) MapFinal(emitter Emitter) {}
+
+func (*salesJob) Reduce(reduceKey string, sortKey string, values <-chan string, emitter Emitter) {
+	panic("Reduce called for a TypedReducer")
+}
+
+func (*salesJob) ReduceValues() (StreamProtocol, interface{}) {
+	return new(JSONProtocol), sale{}
+}
+
+func (*salesJob) TypedReduce(reduceKey string, sortKey string, values <-chan interface{}, emitter Emitter) {
+	var items []string
+	total := 0
+	for v := range values {
+		s := v.(sale)
+		items = append(items, s.Item)
+		total += s.Price
+	}
+	emitter.Emit(reduceKey, "", strings.Join(items, ",")+" "+strconv.Itoa(total))
+}
+
+func TestTypedReduce(t *testing.T) {
+
+	input := "north apple 3\nsouth pear 5\nnorth plum 4\n"
+
+	got, err := RunLocal(new(salesJob), strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the reduce key was marshalled as JSON
+	want := []KeyValue{
+		{`"north"`, "", "apple,plum 7"},
+		{`"south"`, "", "pear 5"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got[%d]=%v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestTypedReduceSkipsBadValues(t *testing.T) {
+
+	values := make(chan string, 3)
+	values <- `{"Item":"apple","Price":3}`
+	values <- `{"Item":`
+	values <- `{"Item":"plum","Price":4}`
+	close(values)
+
+	var got []KeyValue
+	typedReduce(new(salesJob), "north", "", values, NewFuncEmitter(func(kv *KeyValue) { got = append(got, *kv) }))
+
+	if len(got) != 1 || got[0].Value != "apple,plum 7" {
+		t.Errorf("got %v, want apple,plum 7", got)
+	}
+}
@@ -0,0 +1,101 @@
+package dmrgo
+
+// Checking a job and its options before running it
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Validator is implemented by jobs which can check their own configuration,
+// e.g. that a protocol has been set.  Validate calls it after checking the
+// runner's options.
+type Validator interface {
+	Validate() error
+}
+
+// Validate checks a job and the command-line options before it is run, so a
+// bad configuration is reported up front rather than failing part way through
+// the run.  Main and RunContext call it first.
+func Validate(mrjob MapReduceJob) error {
+
+	if mrjob == nil {
+		return errors.New("no job to run")
+	}
+
+	if optNumPartitions < 1 {
+		return fmt.Errorf("--partitions must be at least 1, got %d", optNumPartitions)
+	}
+	if optNumMappers < 1 {
+		return fmt.Errorf("--mappers must be at least 1, got %d", optNumMappers)
+	}
+	if optNumReducers < 1 {
+		return fmt.Errorf("--reducers must be at least 1, got %d", optNumReducers)
+	}
+	if optNumSorts < 0 {
+		return fmt.Errorf("--sorts can't be negative, got %d", optNumSorts)
+	}
+	if optSpillSize < 0 {
+		return fmt.Errorf("--spill-size can't be negative, got %d", optSpillSize)
+	}
+	if optCombineBuffer < 1 {
+		return fmt.Errorf("--combine-buffer must be at least 1, got %d", optCombineBuffer)
+	}
+	if optGzipLevel < gzip.HuffmanOnly || optGzipLevel > gzip.BestCompression {
+		return fmt.Errorf("--gzip-level must be between %d and %d, got %d", gzip.HuffmanOnly, gzip.BestCompression, optGzipLevel)
+	}
+	if optSkewThreshold < 0 || optSkewThreshold > 1 {
+		return fmt.Errorf("--skew-threshold must be between 0 and 1, got %g", optSkewThreshold)
+	}
+	if optExpectRecords < -1 {
+		return fmt.Errorf("--expect-records can't be less than -1, got %d", optExpectRecords)
+	}
+	if Retry.MaxAttempts < 1 {
+		return fmt.Errorf("--retries must be at least 1, got %d", Retry.MaxAttempts)
+	}
+	if optPadSortKeys < 0 {
+		return fmt.Errorf("--pad-sort-keys can't be negative, got %d", optPadSortKeys)
+	}
+	if optTmpDir == "" || optOutputDir == "" {
+		return errors.New("--tmp-dir and --output-dir can't be empty")
+	}
+	if optHeartbeatInterval < 0 {
+		return fmt.Errorf("--heartbeat-interval can't be negative, got %v", optHeartbeatInterval)
+	}
+	if _, err := strconv.Unquote(`"` + optRecordDelimiter + `"`); err != nil {
+		return fmt.Errorf("bad --record-delimiter %q: %v", optRecordDelimiter, err)
+	}
+	if _, err := parsePartitions(optPartitionsOnly, optNumPartitions); err != nil {
+		return err
+	}
+	switch optKeyEncoding {
+	case "url", "base64", "none":
+	default:
+		return fmt.Errorf("--key-encoding must be url, base64 or none, got %q", optKeyEncoding)
+	}
+	if err := checkSeparators(); err != nil {
+		return err
+	}
+	// routed and per-key output has no single place for the end of a group
+	if optGroupSentinel != "" && (optOutputPerKey != "" || ReduceOutputRouter != nil) {
+		return errors.New("--group-sentinel can't be used with --output-per-key or a ReduceOutputRouter")
+	}
+
+	if r, ok := mrjob.(TypedReducer); ok {
+		if _, _, err := typedValueUnmarshaler(r); err != nil {
+			return fmt.Errorf("invalid job: %v", err)
+		}
+	}
+
+	if v, ok := mrjob.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("invalid job: %v", err)
+		}
+	}
+
+	return nil
+}
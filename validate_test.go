@@ -0,0 +1,94 @@
+package dmrgo
+
+// Tests for checking a job before running it
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validatingJob is a countJob which checks its own configuration
+type validatingJob struct {
+	countJob
+	err error
+}
+
+func (j *validatingJob) Validate() error {
+	return j.err
+}
+
+func TestValidate(t *testing.T) {
+
+	var tests = []struct {
+		name  string
+		job   MapReduceJob
+		setup func(t *testing.T)
+		want  string
+	}{
+		{"valid", new(countJob), func(t *testing.T) {}, ""},
+		{"valid job", &validatingJob{}, func(t *testing.T) {}, ""},
+		{"no job", nil, func(t *testing.T) {}, "no job to run"},
+		{"partitions", new(countJob), func(t *testing.T) { setOpt(t, &optNumPartitions, 0) }, "--partitions must be at least 1"},
+		{"mappers", new(countJob), func(t *testing.T) { setOpt(t, &optNumMappers, 0) }, "--mappers must be at least 1"},
+		{"reducers", new(countJob), func(t *testing.T) { setOpt(t, &optNumReducers, -1) }, "--reducers must be at least 1"},
+		{"sorts", new(countJob), func(t *testing.T) { setOpt(t, &optNumSorts, -1) }, "--sorts can't be negative"},
+		{"spill size", new(countJob), func(t *testing.T) { setOpt(t, &optSpillSize, -1) }, "--spill-size can't be negative"},
+		{"combine buffer", new(countJob), func(t *testing.T) { setOpt(t, &optCombineBuffer, 0) }, "--combine-buffer must be at least 1"},
+		{"gzip level", new(countJob), func(t *testing.T) { setOpt(t, &optGzipLevel, 10) }, "--gzip-level must be between"},
+		{"skew threshold", new(countJob), func(t *testing.T) { setOpt(t, &optSkewThreshold, 1.5) }, "--skew-threshold must be between 0 and 1"},
+		{"expect records", new(countJob), func(t *testing.T) { setOpt(t, &optExpectRecords, -2) }, "--expect-records can't be less than -1"},
+		{"retries", new(countJob), func(t *testing.T) { setOpt(t, &Retry.MaxAttempts, 0) }, "--retries must be at least 1"},
+		{"pad sort keys", new(countJob), func(t *testing.T) { setOpt(t, &optPadSortKeys, -1) }, "--pad-sort-keys can't be negative"},
+		{"tmp dir", new(countJob), func(t *testing.T) { setOpt(t, &optTmpDir, "") }, "--tmp-dir and --output-dir can't be empty"},
+		{"output dir", new(countJob), func(t *testing.T) { setOpt(t, &optOutputDir, "") }, "--tmp-dir and --output-dir can't be empty"},
+		{"heartbeat", new(countJob), func(t *testing.T) { setOpt(t, &optHeartbeatInterval, -time.Second) }, "--heartbeat-interval can't be negative"},
+		{"record delimiter", new(countJob), func(t *testing.T) { setOpt(t, &optRecordDelimiter, `\q`) }, "bad --record-delimiter"},
+		{"partitions only", new(countJob), func(t *testing.T) {
+			setOpt(t, &optNumPartitions, 2)
+			setOpt(t, &optPartitionsOnly, "2")
+		}, "bad partition"},
+		{"key encoding", new(countJob), func(t *testing.T) { setOpt(t, &optKeyEncoding, "hex") }, "--key-encoding must be url, base64 or none"},
+		{"separators", new(countJob), func(t *testing.T) { setOpt(t, &keySeparator, '\t') }, "the field and key separators are both"},
+		{"sentinel per key", new(countJob), func(t *testing.T) {
+			setOpt(t, &optGroupSentinel, "--")
+			setOpt(t, &optOutputPerKey, t.TempDir())
+		}, "--group-sentinel can't be used with --output-per-key"},
+		{"sentinel routed", new(countJob), func(t *testing.T) {
+			setOpt(t, &optGroupSentinel, "--")
+			setOpt(t, &ReduceOutputRouter, func(reduceKey, sortKey, value string) string { return reduceKey })
+		}, "--group-sentinel can't be used with --output-per-key or a ReduceOutputRouter"},
+		{"job's own check", &validatingJob{err: errors.New("no protocol set")}, func(t *testing.T) {}, "invalid job: no protocol set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup(t)
+
+			err := Validate(tt.job)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate()=%v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate()=%v, want an error containing %q", err, tt.want)
+			}
+
+			// RunContext reports the same error before starting the run
+			dir := setupTestRun(t, "a\n")
+			tt.setup(t)
+			if _, rerr := RunContext(context.Background(), tt.job); rerr == nil || rerr.Error() != err.Error() {
+				t.Errorf("RunContext()=%v, want %v", rerr, err)
+			}
+			if fns := tempFiles(t, dir); len(fns) != 0 {
+				t.Errorf("temp files left behind: %q", fns)
+			}
+		})
+	}
+}
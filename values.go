@@ -0,0 +1,228 @@
+package dmrgo
+
+// Re-readable collections of a key's values, for reduces which make more than one pass
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// DefaultValueBufferMemory is the number of bytes of values a ValueBuffer holds in memory before spilling
+const DefaultValueBufferMemory = 64 << 20
+
+// ValueBuffer collects values so they can be read more than once, e.g. to
+// compute a mean and then the deviations from it.  Values are held in memory
+// until they total more than its memory limit, and then all of them are
+// spilled to a temporary file in the --tmp-dir, created with TempFileFunc,
+// so a hot key doesn't exhaust memory.  Close removes the temporary file.
+type ValueBuffer struct {
+	limit int
+	size  int
+	n     int
+	mem   []string
+
+	f       *os.File
+	w       *bufio.Writer
+	written int64
+}
+
+// NewValueBuffer returns an empty ValueBuffer which spills once it holds more
+// than maxMemory bytes of values.  maxMemory <= 0 means
+// DefaultValueBufferMemory.
+func NewValueBuffer(maxMemory int) *ValueBuffer {
+	if maxMemory <= 0 {
+		maxMemory = DefaultValueBufferMemory
+	}
+	return &ValueBuffer{limit: maxMemory}
+}
+
+// CollectValues reads all of a Reduce's values into a new ValueBuffer
+func CollectValues(values <-chan string, maxMemory int) (*ValueBuffer, error) {
+
+	b := NewValueBuffer(maxMemory)
+
+	var err error
+	for v := range values {
+		if err == nil {
+			err = b.Add(v)
+		}
+		// keep draining values so the reducer isn't blocked
+	}
+
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Add appends a value to the buffer
+func (b *ValueBuffer) Add(v string) error {
+
+	b.n++
+
+	if b.f == nil {
+		b.mem = append(b.mem, v)
+		b.size += len(v)
+		if b.size <= b.limit {
+			return nil
+		}
+		return b.spill()
+	}
+
+	return b.writeValue(v)
+}
+
+// spill moves the values held in memory to a temporary file
+func (b *ValueBuffer) spill() error {
+
+	f, err := createValueFile()
+	if err != nil {
+		return err
+	}
+	b.f = f
+	b.w = bufio.NewWriter(f)
+
+	for _, v := range b.mem {
+		if err := b.writeValue(v); err != nil {
+			return err
+		}
+	}
+
+	b.mem = nil
+	b.size = 0
+
+	return nil
+}
+
+// valueFiles numbers the spill files of ValueBuffers, so each gets its own
+var valueFiles int64
+
+// createValueFile creates a spill file for a ValueBuffer, named for the run
+// like the map spill files, and skipping any names left by an earlier run
+func createValueFile() (*os.File, error) {
+	for {
+		n := atomic.AddInt64(&valueFiles, 1)
+		f, err := TempFileFunc(valueFileName(jobID(), n))
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+// writeValue writes a length-prefixed value to the spill file, so values may hold any bytes
+func (b *ValueBuffer) writeValue(v string) error {
+
+	var hdr [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdr[:], uint64(len(v)))
+
+	if _, err := b.w.Write(hdr[:n]); err != nil {
+		return err
+	}
+	if _, err := b.w.WriteString(v); err != nil {
+		return err
+	}
+
+	b.written += int64(n + len(v))
+
+	return nil
+}
+
+// Len returns the number of values in the buffer
+func (b *ValueBuffer) Len() int {
+	return b.n
+}
+
+// Spilled returns whether the values have been spilled to disk
+func (b *ValueBuffer) Spilled() bool {
+	return b.f != nil
+}
+
+// Values returns an iterator over the values added so far, in the order they
+// were added.  It may be called any number of times, for as many passes as
+// are needed, but the buffer must not be added to while an iterator is in
+// use.
+func (b *ValueBuffer) Values() (*ValueBufferIterator, error) {
+
+	if b.f == nil {
+		return &ValueBufferIterator{mem: b.mem}, nil
+	}
+
+	if err := b.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return &ValueBufferIterator{br: bufio.NewReader(io.NewSectionReader(b.f, 0, b.written))}, nil
+}
+
+// Close releases the buffer's values and removes its temporary file
+func (b *ValueBuffer) Close() error {
+
+	b.mem = nil
+	b.n = 0
+
+	if b.f == nil {
+		return nil
+	}
+
+	err := b.f.Close()
+	if rerr := os.Remove(b.f.Name()); err == nil {
+		err = rerr
+	}
+	b.f = nil
+	b.w = nil
+
+	return err
+}
+
+// ValueBufferIterator is a single pass over the values of a ValueBuffer
+type ValueBufferIterator struct {
+	mem []string
+	br  *bufio.Reader
+	err error
+}
+
+// Next consumes and returns the next value.  ok is false if there are no
+// more values or there was an error reading them.
+func (it *ValueBufferIterator) Next() (value string, ok bool) {
+
+	if it.br == nil {
+		if len(it.mem) == 0 {
+			return "", false
+		}
+		value = it.mem[0]
+		it.mem = it.mem[1:]
+		return value, true
+	}
+
+	if it.err != nil {
+		return "", false
+	}
+
+	l, err := binary.ReadUvarint(it.br)
+	if err != nil {
+		if err != io.EOF {
+			it.err = err
+		}
+		return "", false
+	}
+
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(it.br, buf); err != nil {
+		it.err = err
+		return "", false
+	}
+
+	return string(buf), true
+}
+
+// Err returns the error, if any, which stopped the iteration
+func (it *ValueBufferIterator) Err() error {
+	return it.err
+}
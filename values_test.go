@@ -0,0 +1,140 @@
+package dmrgo
+
+// Tests for ValueBuffer
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// meanDeviation makes two passes over a key's values: one for the mean and one for the mean absolute deviation from it
+func meanDeviation(t *testing.T, b *ValueBuffer) (float64, float64) {
+
+	var sum float64
+	it, err := b.Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		f, _ := strconv.ParseFloat(v, 64)
+		sum += f
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	mean := sum / float64(b.Len())
+
+	var dev float64
+	it, err = b.Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		f, _ := strconv.ParseFloat(v, 64)
+		dev += math.Abs(f - mean)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return mean, dev / float64(b.Len())
+}
+
+func TestValueBufferTwoPass(t *testing.T) {
+
+	dir := t.TempDir()
+	setOpt(t, &optTmpDir, dir)
+
+	var created []string
+	setOpt(t, &TempFileFunc, func(name string) (*os.File, error) {
+		created = append(created, name)
+		return createExclusive(name)
+	})
+
+	var tests = []struct {
+		n         int
+		maxMemory int
+		spilled   bool
+	}{
+		{10, 0, false},
+		{100000, 1000, true},
+	}
+
+	for _, tt := range tests {
+
+		// 0, 2, 4, ...: the mean is n-1 and the mean deviation n/2
+		values := make(chan string, 64)
+		go func() {
+			for i := 0; i < tt.n; i++ {
+				values <- strconv.Itoa(2 * i)
+			}
+			close(values)
+		}()
+
+		b, err := CollectValues(values, tt.maxMemory)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b.Len() != tt.n || b.Spilled() != tt.spilled {
+			t.Errorf("n=%d: Len()=%d Spilled()=%v, want %d %v", tt.n, b.Len(), b.Spilled(), tt.n, tt.spilled)
+		}
+
+		mean, dev := meanDeviation(t, b)
+		if mean != float64(tt.n-1) || dev != float64(tt.n)/2 {
+			t.Errorf("n=%d: mean %v deviation %v, want %v %v", tt.n, mean, dev, tt.n-1, tt.n/2)
+		}
+
+		if err := b.Close(); err != nil {
+			t.Errorf("n=%d: Close: %v", tt.n, err)
+		}
+	}
+
+	if len(created) != 1 || filepath.Dir(created[0]) != dir {
+		t.Errorf("spill files %q, want one in %s", created, dir)
+	}
+	if fns, _ := filepath.Glob(filepath.Join(dir, "*")); len(fns) != 0 {
+		t.Errorf("files left after Close: %q", fns)
+	}
+}
+
+func TestValueBufferFileName(t *testing.T) {
+
+	setOpt(t, &optTmpDir, t.TempDir())
+
+	var tests = []struct {
+		jobID int
+		want  int
+	}{
+		{0, os.Getpid()},
+		{42, 42},
+	}
+
+	for _, tt := range tests {
+		setOpt(t, &optJobID, tt.jobID)
+
+		var created string
+		setOpt(t, &TempFileFunc, func(name string) (*os.File, error) {
+			created = name
+			return createExclusive(name)
+		})
+
+		b := NewValueBuffer(1)
+		if err := b.Add("spilled"); err != nil {
+			t.Fatal(err)
+		}
+		b.Close()
+
+		// named for the run, like the map spill files
+		if prefix := fmt.Sprintf("tmp-values-p%d-", tt.want); !strings.HasPrefix(filepath.Base(created), prefix) {
+			t.Errorf("--job-id %d: spill file %q, want it to start with %q", tt.jobID, created, prefix)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package dmrgo
+
+// XML protocol for interop with legacy feeds
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+)
+
+// XMLProtocol encodes values as XML fragments with encoding/xml, so struct
+// tags (including attributes and nested elements) control the layout.
+// Fragments are written on a single line, without indentation: encoding/xml
+// escapes newlines in text and attributes, and any left in raw XML (e.g.
+// ",innerxml" fields) are replaced by spaces.  Keys are primitives, written
+// as by TSVProtocol.
+type XMLProtocol struct {
+	// empty -- just a type
+}
+
+var _ StreamProtocol = (*XMLProtocol)(nil)
+var _ ValueUnmarshaler = (*XMLProtocol)(nil)
+
+// xmlNewlines replaces the raw newlines left in marshalled XML
+var xmlNewlines = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// Marshal implements the StreamProtocol interface.  A nil sortKey is written as no sort key.
+func (p *XMLProtocol) Marshal(reduceKey interface{}, sortKey interface{}, value interface{}) *KeyValue {
+	v, _ := xml.Marshal(value)
+	r, s := marshalKeys(reduceKey, sortKey)
+	return &KeyValue{r, s, xmlNewlines.Replace(string(v))}
+}
+
+// UnmarshalKVs implements the StreamProtocol interface
+func (p *XMLProtocol) UnmarshalKVs(key string, values []string, k interface{}, vs interface{}) error {
+
+	var errs RecordErrors
+
+	if err := scanField(key, reflect.ValueOf(k).Elem()); err != nil {
+		errs.add(-1, err)
+	}
+
+	vsPtrValue := reflect.ValueOf(vs)
+	vsType := reflect.TypeOf(vs).Elem()
+
+	v := reflect.MakeSlice(vsType, len(values), len(values))
+
+	for i, s := range values {
+		p.unmarshalValue(s, v.Index(i), i, &errs)
+	}
+
+	vsPtrValue.Elem().Set(v)
+
+	return errs.err()
+}
+
+// UnmarshalValue implements the ValueUnmarshaler interface
+func (p *XMLProtocol) UnmarshalValue(value string, v interface{}) error {
+	var errs RecordErrors
+	p.unmarshalValue(value, reflect.ValueOf(v).Elem(), 0, &errs)
+	return errs.err()
+}
+
+// unmarshalValue decodes the vi'th value into e, recording any errors in errs
+func (p *XMLProtocol) unmarshalValue(s string, e reflect.Value, vi int, errs *RecordErrors) {
+	if err := xml.Unmarshal([]byte(s), e.Addr().Interface()); err != nil {
+		// skip, unless we're being strict
+		errs.add(vi, err)
+	}
+}
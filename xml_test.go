@@ -0,0 +1,125 @@
+package dmrgo
+
+// Tests for the XML protocol
+// Copyright (c) 2011 Damian Gryski <damian@gryski.com>
+// License: GPLv3 or, at your option, any later version
+
+import (
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type feedAddress struct {
+	Street string `xml:"street"`
+	City   string `xml:"city,attr,omitempty"`
+}
+
+// feedItem has attributes, nested elements and text which may span lines
+type feedItem struct {
+	XMLName xml.Name    `xml:"item"`
+	ID      int         `xml:"id,attr"`
+	Lang    string      `xml:"lang,attr,omitempty"`
+	Title   string      `xml:"title"`
+	Address feedAddress `xml:"address"`
+	Tags    []string    `xml:"tags>tag"`
+}
+
+func TestXMLRoundTrip(t *testing.T) {
+
+	var tests = []struct {
+		name  string
+		value feedItem
+		want  string
+	}{
+		{"attributes", feedItem{ID: 1, Lang: "en", Title: "one"},
+			`<item id="1" lang="en"><title>one</title><address><street></street></address><tags></tags></item>`},
+		{"nested", feedItem{ID: 2, Title: "two", Address: feedAddress{"1 High St", "Leeds"}, Tags: []string{"a", "b"}},
+			`<item id="2"><title>two</title><address city="Leeds"><street>1 High St</street></address><tags><tag>a</tag><tag>b</tag></tags></item>`},
+		{"newlines", feedItem{ID: 3, Title: "two\nlines", Address: feedAddress{"a\r\nb", "x\ny"}},
+			`<item id="3"><title>two&#xA;lines</title><address city="x&#xA;y"><street>a&#xD;&#xA;b</street></address><tags></tags></item>`},
+		{"escaping", feedItem{ID: 4, Title: `<&">`},
+			`<item id="4"><title>&lt;&amp;&#34;&gt;</title><address><street></street></address><tags></tags></item>`},
+	}
+
+	p := new(XMLProtocol)
+
+	for _, tt := range tests {
+		kv := p.Marshal("key", nil, tt.value)
+		if kv.Value != tt.want {
+			t.Errorf("%s: Marshal gave %q, want %q", tt.name, kv.Value, tt.want)
+		}
+		if strings.ContainsAny(kv.Value, "\r\n") {
+			t.Errorf("%s: Marshal gave %q, which isn't a single line", tt.name, kv.Value)
+		}
+
+		var k string
+		var vs []feedItem
+		if err := p.UnmarshalKVs(kv.ReduceKey, []string{kv.Value}, &k, &vs); err != nil {
+			t.Errorf("%s: UnmarshalKVs(%q): %v", tt.name, kv.Value, err)
+			continue
+		}
+		want := tt.value
+		want.XMLName = xml.Name{Local: "item"}
+		if k != "key" || !reflect.DeepEqual(vs, []feedItem{want}) {
+			t.Errorf("%s: round trip gave %q %+v, want %+v", tt.name, k, vs, want)
+		}
+	}
+}
+
+// rawXML has a field written as raw XML, which may contain newlines
+type rawXML struct {
+	XMLName xml.Name `xml:"raw"`
+	Inner   string   `xml:",innerxml"`
+}
+
+func TestXMLRawNewlines(t *testing.T) {
+
+	var tests = []struct {
+		inner string
+		want  string
+	}{
+		{"<a/>", "<raw><a/></raw>"},
+		{"<a>\n  <b/>\r\n</a>", "<raw><a>   <b/> </a></raw>"},
+	}
+
+	for _, tt := range tests {
+		kv := new(XMLProtocol).Marshal("k", nil, rawXML{Inner: tt.inner})
+		if kv.Value != tt.want {
+			t.Errorf("Marshal of inner XML %q gave %q, want %q", tt.inner, kv.Value, tt.want)
+		}
+	}
+}
+
+func TestXMLUnmarshalKVsErrors(t *testing.T) {
+
+	var tests = []struct {
+		values  []string
+		indexes []int
+	}{
+		{[]string{`<item id="1"></item>`, `<item id="2"></item>`}, nil},
+		{[]string{`<item id="1"></item>`, `<item id="2">`, `<item id="x"></item>`}, []int{1, 2}},
+		{[]string{`not xml`}, []int{0}},
+	}
+
+	defer resetFailure()
+
+	for _, tt := range tests {
+		var k string
+		var vs []feedItem
+		err := new(XMLProtocol).UnmarshalKVs("key", tt.values, &k, &vs)
+
+		var indexes []int
+		var errs RecordErrors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				indexes = append(indexes, e.Index)
+			}
+		}
+		if !reflect.DeepEqual(indexes, tt.indexes) {
+			t.Errorf("UnmarshalKVs(%q): errors %v at %v, want errors at %v", tt.values, err, indexes, tt.indexes)
+		}
+	}
+}